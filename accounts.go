@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+)
+
+// accountKey holds the pool *account a request was assigned, if any.
+const accountKey = "account"
+
+// account is one team-owned upstream account of the pool.
+type account struct {
+	AccountConfig
+	CooldownUntil time.Time
+	Requests      int64
+	Failures      int64
+	LastStatus    int
+	LastError     string
+}
+
+func (a *account) Credential() Credential {
+	baseURL := a.BaseURL
+	if baseURL == "" {
+		baseURL = config.Upstream.BaseURLFor(a.PUID)
+	}
+	return Credential{AccessToken: a.AccessToken, PUID: a.PUID, BaseURL: baseURL}
+}
+
+// accountPool serves requests made with pool keys from the accounts in
+// accounts.list, round robin. An account the upstream rejects or fails on
+// cools down before it is used again.
+type accountPool struct {
+	cfg      AccountsConfig
+	mu       sync.Mutex
+	accounts []*account
+	next     int
+}
+
+func newAccountPool(cfg AccountsConfig) *accountPool {
+	pool := &accountPool{cfg: cfg}
+	for _, a := range cfg.List {
+		pool.accounts = append(pool.accounts, &account{AccountConfig: a})
+	}
+	return pool
+}
+
+// available reports whether a can take requests: not cooling down and its
+// access token not expired.
+func (a *account) available(now time.Time) bool {
+	if now.Before(a.CooldownUntil) {
+		return false
+	}
+	claims, err := parseAccessToken(a.AccessToken)
+	return err == nil && claims.ExpiresAt.After(now)
+}
+
+// Acquire picks the next available account that is not in tried.
+func (p *accountPool) Acquire(tried map[string]bool) (*account, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i, ok := p.nextLocked(tried)
+	if !ok {
+		return nil, false
+	}
+	a := p.accounts[i]
+	p.next = (i + 1) % len(p.accounts)
+	a.Requests++
+	return a, true
+}
+
+// Peek returns the account Acquire would pick without taking it, for
+// requests that only read from the upstream.
+func (p *accountPool) Peek() (*account, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i, ok := p.nextLocked(nil)
+	if !ok {
+		return nil, false
+	}
+	return p.accounts[i], true
+}
+
+func (p *accountPool) nextLocked(tried map[string]bool) (int, bool) {
+	now := time.Now()
+	for i := range p.accounts {
+		j := (p.next + i) % len(p.accounts)
+		if a := p.accounts[j]; !tried[a.Name] && a.available(now) {
+			return j, true
+		}
+	}
+	return 0, false
+}
+
+// accountFailed reports whether status means the account itself should
+// not be used for a while: rejected credentials or an upstream failure.
+func accountFailed(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden || status >= 500
+}
+
+// Fail puts a into cooldown after the upstream answered status.
+func (p *accountPool) Fail(a *account, status int, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cooldown := time.Duration(p.cfg.Cooldown)
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		cooldown = time.Duration(p.cfg.AuthCooldown)
+	}
+	a.Failures++
+	a.LastStatus = status
+	a.LastError = reason
+	a.CooldownUntil = time.Now().Add(cooldown)
+	fmt.Printf("Account %s cooling down for %s after upstream returned %d\n", a.Name, cooldown, status)
+}
+
+// List returns the configuration of every account of the pool.
+func (p *accountPool) List() []AccountConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]AccountConfig, 0, len(p.accounts))
+	for _, a := range p.accounts {
+		list = append(list, a.AccountConfig)
+	}
+	return list
+}
+
+// Reset ends the cooldown of account name.
+func (p *accountPool) Reset(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.accounts {
+		if a.Name == name {
+			a.CooldownUntil = time.Time{}
+			return true
+		}
+	}
+	return false
+}
+
+type accountView struct {
+	Name          string     `json:"name"`
+	PUID          string     `json:"puid"`
+	Healthy       bool       `json:"healthy"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+	CooldownLeft  int64      `json:"cooldown_left"`
+	TokenStatus   string     `json:"token_status"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Requests      int64      `json:"requests"`
+	Failures      int64      `json:"failures"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Status reports every account of the pool.
+func (p *accountPool) Status() []accountView {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	views := make([]accountView, 0, len(p.accounts))
+	for _, a := range p.accounts {
+		view := accountView{
+			Name:       a.Name,
+			PUID:       a.PUID,
+			Healthy:    a.available(now),
+			Requests:   a.Requests,
+			Failures:   a.Failures,
+			LastStatus: a.LastStatus,
+			LastError:  a.LastError,
+		}
+		if now.Before(a.CooldownUntil) {
+			cooldownUntil := a.CooldownUntil
+			view.CooldownUntil = &cooldownUntil
+			view.CooldownLeft = int64(a.CooldownUntil.Sub(now) / time.Second)
+		}
+		if claims, err := parseAccessToken(a.AccessToken); err != nil {
+			view.TokenStatus = "invalid"
+		} else {
+			view.TokenStatus = claims.Status()
+			view.ExpiresAt = &claims.ExpiresAt
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// requestAccount returns the pool account assigned by acquireAccount, nil
+// for requests made with a credential of their own.
+func requestAccount(c *gin.Context) *account {
+	a, _ := c.Get(accountKey)
+	acc, _ := a.(*account)
+	return acc
+}
+
+// acquireAccount assigns requests made with a pool key an account of the
+// pool. It runs on the routes that send requests upstream.
+func (g *gateway) acquireAccount(c *gin.Context) {
+	value, _ := c.Get(apiKeyKey)
+	if key, _ := value.(*APIKey); key == nil || !key.Pool {
+		c.Next()
+		return
+	}
+	acc, ok := g.accounts.Acquire(nil)
+	if !ok {
+		noAvailableAccount(c)
+		return
+	}
+	c.Set(accountKey, acc)
+	c.Set(credentialKey, acc.Credential())
+	c.Next()
+}
+
+func noAvailableAccount(c *gin.Context) {
+	c.AbortWithStatusJSON(503, gin.H{"error": gin.H{
+		"message": "No upstream account is available, try again later",
+		"type":    "server_error",
+		"param":   nil,
+		"code":    "no_available_account",
+	}})
+}
+
+// conversation sends request upstream as cred. Requests served by the
+// account pool move to the next available account when the upstream
+// rejects or fails on the current one; this only happens before anything
+// is written to the client. It returns the response and the credential
+// that produced it, or false after writing the error to c.
+func (g *gateway) conversation(c *gin.Context, request ChatGPTRequest, cred Credential) (*http.Response, Credential, bool) {
+	acc := requestAccount(c)
+	if acc != nil {
+		cred = acc.Credential()
+	}
+	tried := map[string]bool{}
+	for {
+		// Uploaded files belong to the account, so images are uploaded again
+		// whenever the request moves to another one
+		if err := g.uploadImages(&request, cred); err != nil {
+			fmt.Println("Error uploading images: ", err)
+			c.JSON(502, gin.H{"error": gin.H{
+				"message": err.Error(),
+				"type":    "upstream_error",
+				"param":   "messages",
+				"code":    "image_upload_failed",
+			}})
+			return nil, cred, false
+		}
+		response, err := g.upstream.Conversation(c.Request.Context(), request, cred)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": "error sending request",
+			})
+			return nil, cred, false
+		}
+		if acc == nil || !accountFailed(response.StatusCode) {
+			if HandleRequestError(c, response) {
+				response.Body.Close()
+				return nil, cred, false
+			}
+			return response, cred, true
+		}
+		tried[acc.Name] = true
+		g.accounts.Fail(acc, response.StatusCode, response.Status)
+		next, ok := g.acquireWithCapacity(tried, request.Model)
+		if !ok {
+			HandleRequestError(c, response)
+			response.Body.Close()
+			return nil, cred, false
+		}
+		response.Body.Close()
+		fmt.Println("Retrying on account " + next.Name)
+		acc = next
+		c.Set(accountKey, acc)
+		cred = acc.Credential()
+		c.Set(credentialKey, cred)
+		g.moveCapacity(c, request.Model)
+		if request.ArkoseToken, err = g.upstream.ArkoseToken(cred); err != nil {
+			fmt.Println("Error getting Arkose token: ", err)
+		}
+	}
+}
+
+// acquireWithCapacity picks the next available account not in tried with
+// capacity left for slug, adding the accounts at their cap to tried.
+func (g *gateway) acquireWithCapacity(tried map[string]bool, slug string) (*account, bool) {
+	for {
+		next, ok := g.accounts.Acquire(tried)
+		if !ok {
+			return nil, false
+		}
+		if account, ids := next.capAccount(); g.caps.Available(account, ids, slug) {
+			return next, ok
+		}
+		tried[next.Name] = true
+	}
+}
+
+func (g *gateway) listAccounts(c *gin.Context) {
+	c.JSON(200, gin.H{"object": "list", "data": g.accounts.Status()})
+}
+
+func (g *gateway) resetAccount(c *gin.Context) {
+	name := c.Param("name")
+	if !g.accounts.Reset(name) {
+		c.JSON(404, gin.H{"error": gin.H{
+			"message": "no such account " + name,
+			"type":    "invalid_request_error",
+			"param":   "name",
+			"code":    nil,
+		}})
+		return
+	}
+	c.JSON(200, gin.H{"name": name, "reset": true})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth guards the /admin api with the configured admin token. The api
+// is disabled while no token is configured.
+func adminAuth(c *gin.Context) {
+	if config.Admin.Token == "" {
+		c.AbortWithStatusJSON(403, gin.H{"error": gin.H{
+			"message": "admin api is disabled, set admin.token to enable it",
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    "admin_disabled",
+		}})
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+		c.AbortWithStatusJSON(401, gin.H{"error": gin.H{
+			"message": "invalid admin token",
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    "invalid_api_key",
+		}})
+		return
+	}
+	c.Next()
+}
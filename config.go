@@ -0,0 +1,734 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bogdanfinn/tls-client/profiles"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix 所有环境变量统一使用该前缀，例如 CHATGPT_REVERSE_LISTEN
+const envPrefix = "CHATGPT_REVERSE_"
+
+// defaultConfigFiles 未指定 --config 时按顺序在当前目录查找
+var defaultConfigFiles = []string{"config.yaml", "config.yml", "config.toml"}
+
+// Config is the effective runtime configuration. Values are layered in the
+// order defaults < config file < environment variables < command-line flags.
+type Config struct {
+	// Listen is the address the gateway binds to, e.g. ":9333".
+	Listen string `yaml:"listen" toml:"listen"`
+	// Proxy is the upstream proxy url, leave empty to connect directly.
+	// It is only used when proxies.list is empty.
+	Proxy   string        `yaml:"proxy" toml:"proxy"`
+	Proxies ProxiesConfig `yaml:"proxies" toml:"proxies"`
+	// DisableHistory 默认true不开启网页历史记录
+	DisableHistory bool `yaml:"disable_history" toml:"disable_history"`
+	// FakeUpstream is an SSE transcript file replayed for every conversation
+	// instead of calling the web backend, for offline testing.
+	FakeUpstream string         `yaml:"fake_upstream,omitempty" toml:"fake_upstream"`
+	Upstream     UpstreamConfig `yaml:"upstream" toml:"upstream"`
+	Stream       StreamConfig   `yaml:"stream" toml:"stream"`
+	Compat       CompatConfig   `yaml:"compat" toml:"compat"`
+	Tools        ToolsConfig    `yaml:"tools" toml:"tools"`
+	// ResponseFormat controls how json_object and json_schema replies are
+	// enforced.
+	ResponseFormat ResponseFormatConfig `yaml:"response_format" toml:"response_format"`
+	Models         ModelsConfig         `yaml:"models" toml:"models"`
+	// Routes maps public model names to upstream models.
+	Routes   ModelRoutes    `yaml:"routes" toml:"routes"`
+	Gizmos   GizmoConfig    `yaml:"gizmos" toml:"gizmos"`
+	Admin    AdminConfig    `yaml:"admin" toml:"admin"`
+	Keys     KeysConfig     `yaml:"keys" toml:"keys"`
+	Ledger   LedgerConfig   `yaml:"ledger" toml:"ledger"`
+	Accounts AccountsConfig `yaml:"accounts" toml:"accounts"`
+	Caps     CapsConfig     `yaml:"caps" toml:"caps"`
+	Tokens   TokensConfig   `yaml:"tokens" toml:"tokens"`
+	Sessions SessionsConfig `yaml:"sessions" toml:"sessions"`
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	Client   ClientConfig   `yaml:"client" toml:"client"`
+}
+
+// UpstreamConfig selects which web backend requests are sent to.
+type UpstreamConfig struct {
+	// BaseURL is the backend origin, every /backend-api path is derived from it.
+	BaseURL string `yaml:"base_url" toml:"base_url"`
+	// AccountBaseURLs overrides BaseURL for individual accounts, keyed by PUID.
+	AccountBaseURLs map[string]string `yaml:"account_base_urls,omitempty" toml:"account_base_urls"`
+}
+
+// BaseURLFor returns the base url configured for the account, if any.
+func (u UpstreamConfig) BaseURLFor(puid string) string {
+	if baseURL, ok := u.AccountBaseURLs[puid]; ok {
+		return baseURL
+	}
+	return u.BaseURL
+}
+
+// ProxiesConfig is a pool of upstream proxies with health checks.
+type ProxiesConfig struct {
+	// List holds http, https and socks5 proxy urls.
+	List []string `yaml:"list" toml:"list"`
+	// CheckURL is requested through every proxy each CheckInterval.
+	CheckURL      string   `yaml:"check_url" toml:"check_url"`
+	CheckInterval Duration `yaml:"check_interval" toml:"check_interval"`
+	CheckTimeout  Duration `yaml:"check_timeout" toml:"check_timeout"`
+	// FailThreshold consecutive errors take a proxy out of rotation until a
+	// health check succeeds.
+	FailThreshold int `yaml:"fail_threshold" toml:"fail_threshold"`
+}
+
+// StreamConfig controls how upstream snapshots are streamed to clients.
+type StreamConfig struct {
+	// RewritePolicy decides what happens when the upstream changes text that
+	// was already streamed: "ignore" or "error".
+	RewritePolicy string `yaml:"rewrite_policy" toml:"rewrite_policy"`
+}
+
+// CompatConfig controls how chat requests the gateway cannot fully honor
+// are treated.
+type CompatConfig struct {
+	// Mode is "lenient" to ignore unsupported parameters or "strict" to
+	// reject them and unknown parameters.
+	Mode string `yaml:"mode" toml:"mode"`
+}
+
+// ToolsConfig controls how function calling is emulated. Both templates
+// are Go text/templates, empty uses the built-in ones.
+type ToolsConfig struct {
+	// PromptTemplate renders the tool instructions, sent as the first system
+	// message. It is executed with .Tools (the function definitions as a
+	// JSON array), .Function, .Required and .Parallel.
+	PromptTemplate string `yaml:"prompt_template" toml:"prompt_template"`
+	// ResultTemplate renders a tool message, executed with .ID, .Name and
+	// .Content.
+	ResultTemplate string `yaml:"result_template" toml:"result_template"`
+}
+
+// ResponseFormatConfig controls structured outputs.
+type ResponseFormatConfig struct {
+	// RepairAttempts is how many times the model is asked to correct a
+	// reply that is not valid JSON or does not match the schema before the
+	// request fails.
+	RepairAttempts int `yaml:"repair_attempts" toml:"repair_attempts"`
+}
+
+// ModelsConfig controls what /v1/models reports.
+type ModelsConfig struct {
+	// List is reported in addition to the routed and upstream models,
+	// names that no route resolves are left out.
+	List []string `yaml:"list" toml:"list"`
+	// CacheTTL is how long a fetched upstream model list is reused.
+	CacheTTL Duration `yaml:"cache_ttl" toml:"cache_ttl"`
+}
+
+// GizmoConfig controls how gizmo definitions are cached.
+type GizmoConfig struct {
+	// CacheDir stores one JSON file per gizmo, empty keeps them in memory only.
+	CacheDir string   `yaml:"cache_dir" toml:"cache_dir"`
+	TTL      Duration `yaml:"ttl" toml:"ttl"`
+}
+
+// AdminConfig protects the /admin api.
+type AdminConfig struct {
+	// Token must be sent as "Authorization: Bearer <token>", empty disables the api.
+	Token string `yaml:"token" toml:"token"`
+}
+
+// KeysConfig controls gateway-issued API keys.
+type KeysConfig struct {
+	// File persists the issued keys, empty keeps them in memory only.
+	File string `yaml:"file" toml:"file"`
+	// AllowUpstreamTokens still accepts raw upstream access tokens with a
+	// PUid header in addition to gateway keys.
+	AllowUpstreamTokens bool `yaml:"allow_upstream_tokens" toml:"allow_upstream_tokens"`
+	// DefaultLimits applies to keys without limits of their own.
+	DefaultLimits KeyLimits `yaml:"default_limits" toml:"default_limits"`
+	// UsageFile persists the daily and monthly quota counters, empty keeps
+	// them in memory only.
+	UsageFile string `yaml:"usage_file" toml:"usage_file"`
+}
+
+// LedgerConfig controls the usage ledger behind /admin/usage.
+type LedgerConfig struct {
+	// File is the bbolt database every upstream exchange is recorded in,
+	// empty disables the ledger.
+	File string `yaml:"file" toml:"file"`
+}
+
+// AccountsConfig is a pool of team-owned upstream accounts. Requests made
+// with a pool key are spread over them and retried on another account when
+// one is rejected or fails.
+type AccountsConfig struct {
+	List []AccountConfig `yaml:"list" toml:"list"`
+	// Cooldown takes an account out of the pool after an upstream 5xx.
+	Cooldown Duration `yaml:"cooldown" toml:"cooldown"`
+	// AuthCooldown takes an account out of the pool after a 401 or 403.
+	AuthCooldown Duration `yaml:"auth_cooldown" toml:"auth_cooldown"`
+}
+
+// AccountConfig is one upstream account of the pool.
+type AccountConfig struct {
+	Name        string `yaml:"name" toml:"name"`
+	AccessToken string `yaml:"access_token" toml:"access_token"`
+	PUID        string `yaml:"puid" toml:"puid"`
+	BaseURL     string `yaml:"base_url,omitempty" toml:"base_url"`
+}
+
+// CapsConfig holds the local per-account usage caps.
+type CapsConfig struct {
+	// Rules are tried in order, the first one matching the upstream model
+	// and account applies.
+	Rules []CapRule `yaml:"rules" toml:"rules"`
+	// MaxQueue is how many requests may wait for one account's cap.
+	MaxQueue int `yaml:"max_queue" toml:"max_queue"`
+	// MaxWait is how long a request waits for capacity before a 429.
+	MaxWait Duration `yaml:"max_wait" toml:"max_wait"`
+}
+
+// TokensConfig controls how upstream access token expiry is tracked.
+type TokensConfig struct {
+	// WarnBefore is how long before expiry a stored token is reported as expiring.
+	WarnBefore Duration `yaml:"warn_before" toml:"warn_before"`
+	// CheckInterval is how often stored tokens are checked.
+	CheckInterval Duration `yaml:"check_interval" toml:"check_interval"`
+}
+
+// SessionsConfig controls the upstream session kept for each credential.
+type SessionsConfig struct {
+	// IdleTimeout drops a session, its cookies and connections, after this
+	// long without requests.
+	IdleTimeout Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+}
+
+// ServerConfig holds the http.Server settings used by initServer.
+type ServerConfig struct {
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout"`
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	WriteTimeout      Duration `yaml:"write_timeout" toml:"write_timeout"`
+	MaxHeaderBytes    int      `yaml:"max_header_bytes" toml:"max_header_bytes"`
+}
+
+// ClientConfig holds the tls-client options used to reach the upstream.
+type ClientConfig struct {
+	Timeout            Duration `yaml:"timeout" toml:"timeout"`
+	Profile            string   `yaml:"profile" toml:"profile"`
+	FollowRedirects    bool     `yaml:"follow_redirects" toml:"follow_redirects"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// Duration is a time.Duration that reads and writes as "30s", "5m" etc.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
+
+// config 当前生效的配置，main 启动时加载
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Listen:         ":9333",
+		Proxy:          "http://127.0.0.1:7890",
+		DisableHistory: true,
+		Proxies: ProxiesConfig{
+			CheckURL:      defaultBaseURL + "/favicon.ico",
+			CheckInterval: Duration(time.Minute),
+			CheckTimeout:  Duration(10 * time.Second),
+			FailThreshold: 3,
+		},
+		Upstream: UpstreamConfig{
+			BaseURL: defaultBaseURL,
+		},
+		Stream: StreamConfig{
+			RewritePolicy: RewriteError,
+		},
+		Compat: CompatConfig{
+			Mode: CompatLenient,
+		},
+		ResponseFormat: ResponseFormatConfig{
+			RepairAttempts: 2,
+		},
+		Models: ModelsConfig{
+			CacheTTL: Duration(10 * time.Minute),
+		},
+		Routes: defaultModelRoutes(),
+		Gizmos: GizmoConfig{
+			CacheDir: "gizmos",
+			TTL:      Duration(24 * time.Hour),
+		},
+		Keys: KeysConfig{
+			File:                "keys.json",
+			AllowUpstreamTokens: true,
+			UsageFile:           "key_usage.json",
+		},
+		Ledger: LedgerConfig{
+			File: "usage.db",
+		},
+		Accounts: AccountsConfig{
+			Cooldown:     Duration(time.Minute),
+			AuthCooldown: Duration(30 * time.Minute),
+		},
+		Caps: CapsConfig{
+			MaxQueue: 16,
+			MaxWait:  Duration(30 * time.Second),
+		},
+		Tokens: TokensConfig{
+			WarnBefore:    Duration(72 * time.Hour),
+			CheckInterval: Duration(10 * time.Minute),
+		},
+		Sessions: SessionsConfig{
+			IdleTimeout: Duration(30 * time.Minute),
+		},
+		Server: ServerConfig{
+			ReadTimeout:       Duration(1800 * time.Second),
+			ReadHeaderTimeout: Duration(1800 * time.Second),
+			WriteTimeout:      Duration(1800 * time.Second),
+			MaxHeaderBytes:    1 << 20,
+		},
+		Client: ClientConfig{
+			Timeout:            Duration(360 * time.Second),
+			Profile:            "okhttp4_android_13",
+			FollowRedirects:    false,
+			InsecureSkipVerify: true,
+		},
+	}
+}
+
+// loadConfig builds the effective configuration from args and the process
+// environment, the caller validates it. printOnly reports whether
+// --print-config was requested.
+func loadConfig(args []string) (cfg Config, printOnly bool, err error) {
+	cfg = defaultConfig()
+	fs := flag.NewFlagSet("chatgpt-reverse", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a YAML or TOML config file")
+	fs.BoolVar(&printOnly, "print-config", false, "print the effective config and exit")
+	// 命令行参数先解析到独立的变量里，最后只覆盖用户显式设置过的项
+	flags := cfg
+	fs.StringVar(&flags.Listen, "listen", flags.Listen, "listen address")
+	fs.StringVar(&flags.Proxy, "proxy", flags.Proxy, "upstream proxy url, empty for none")
+	fs.BoolVar(&flags.DisableHistory, "disable-history", flags.DisableHistory, "disable web history and training")
+	fs.StringVar(&flags.FakeUpstream, "fake-upstream", flags.FakeUpstream, "replay this SSE transcript instead of calling upstream")
+	fs.StringVar(&flags.Upstream.BaseURL, "upstream-base-url", flags.Upstream.BaseURL, "upstream web backend base url")
+	fs.StringVar(&flags.Stream.RewritePolicy, "rewrite-policy", flags.Stream.RewritePolicy, "what to do when upstream rewrites streamed text: ignore or error")
+	fs.StringVar(&flags.Compat.Mode, "compat-mode", flags.Compat.Mode, "unsupported request parameters: lenient ignores them, strict rejects them")
+	fs.Var(&flags.Server.ReadTimeout, "read-timeout", "server read timeout")
+	fs.Var(&flags.Server.ReadHeaderTimeout, "read-header-timeout", "server read header timeout")
+	fs.Var(&flags.Server.WriteTimeout, "write-timeout", "server write timeout")
+	fs.IntVar(&flags.Server.MaxHeaderBytes, "max-header-bytes", flags.Server.MaxHeaderBytes, "server max header bytes")
+	fs.Var(&flags.Client.Timeout, "client-timeout", "upstream request timeout")
+	fs.StringVar(&flags.Client.Profile, "client-profile", flags.Client.Profile, "tls-client profile name")
+	fs.BoolVar(&flags.Client.FollowRedirects, "follow-redirects", flags.Client.FollowRedirects, "follow upstream redirects")
+	fs.BoolVar(&flags.Client.InsecureSkipVerify, "insecure-skip-verify", flags.Client.InsecureSkipVerify, "skip upstream TLS verification")
+	if err = fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path == "" {
+		for _, name := range defaultConfigFiles {
+			if _, statErr := os.Stat(name); statErr == nil {
+				path = name
+				break
+			}
+		}
+	}
+	if path != "" {
+		if err = readConfigFile(path, &cfg); err != nil {
+			return cfg, false, err
+		}
+	}
+	if err = applyEnv(&cfg); err != nil {
+		return cfg, false, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = flags.Listen
+		case "proxy":
+			cfg.Proxy = flags.Proxy
+		case "disable-history":
+			cfg.DisableHistory = flags.DisableHistory
+		case "fake-upstream":
+			cfg.FakeUpstream = flags.FakeUpstream
+		case "upstream-base-url":
+			cfg.Upstream.BaseURL = flags.Upstream.BaseURL
+		case "rewrite-policy":
+			cfg.Stream.RewritePolicy = flags.Stream.RewritePolicy
+		case "compat-mode":
+			cfg.Compat.Mode = flags.Compat.Mode
+		case "read-timeout":
+			cfg.Server.ReadTimeout = flags.Server.ReadTimeout
+		case "read-header-timeout":
+			cfg.Server.ReadHeaderTimeout = flags.Server.ReadHeaderTimeout
+		case "write-timeout":
+			cfg.Server.WriteTimeout = flags.Server.WriteTimeout
+		case "max-header-bytes":
+			cfg.Server.MaxHeaderBytes = flags.Server.MaxHeaderBytes
+		case "client-timeout":
+			cfg.Client.Timeout = flags.Client.Timeout
+		case "client-profile":
+			cfg.Client.Profile = flags.Client.Profile
+		case "follow-redirects":
+			cfg.Client.FollowRedirects = flags.Client.FollowRedirects
+		case "insecure-skip-verify":
+			cfg.Client.InsecureSkipVerify = flags.Client.InsecureSkipVerify
+		}
+	})
+	return cfg, printOnly, nil
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	// Unknown keys are rejected, a misspelled one would otherwise leave
+	// its setting at the default without a word
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(cfg); err == io.EOF {
+			// An empty file
+			err = nil
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+		var strict *toml.StrictMissingError
+		if errors.As(err, &strict) {
+			var keys []string
+			for _, missing := range strict.Errors {
+				keys = append(keys, strings.Join(missing.Key(), "."))
+			}
+			err = fmt.Errorf("unknown keys %s", strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("config: unsupported file type %q, use .yaml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: parse %s: %w", path, err)
+	}
+	return nil
+}
+
+func applyEnv(cfg *Config) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			*dst = v
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("config: %s%s: %w", envPrefix, name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("config: %s%s: %w", envPrefix, name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	duration := func(name string, dst *Duration) {
+		if v, ok := os.LookupEnv(envPrefix + name); ok {
+			if err := dst.UnmarshalText([]byte(v)); err != nil {
+				errs = append(errs, fmt.Errorf("config: %s%s: %w", envPrefix, name, err))
+			}
+		}
+	}
+	str("LISTEN", &cfg.Listen)
+	str("PROXY", &cfg.Proxy)
+	if v, ok := os.LookupEnv(envPrefix + "PROXIES"); ok {
+		cfg.Proxies.List = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	str("PROXIES_CHECK_URL", &cfg.Proxies.CheckURL)
+	duration("PROXIES_CHECK_INTERVAL", &cfg.Proxies.CheckInterval)
+	duration("PROXIES_CHECK_TIMEOUT", &cfg.Proxies.CheckTimeout)
+	integer("PROXIES_FAIL_THRESHOLD", &cfg.Proxies.FailThreshold)
+	boolean("DISABLE_HISTORY", &cfg.DisableHistory)
+	str("FAKE_UPSTREAM", &cfg.FakeUpstream)
+	str("UPSTREAM_BASE_URL", &cfg.Upstream.BaseURL)
+	str("STREAM_REWRITE_POLICY", &cfg.Stream.RewritePolicy)
+	str("COMPAT_MODE", &cfg.Compat.Mode)
+	str("TOOLS_PROMPT_TEMPLATE", &cfg.Tools.PromptTemplate)
+	str("TOOLS_RESULT_TEMPLATE", &cfg.Tools.ResultTemplate)
+	integer("RESPONSE_FORMAT_REPAIR_ATTEMPTS", &cfg.ResponseFormat.RepairAttempts)
+	duration("MODELS_CACHE_TTL", &cfg.Models.CacheTTL)
+	str("GIZMOS_CACHE_DIR", &cfg.Gizmos.CacheDir)
+	duration("GIZMOS_TTL", &cfg.Gizmos.TTL)
+	str("ADMIN_TOKEN", &cfg.Admin.Token)
+	str("KEYS_FILE", &cfg.Keys.File)
+	boolean("KEYS_ALLOW_UPSTREAM_TOKENS", &cfg.Keys.AllowUpstreamTokens)
+	str("KEYS_USAGE_FILE", &cfg.Keys.UsageFile)
+	str("LEDGER_FILE", &cfg.Ledger.File)
+	duration("ACCOUNTS_COOLDOWN", &cfg.Accounts.Cooldown)
+	duration("ACCOUNTS_AUTH_COOLDOWN", &cfg.Accounts.AuthCooldown)
+	integer("CAPS_MAX_QUEUE", &cfg.Caps.MaxQueue)
+	duration("CAPS_MAX_WAIT", &cfg.Caps.MaxWait)
+	duration("TOKENS_WARN_BEFORE", &cfg.Tokens.WarnBefore)
+	duration("TOKENS_CHECK_INTERVAL", &cfg.Tokens.CheckInterval)
+	duration("SESSIONS_IDLE_TIMEOUT", &cfg.Sessions.IdleTimeout)
+	duration("SERVER_READ_TIMEOUT", &cfg.Server.ReadTimeout)
+	duration("SERVER_READ_HEADER_TIMEOUT", &cfg.Server.ReadHeaderTimeout)
+	duration("SERVER_WRITE_TIMEOUT", &cfg.Server.WriteTimeout)
+	integer("SERVER_MAX_HEADER_BYTES", &cfg.Server.MaxHeaderBytes)
+	duration("CLIENT_TIMEOUT", &cfg.Client.Timeout)
+	str("CLIENT_PROFILE", &cfg.Client.Profile)
+	boolean("CLIENT_FOLLOW_REDIRECTS", &cfg.Client.FollowRedirects)
+	boolean("CLIENT_INSECURE_SKIP_VERIFY", &cfg.Client.InsecureSkipVerify)
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once so a bad deployment fails
+// on startup instead of on the first request.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("config: listen %q: %w", cfg.Listen, err))
+	}
+	if cfg.Proxy != "" {
+		if err := validateProxyUrl(cfg.Proxy); err != nil {
+			errs = append(errs, fmt.Errorf("config: proxy: %w", err))
+		}
+	}
+	for i, proxy := range cfg.Proxies.List {
+		if err := validateProxyUrl(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("config: proxies.list[%d]: %w", i, err))
+		}
+	}
+	if u, err := url.Parse(cfg.Proxies.CheckURL); err != nil || u.Host == "" {
+		errs = append(errs, fmt.Errorf("config: proxies.check_url %q is not an absolute url", cfg.Proxies.CheckURL))
+	}
+	if cfg.Proxies.CheckInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("config: proxies.check_interval must be at least 1s"))
+	}
+	if cfg.Proxies.CheckTimeout < Duration(time.Second) {
+		errs = append(errs, errors.New("config: proxies.check_timeout must be at least 1s"))
+	}
+	if cfg.Proxies.FailThreshold < 1 {
+		errs = append(errs, errors.New("config: proxies.fail_threshold must be at least 1"))
+	}
+	if err := validateBaseURL(cfg.Upstream.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("config: upstream.base_url: %w", err))
+	}
+	for puid, baseURL := range cfg.Upstream.AccountBaseURLs {
+		if err := validateBaseURL(baseURL); err != nil {
+			errs = append(errs, fmt.Errorf("config: upstream.account_base_urls[%s]: %w", puid, err))
+		}
+	}
+	if cfg.Stream.RewritePolicy != RewriteIgnore && cfg.Stream.RewritePolicy != RewriteError {
+		errs = append(errs, fmt.Errorf("config: stream.rewrite_policy %q must be %q or %q", cfg.Stream.RewritePolicy, RewriteIgnore, RewriteError))
+	}
+	if cfg.Compat.Mode != CompatLenient && cfg.Compat.Mode != CompatStrict {
+		errs = append(errs, fmt.Errorf("config: compat.mode %q must be %q or %q", cfg.Compat.Mode, CompatLenient, CompatStrict))
+	}
+	if _, _, err := parseToolTemplates(cfg.Tools); err != nil {
+		errs = append(errs, fmt.Errorf("config: tools: %w", err))
+	}
+	if cfg.ResponseFormat.RepairAttempts < 0 {
+		errs = append(errs, errors.New("config: response_format.repair_attempts must not be negative"))
+	}
+	if cfg.Models.CacheTTL < 0 {
+		errs = append(errs, errors.New("config: models.cache_ttl must not be negative"))
+	}
+	if err := cfg.Routes.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Gizmos.TTL < 0 {
+		errs = append(errs, errors.New("config: gizmos.ttl must not be negative"))
+	}
+	if err := cfg.Keys.DefaultLimits.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("config: keys.default_limits: %w", err))
+	}
+	names := map[string]bool{}
+	for i, a := range cfg.Accounts.List {
+		switch {
+		case a.Name == "":
+			errs = append(errs, fmt.Errorf("config: accounts.list[%d]: name is required", i))
+		case names[a.Name]:
+			errs = append(errs, fmt.Errorf("config: accounts.list[%d]: duplicate name %q", i, a.Name))
+		}
+		names[a.Name] = true
+		if _, err := parseAccessToken(a.AccessToken); err != nil {
+			errs = append(errs, fmt.Errorf("config: accounts.list[%d]: %w", i, err))
+		}
+		if a.BaseURL != "" {
+			if err := validateBaseURL(a.BaseURL); err != nil {
+				errs = append(errs, fmt.Errorf("config: accounts.list[%d].base_url: %w", i, err))
+			}
+		}
+	}
+	if cfg.Accounts.Cooldown < 0 || cfg.Accounts.AuthCooldown < 0 {
+		errs = append(errs, errors.New("config: accounts cooldowns must not be negative"))
+	}
+	for i, rule := range cfg.Caps.Rules {
+		if _, err := path.Match(rule.Model, ""); err != nil || rule.Model == "" {
+			errs = append(errs, fmt.Errorf("config: caps.rules[%d]: invalid model pattern %q", i, rule.Model))
+		}
+		if rule.Requests < 1 {
+			errs = append(errs, fmt.Errorf("config: caps.rules[%d]: requests must be at least 1", i))
+		}
+		if rule.Window < Duration(time.Second) {
+			errs = append(errs, fmt.Errorf("config: caps.rules[%d]: window must be at least 1s", i))
+		}
+	}
+	if cfg.Caps.MaxQueue < 0 {
+		errs = append(errs, errors.New("config: caps.max_queue must not be negative"))
+	}
+	if cfg.Caps.MaxWait < 0 {
+		errs = append(errs, errors.New("config: caps.max_wait must not be negative"))
+	}
+	if cfg.Tokens.WarnBefore < 0 {
+		errs = append(errs, errors.New("config: tokens.warn_before must not be negative"))
+	}
+	if cfg.Tokens.CheckInterval < Duration(time.Second) {
+		errs = append(errs, errors.New("config: tokens.check_interval must be at least 1s"))
+	}
+	if cfg.Sessions.IdleTimeout < Duration(time.Second) {
+		errs = append(errs, errors.New("config: sessions.idle_timeout must be at least 1s"))
+	}
+	if cfg.Server.ReadTimeout <= 0 {
+		errs = append(errs, errors.New("config: server.read_timeout must be positive"))
+	}
+	if cfg.Server.ReadHeaderTimeout <= 0 {
+		errs = append(errs, errors.New("config: server.read_header_timeout must be positive"))
+	}
+	if cfg.Server.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("config: server.write_timeout must be positive"))
+	}
+	if cfg.Server.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("config: server.max_header_bytes must be positive"))
+	}
+	if cfg.Client.Timeout < Duration(time.Second) {
+		errs = append(errs, errors.New("config: client.timeout must be at least 1s"))
+	}
+	if _, ok := profiles.MappedTLSClients[cfg.Client.Profile]; !ok {
+		errs = append(errs, fmt.Errorf("config: client.profile %q is not a known tls-client profile", cfg.Client.Profile))
+	}
+	return errors.Join(errs...)
+}
+
+func validateProxyUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("%q: unsupported scheme %q", raw, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q: missing host", raw)
+	}
+	return nil
+}
+
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q: missing host", raw)
+	}
+	return nil
+}
+
+// redactedSecret replaces secrets in the printed config.
+const redactedSecret = "xxxxx"
+
+// redactPUID hides a PUID, which is a session cookie, in the printed
+// config. The same PUID always prints the same, so accounts can still be
+// matched with their account_base_urls.
+func redactPUID(puid string) string {
+	if puid == "" {
+		return ""
+	}
+	return redactedSecret + "-" + hashAPIKey(puid)[:8]
+}
+
+// WriteTo prints the effective config as YAML, used by --print-config.
+// Tokens, PUIDs and proxy passwords are redacted.
+func (cfg *Config) WriteTo(w io.Writer) (int64, error) {
+	printed := *cfg
+	if printed.Admin.Token != "" {
+		printed.Admin.Token = redactedSecret
+	}
+	printed.Accounts.List = make([]AccountConfig, len(cfg.Accounts.List))
+	for i, a := range cfg.Accounts.List {
+		if a.AccessToken != "" {
+			a.AccessToken = redactedSecret
+		}
+		a.PUID = redactPUID(a.PUID)
+		printed.Accounts.List[i] = a
+	}
+	if cfg.Upstream.AccountBaseURLs != nil {
+		printed.Upstream.AccountBaseURLs = map[string]string{}
+		for puid, baseURL := range cfg.Upstream.AccountBaseURLs {
+			printed.Upstream.AccountBaseURLs[redactPUID(puid)] = baseURL
+		}
+	}
+	if printed.Proxy != directProxy {
+		printed.Proxy = redactProxy(printed.Proxy)
+	}
+	printed.Proxies.List = make([]string, len(cfg.Proxies.List))
+	for i, proxy := range cfg.Proxies.List {
+		printed.Proxies.List[i] = redactProxy(proxy)
+	}
+	out, err := yaml.Marshal(&printed)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(out)
+	return int64(n), err
+}
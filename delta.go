@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// deltaOperation is one frame of the delta_encoding stream protocol. Path
+// and operation may be omitted, in which case the previous ones are reused.
+type deltaOperation struct {
+	Path      *string         `json:"p,omitempty"`
+	Operation *string         `json:"o,omitempty"`
+	Value     json.RawMessage `json:"v"`
+}
+
+// messageState rebuilds the current ChatGPTResponse from delta_encoding
+// frames. The document is kept as generic JSON so patches can address any
+// path, e.g. /message/content/parts/0 or /message/metadata/finish_details.
+type messageState struct {
+	doc           interface{}
+	lastPath      string
+	lastOperation string
+}
+
+func newMessageState() *messageState {
+	return &messageState{doc: map[string]interface{}{}}
+}
+
+// Apply decodes a delta frame and applies it to the message.
+func (s *messageState) Apply(data []byte) error {
+	var op deltaOperation
+	if err := json.Unmarshal(data, &op); err != nil {
+		return err
+	}
+	path, operation := s.lastPath, s.lastOperation
+	if op.Path != nil {
+		path = *op.Path
+	}
+	if op.Operation != nil {
+		operation = *op.Operation
+	}
+	if operation == "" {
+		// A bare value without any previous operation starts as an append
+		operation = "append"
+	}
+	s.lastPath, s.lastOperation = path, operation
+	return s.apply(path, operation, op.Value)
+}
+
+func (s *messageState) apply(path string, operation string, raw json.RawMessage) error {
+	if operation == "patch" {
+		var ops []deltaOperation
+		if err := json.Unmarshal(raw, &ops); err != nil {
+			return fmt.Errorf("delta: patch %q: %w", path, err)
+		}
+		for _, op := range ops {
+			if op.Path == nil || op.Operation == nil {
+				return fmt.Errorf("delta: patch %q: nested operation without path or operation", path)
+			}
+			if err := s.apply(path+*op.Path, *op.Operation, op.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var value interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return fmt.Errorf("delta: %s %q: %w", operation, path, err)
+		}
+	}
+	keys, err := splitPointer(path)
+	if err != nil {
+		return err
+	}
+	doc, err := update(s.doc, keys, func(current interface{}) (interface{}, bool, error) {
+		switch operation {
+		case "add", "replace":
+			return value, true, nil
+		case "remove":
+			return nil, false, nil
+		case "append":
+			switch current := current.(type) {
+			case nil:
+				return value, true, nil
+			case string:
+				text, ok := value.(string)
+				if !ok {
+					return nil, false, fmt.Errorf("delta: append %q: value is not a string", path)
+				}
+				return current + text, true, nil
+			case []interface{}:
+				if items, ok := value.([]interface{}); ok {
+					return append(current, items...), true, nil
+				}
+				return append(current, value), true, nil
+			default:
+				return nil, false, fmt.Errorf("delta: append %q: target is %T", path, current)
+			}
+		case "truncate":
+			length, ok := value.(float64)
+			if !ok || length < 0 {
+				return nil, false, fmt.Errorf("delta: truncate %q: invalid length", path)
+			}
+			n := int(length)
+			switch current := current.(type) {
+			case string:
+				if n < len(current) {
+					current = current[:n]
+				}
+				return current, true, nil
+			case []interface{}:
+				if n < len(current) {
+					current = current[:n]
+				}
+				return current, true, nil
+			default:
+				return nil, false, fmt.Errorf("delta: truncate %q: target is %T", path, current)
+			}
+		default:
+			return nil, false, fmt.Errorf("delta: unsupported operation %q", operation)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.doc = doc
+	return nil
+}
+
+// Response returns a snapshot of the rebuilt message, in the same shape the
+// snapshot stream protocol sends.
+func (s *messageState) Response() (ChatGPTResponse, error) {
+	var response ChatGPTResponse
+	data, err := json.Marshal(s.doc)
+	if err != nil {
+		return response, err
+	}
+	err = json.Unmarshal(data, &response)
+	return response, err
+}
+
+// splitPointer splits a JSON pointer (RFC 6901) into its unescaped keys.
+func splitPointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("delta: invalid path %q", path)
+	}
+	keys := strings.Split(path[1:], "/")
+	for i, key := range keys {
+		keys[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+	}
+	return keys, nil
+}
+
+// update walks keys from node, creating missing objects on the way, and
+// replaces the addressed value with the result of fn. A false keep removes it.
+func update(node interface{}, keys []string, fn func(current interface{}) (interface{}, bool, error)) (interface{}, error) {
+	if len(keys) == 0 {
+		value, keep, err := fn(node)
+		if err != nil || !keep {
+			return nil, err
+		}
+		return value, nil
+	}
+	key, rest := keys[0], keys[1:]
+	switch current := node.(type) {
+	case nil:
+		node = map[string]interface{}{}
+		return update(node, keys, fn)
+	case map[string]interface{}:
+		child := current[key]
+		if len(rest) == 0 {
+			value, keep, err := fn(child)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				current[key] = value
+			} else {
+				delete(current, key)
+			}
+			return current, nil
+		}
+		child, err := update(child, rest, fn)
+		if err != nil {
+			return nil, err
+		}
+		current[key] = child
+		return current, nil
+	case []interface{}:
+		index := len(current)
+		if key != "-" {
+			var err error
+			index, err = strconv.Atoi(key)
+			if err != nil || index < 0 || index > len(current) {
+				return nil, fmt.Errorf("delta: invalid array index %q", key)
+			}
+		}
+		var child interface{}
+		exists := index < len(current)
+		if exists {
+			child = current[index]
+		}
+		if len(rest) == 0 {
+			value, keep, err := fn(child)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case keep && exists:
+				current[index] = value
+			case keep:
+				current = append(current, value)
+			case exists:
+				current = append(current[:index], current[index+1:]...)
+			}
+			return current, nil
+		}
+		child, err := update(child, rest, fn)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			current[index] = child
+		} else {
+			current = append(current, child)
+		}
+		return current, nil
+	default:
+		return nil, fmt.Errorf("delta: cannot address %q inside %T", key, node)
+	}
+}
+
+const (
+	// RewriteIgnore keeps what was already streamed and resumes once the
+	// upstream text extends it again. The reply ends with the streamed
+	// text, whatever the upstream rewrote after it.
+	RewriteIgnore = "ignore"
+	// RewriteError aborts the stream with an error event as soon as
+	// streamed text is rewritten.
+	RewriteError = "error"
+	// rewriteFollow takes every snapshot as is, for replies that are not
+	// streamed and so cannot contradict anything.
+	rewriteFollow = "follow"
+)
+
+// textDelta turns successive snapshots of the message text into the
+// increments streamed to the client. Deltas are always computed against
+// the text already sent, so their concatenation equals Emitted(), which is
+// the text the reply ends with. A reply may span several assistant
+// messages, e.g. around a browsing step; each new message is appended
+// after a blank line.
+type textDelta struct {
+	policy  string
+	emitted string
+	latest  string
+	// message is the id of the current message, base the reply text
+	// before it
+	message string
+	base    string
+	// rewrites counts snapshots that did not extend the emitted text
+	rewrites int
+}
+
+// messageSeparator joins the texts of the messages of one reply.
+const messageSeparator = "\n\n"
+
+func newTextDelta(policy string) *textDelta {
+	return &textDelta{policy: policy}
+}
+
+// Next returns the text to stream for snapshot of message id, "" if
+// nothing is new.
+func (d *textDelta) Next(id string, snapshot string) (string, error) {
+	if id != d.message {
+		if d.message != "" {
+			d.base = d.emitted
+		}
+		d.message = id
+	}
+	if d.base != "" && snapshot != "" {
+		snapshot = d.base + messageSeparator + snapshot
+	} else if d.base != "" {
+		snapshot = d.base
+	}
+	d.latest = snapshot
+	if strings.HasPrefix(snapshot, d.emitted) {
+		delta := snapshot[len(d.emitted):]
+		d.emitted = snapshot
+		return delta, nil
+	}
+	d.rewrites++
+	switch d.policy {
+	case RewriteError:
+		return "", &StreamError{Kind: ErrStreamRewritten, Data: snapshot}
+	case rewriteFollow:
+		d.emitted = snapshot
+	}
+	return "", nil
+}
+
+// Emitted is the text sent to the client so far.
+func (d *textDelta) Emitted() string {
+	return d.emitted
+}
+
+// Text is the latest full text reported by the upstream.
+func (d *textDelta) Text() string {
+	return d.latest
+}
+
+// Diverged reports whether the streamed text differs from the final text.
+func (d *textDelta) Diverged() bool {
+	return d.emitted != d.latest
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+)
+
+const textPath = "/message/content/parts/0"
+
+// frameScript is a random delta_encoding stream and the text each of its
+// frames leaves the message with.
+type frameScript struct {
+	body  string
+	texts []string
+	// rewrites reports for every frame whether it did not extend the text
+	// before it
+	rewrites []bool
+}
+
+func randomText(r *rand.Rand) string {
+	const alphabet = "ab c\né語"
+	runes := []rune(alphabet)
+	n := r.Intn(6)
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteRune(runes[r.Intn(len(runes))])
+	}
+	return b.String()
+}
+
+func frame(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return "event: delta\ndata: " + string(data) + "\n\n"
+}
+
+// newFrameScript builds append, patch, truncate and rewrite frames, the
+// operations the web backend uses to edit the message text.
+func newFrameScript(r *rand.Rand) frameScript {
+	var s frameScript
+	var b strings.Builder
+	b.WriteString("event: delta_encoding\ndata: \"v1\"\n\n")
+	b.WriteString(frame(map[string]interface{}{"p": "", "o": "add", "v": map[string]interface{}{
+		"message": map[string]interface{}{
+			"id":       "m1",
+			"author":   map[string]interface{}{"role": "assistant"},
+			"content":  map[string]interface{}{"content_type": "text", "parts": []string{""}},
+			"metadata": map[string]interface{}{},
+		},
+		"conversation_id": "c1",
+	}}))
+	text, lastAppend := "", false
+	for i, n := 0, 1+r.Intn(12); i < n; i++ {
+		previous := text
+		switch r.Intn(5) {
+		case 0, 1:
+			added := randomText(r)
+			if lastAppend && r.Intn(2) == 0 {
+				// Path and operation are reused from the previous frame
+				b.WriteString(frame(map[string]interface{}{"v": added}))
+			} else {
+				b.WriteString(frame(map[string]interface{}{"p": textPath, "o": "append", "v": added}))
+			}
+			text += added
+			lastAppend = true
+		case 2:
+			first, second := randomText(r), randomText(r)
+			b.WriteString(frame(map[string]interface{}{"p": "", "o": "patch", "v": []interface{}{
+				map[string]interface{}{"p": textPath, "o": "append", "v": first},
+				map[string]interface{}{"p": "/message/status", "o": "replace", "v": "in_progress"},
+				map[string]interface{}{"p": textPath, "o": "append", "v": second},
+			}}))
+			text += first + second
+			lastAppend = false
+		case 3:
+			cut := 0
+			if len(text) > 0 {
+				cut = r.Intn(len(text))
+			}
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			b.WriteString(frame(map[string]interface{}{"p": textPath, "o": "truncate", "v": cut}))
+			text = text[:cut]
+			lastAppend = false
+		case 4:
+			if r.Intn(2) == 0 {
+				// A rewrite that happens to extend the text
+				text += randomText(r)
+			} else {
+				text = randomText(r) + randomText(r)
+			}
+			b.WriteString(frame(map[string]interface{}{"p": textPath, "o": "replace", "v": text}))
+			lastAppend = false
+		}
+		s.texts = append(s.texts, text)
+		s.rewrites = append(s.rewrites, !strings.HasPrefix(text, previous))
+	}
+	b.WriteString("data: [DONE]\n\n")
+	s.body = b.String()
+	return s
+}
+
+// snapshots decodes the script the way Handler does.
+func (s frameScript) snapshots(t *testing.T) []string {
+	stream := newResponseStream(strings.NewReader(s.body))
+	var texts []string
+	for {
+		response, err := stream.Next()
+		if err == io.EOF {
+			return texts
+		}
+		if err != nil {
+			t.Fatalf("decoding %q: %v", s.body, err)
+		}
+		texts = append(texts, response.Message.Content.Text())
+	}
+}
+
+func TestTextDeltaConcatenatesToFinalText(t *testing.T) {
+	check := func(seed int64) bool {
+		script := newFrameScript(rand.New(rand.NewSource(seed)))
+		snapshots := script.snapshots(t)
+		// The first snapshot is the empty message the stream starts with
+		if len(snapshots) != len(script.texts)+1 {
+			t.Errorf("seed %d: got %d snapshots for %d frames", seed, len(snapshots), len(script.texts))
+			return false
+		}
+		for i, text := range script.texts {
+			if snapshots[i+1] != text {
+				t.Errorf("seed %d: frame %d left %q, want %q", seed, i, snapshots[i+1], text)
+				return false
+			}
+		}
+		final := script.texts[len(script.texts)-1]
+
+		for _, policy := range []string{RewriteError, RewriteIgnore, rewriteFollow} {
+			d := newTextDelta(policy)
+			var streamed strings.Builder
+			var failed error
+			for _, snapshot := range snapshots {
+				delta, err := d.Next("m1", snapshot)
+				if err != nil {
+					failed = err
+					break
+				}
+				streamed.WriteString(delta)
+			}
+			// follow is for replies that are not streamed, its deltas are unused
+			if policy != rewriteFollow && streamed.String() != d.Emitted() {
+				t.Errorf("seed %d, %s: deltas add up to %q, emitted %q", seed, policy, streamed.String(), d.Emitted())
+				return false
+			}
+			if failed != nil {
+				if policy != RewriteError || !errors.Is(failed, ErrStreamRewritten) {
+					t.Errorf("seed %d, %s: unexpected error %v", seed, policy, failed)
+					return false
+				}
+				continue
+			}
+			switch {
+			case policy == rewriteFollow && d.Emitted() != final:
+				t.Errorf("seed %d, %s: emitted %q, final text %q", seed, policy, d.Emitted(), final)
+				return false
+			case policy == RewriteError && d.Emitted() != final:
+				t.Errorf("seed %d, %s: stream ended on %q without error, final text %q", seed, policy, d.Emitted(), final)
+				return false
+			case !d.Diverged() && d.Emitted() != final:
+				t.Errorf("seed %d, %s: emitted %q, final text %q", seed, policy, d.Emitted(), final)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTextDeltaReportsRewrites(t *testing.T) {
+	check := func(seed int64) bool {
+		script := newFrameScript(rand.New(rand.NewSource(seed)))
+		d := newTextDelta(RewriteError)
+		for i, text := range script.texts {
+			// Until the first error the emitted text is the previous frame's
+			_, err := d.Next("m1", text)
+			if script.rewrites[i] != (err != nil) {
+				t.Errorf("seed %d: frame %d from %q to %q: error %v", seed, i, d.Emitted(), text, err)
+				return false
+			}
+			if err != nil {
+				return true
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTextDeltaNewMessage(t *testing.T) {
+	d := newTextDelta(RewriteError)
+	var streamed strings.Builder
+	for _, frame := range []struct{ id, text string }{
+		{"m1", "Let me"},
+		{"m1", "Let me search."},
+		// The second message starts empty and does not extend the first
+		{"m2", ""},
+		{"m2", "Found"},
+		{"m2", "Found it."},
+	} {
+		delta, err := d.Next(frame.id, frame.text)
+		if err != nil {
+			t.Fatalf("%s %q: %v", frame.id, frame.text, err)
+		}
+		streamed.WriteString(delta)
+	}
+	want := "Let me search.\n\nFound it."
+	if d.Emitted() != want || streamed.String() != want || d.Diverged() {
+		t.Errorf("emitted %q, streamed %q, want %q", d.Emitted(), streamed.String(), want)
+	}
+	// A rewrite within the current message is still one
+	if _, err := d.Next("m2", "Lost it."); !errors.Is(err, ErrStreamRewritten) {
+		t.Errorf("rewrite of the second message: %v", err)
+	}
+}
+
+func TestChatCompletionStreamTwoMessages(t *testing.T) {
+	testConfig()
+	if config.Stream.RewritePolicy != RewriteError {
+		t.Fatalf("default rewrite policy %q", config.Stream.RewritePolicy)
+	}
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(
+		snapshot("m1", "Let me", ""),
+		snapshot("m1", "Let me search.", "stop"),
+		snapshot("m2", "Found", ""),
+		snapshot("m2", "Found it.", "stop"),
+		"[DONE]",
+	)})
+	router, key := testRouter(t, upstream, false)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	text, finish := streamedText(readChunks(t, recorder.Body.String()))
+	if text != "Let me search.\n\nFound it." || finish != "stop" {
+		t.Errorf("streamed %q, finish %v:\n%s", text, finish, recorder.Body)
+	}
+}
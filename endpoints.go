@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// defaultBaseURL is the public web backend.
+const defaultBaseURL = "https://chat.openai.com"
+
+// Endpoints derives every backend url from one base url, so a mirror, a
+// recording proxy or a local mock only needs a different base.
+type Endpoints struct {
+	BaseURL string
+}
+
+func NewEndpoints(baseURL string) Endpoints {
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	return Endpoints{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (e Endpoints) url(path string) string {
+	return e.BaseURL + "/backend-api" + path
+}
+
+func (e Endpoints) Conversation() string {
+	return e.url("/conversation")
+}
+
+func (e Endpoints) Conversations() string {
+	return e.url("/conversations")
+}
+
+func (e Endpoints) Models() string {
+	return e.url("/models")
+}
+
+func (e Endpoints) Files() string {
+	return e.url("/files")
+}
+
+func (e Endpoints) File(id string) string {
+	return e.url("/files/" + url.PathEscape(id))
+}
+
+func (e Endpoints) FileUploaded(id string) string {
+	return e.url("/files/" + url.PathEscape(id) + "/uploaded")
+}
+
+func (e Endpoints) FileDownload(id string) string {
+	return e.url("/files/" + url.PathEscape(id) + "/download")
+}
+
+func (e Endpoints) Gizmo(id string) string {
+	return e.url("/gizmos/" + url.PathEscape(id))
+}
+
+// Credential identifies the upstream account a request is sent as.
+type Credential struct {
+	AccessToken string
+	PUID        string
+	// BaseURL overrides the deployment wide upstream base url for this account.
+	BaseURL string
+}
+
+func (cred Credential) Endpoints() Endpoints {
+	if cred.BaseURL != "" {
+		return NewEndpoints(cred.BaseURL)
+	}
+	return NewEndpoints(config.Upstream.BaseURL)
+}
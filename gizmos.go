@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gizmoModelPrefix selects a custom GPT by id, e.g. "gizmo:g-2fkFE8rbu".
+const gizmoModelPrefix = "gizmo:"
+
+var gizmoIDPattern = regexp.MustCompile(`^g-[A-Za-z0-9]+$`)
+
+// cachedGizmo is a gizmo definition as stored in memory and on disk.
+type cachedGizmo struct {
+	ID        string          `json:"id"`
+	Gizmo     json.RawMessage `json:"gizmo"`
+	FetchedAt time.Time       `json:"fetched_at"`
+}
+
+// gizmoCache keeps gizmo definitions fetched from the web backend, in
+// memory and optionally as one JSON file per gizmo in gizmos.cache_dir.
+type gizmoCache struct {
+	upstream Upstream
+	mu       sync.Mutex
+	entries  map[string]cachedGizmo
+	// now is the clock of the cache.
+	now func() time.Time
+}
+
+func newGizmoCache(upstream Upstream) *gizmoCache {
+	return &gizmoCache{upstream: upstream, entries: map[string]cachedGizmo{}, now: time.Now}
+}
+
+func (g *gizmoCache) path(id string) string {
+	return filepath.Join(config.Gizmos.CacheDir, id+".json")
+}
+
+// cached returns gizmo id from memory or, failing that, from disk.
+func (g *gizmoCache) cached(id string) (cachedGizmo, bool) {
+	g.mu.Lock()
+	entry, ok := g.entries[id]
+	g.mu.Unlock()
+	if !ok && config.Gizmos.CacheDir != "" {
+		if data, err := os.ReadFile(g.path(id)); err == nil && json.Unmarshal(data, &entry) == nil {
+			ok = true
+		}
+	}
+	return entry, ok
+}
+
+// Get returns the definition of gizmo id, fetching it when it is not
+// cached or older than gizmos.ttl.
+func (g *gizmoCache) Get(id string, cred Credential) (cachedGizmo, error) {
+	if !gizmoIDPattern.MatchString(id) {
+		return cachedGizmo{}, fmt.Errorf("gizmo: invalid id %q", id)
+	}
+	entry, ok := g.cached(id)
+	if ok && g.now().Sub(entry.FetchedAt) < time.Duration(config.Gizmos.TTL) {
+		return entry, nil
+	}
+	fetched, err := g.Refresh(id, cred)
+	if err != nil {
+		if ok {
+			// Serve the stale definition rather than failing the request
+			fmt.Println("Error refreshing gizmo "+id+": ", err)
+			return entry, nil
+		}
+		return cachedGizmo{}, err
+	}
+	return fetched, nil
+}
+
+// Refresh fetches gizmo id from the web backend and caches it.
+func (g *gizmoCache) Refresh(id string, cred Credential) (cachedGizmo, error) {
+	gizmo, err := g.upstream.Gizmo(id, cred)
+	if err != nil {
+		return cachedGizmo{}, err
+	}
+	entry := cachedGizmo{ID: id, Gizmo: gizmo, FetchedAt: g.now()}
+	g.mu.Lock()
+	g.entries[id] = entry
+	g.mu.Unlock()
+	if config.Gizmos.CacheDir != "" {
+		if err = g.save(entry); err != nil {
+			fmt.Println("Error saving gizmo "+id+": ", err)
+		}
+	}
+	return entry, nil
+}
+
+func (g *gizmoCache) save(entry cachedGizmo) error {
+	if err := os.MkdirAll(config.Gizmos.CacheDir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := g.path(entry.ID) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.path(entry.ID))
+}
+
+// Invalidate drops gizmo id from memory and disk so the next use refetches it.
+func (g *gizmoCache) Invalidate(id string) {
+	g.mu.Lock()
+	delete(g.entries, id)
+	g.mu.Unlock()
+	if config.Gizmos.CacheDir != "" {
+		_ = os.Remove(g.path(id))
+	}
+}
+
+// List returns the gizmos cached in memory and on disk, sorted by id.
+func (g *gizmoCache) List() []cachedGizmo {
+	entries := map[string]cachedGizmo{}
+	if config.Gizmos.CacheDir != "" {
+		paths, _ := filepath.Glob(filepath.Join(config.Gizmos.CacheDir, "g-*.json"))
+		for _, path := range paths {
+			var entry cachedGizmo
+			if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &entry) == nil && gizmoIDPattern.MatchString(entry.ID) {
+				entries[entry.ID] = entry
+			}
+		}
+	}
+	g.mu.Lock()
+	for id, entry := range g.entries {
+		if entry.FetchedAt.After(entries[id].FetchedAt) {
+			entries[id] = entry
+		}
+	}
+	g.mu.Unlock()
+	list := make([]cachedGizmo, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ConversationMode builds the gizmo_interaction mode for gizmo id. If the
+// definition cannot be fetched the bare gizmo id is sent instead.
+func (g *gizmoCache) ConversationMode(id string, cred Credential) map[string]interface{} {
+	mode := map[string]interface{}{
+		"kind":     "gizmo_interaction",
+		"gizmo_id": id,
+	}
+	entry, err := g.Get(id, cred)
+	if err != nil {
+		fmt.Println("Error fetching gizmo "+id+": ", err)
+		return mode
+	}
+	mode["gizmo"] = entry.Gizmo
+	return mode
+}
+
+func (g *gateway) listGizmos(c *gin.Context) {
+	c.JSON(200, gin.H{"object": "list", "data": g.gizmos.List()})
+}
+
+func (g *gateway) refreshGizmo(c *gin.Context) {
+	id := c.Param("id")
+	if !gizmoIDPattern.MatchString(id) {
+		c.JSON(400, gin.H{"error": gin.H{
+			"message": fmt.Sprintf("invalid gizmo id %q", id),
+			"type":    "invalid_request_error",
+			"param":   "id",
+			"code":    nil,
+		}})
+		return
+	}
+	g.gizmos.Invalidate(id)
+	// Admin requests carry no upstream credential: the definition is
+	// fetched right away as a pool account if there is one, otherwise by
+	// the next request using the gizmo
+	acc, ok := g.accounts.Acquire(nil)
+	if !ok {
+		c.JSON(200, gin.H{"id": id, "invalidated": true, "refreshed": false})
+		return
+	}
+	entry, err := g.gizmos.Refresh(id, acc.Credential())
+	if err != nil {
+		c.JSON(502, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "upstream_error",
+			"param":   "id",
+			"code":    "gizmo_fetch_failed",
+		}})
+		return
+	}
+	c.JSON(200, gin.H{"id": id, "invalidated": true, "refreshed": true, "fetched_at": entry.FetchedAt})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gizmoUpstream counts gizmo fetches and fails them while err is set.
+type gizmoUpstream struct {
+	*FakeUpstream
+	err     error
+	fetches int32
+}
+
+func (u *gizmoUpstream) Gizmo(id string, cred Credential) (json.RawMessage, error) {
+	atomic.AddInt32(&u.fetches, 1)
+	if u.err != nil {
+		return nil, u.err
+	}
+	return u.FakeUpstream.Gizmo(id, cred)
+}
+
+func TestGizmoCache(t *testing.T) {
+	testConfig()
+	config.Gizmos.CacheDir = t.TempDir()
+	config.Gizmos.TTL = Duration(time.Hour)
+	upstream := &gizmoUpstream{FakeUpstream: NewFakeUpstream()}
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	cache := newGizmoCache(upstream)
+	cache.now = clock
+
+	if _, err := cache.Get("g-abc", Credential{}); err != nil {
+		t.Fatal(err)
+	}
+	// A restarted gateway reads the definition from disk
+	restarted := newGizmoCache(upstream)
+	restarted.now = clock
+	entry, err := restarted.Get("g-abc", Credential{})
+	if err != nil || atomic.LoadInt32(&upstream.fetches) != 1 || !entry.FetchedAt.Equal(now) {
+		t.Fatalf("after restart: %+v, %v, %d fetches", entry, err, upstream.fetches)
+	}
+	if list := restarted.List(); len(list) != 1 || list[0].ID != "g-abc" {
+		t.Errorf("list after restart %+v", list)
+	}
+
+	now = now.Add(time.Hour)
+	if entry, _ = restarted.Get("g-abc", Credential{}); atomic.LoadInt32(&upstream.fetches) != 2 || !entry.FetchedAt.Equal(now) {
+		t.Fatalf("after the ttl: %+v, %d fetches", entry, upstream.fetches)
+	}
+
+	// Failed refreshes serve the stale definition, unknown gizmos fail
+	now = now.Add(time.Hour)
+	upstream.err = errors.New("unavailable")
+	entry, err = restarted.Get("g-abc", Credential{})
+	if err != nil || !entry.FetchedAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("failed refresh: %+v, %v", entry, err)
+	}
+	if _, err = restarted.Get("g-other", Credential{}); err == nil {
+		t.Error("uncached gizmo: no error")
+	}
+	if _, err = restarted.Get("../g-abc", Credential{}); err == nil {
+		t.Error("invalid id: no error")
+	}
+}
+
+func TestRefreshGizmo(t *testing.T) {
+	testConfig()
+	config.Admin.Token = "admin-token"
+	config.Gizmos.CacheDir = t.TempDir()
+	upstream := &gizmoUpstream{FakeUpstream: NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")})}
+	router, key := testRouter(t, upstream, false)
+	chat := `{"model":"gizmo:g-abc","messages":[{"role":"user","content":"hi"}]}`
+	if recorder := postChat(t, router, key, chat); recorder.Code != 200 || atomic.LoadInt32(&upstream.fetches) != 1 {
+		t.Fatalf("status %d, %d fetches", recorder.Code, upstream.fetches)
+	}
+
+	// Without pool accounts the cache is dropped and the next request
+	// fetches the gizmo with its own credential
+	recorder := adminRequest(router, http.MethodPost, "/admin/gizmos/g-abc/refresh", "")
+	var refreshed struct {
+		Invalidated bool `json:"invalidated"`
+		Refreshed   bool `json:"refreshed"`
+	}
+	if json.Unmarshal(recorder.Body.Bytes(), &refreshed); recorder.Code != 200 || !refreshed.Invalidated || refreshed.Refreshed {
+		t.Fatalf("refresh without pool accounts: %d %s", recorder.Code, recorder.Body)
+	}
+	if _, err := os.Stat(filepath.Join(config.Gizmos.CacheDir, "g-abc.json")); !os.IsNotExist(err) {
+		t.Errorf("cache file after refresh: %v", err)
+	}
+	if recorder := adminRequest(router, http.MethodGet, "/admin/gizmos", ""); strings.Contains(recorder.Body.String(), "g-abc") {
+		t.Errorf("gizmos after refresh: %s", recorder.Body)
+	}
+	if recorder := postChat(t, router, key, chat); recorder.Code != 200 || atomic.LoadInt32(&upstream.fetches) != 2 {
+		t.Errorf("after refresh: status %d, %d fetches", recorder.Code, upstream.fetches)
+	}
+	if recorder := adminRequest(router, http.MethodPost, "/admin/gizmos/not-a-gizmo/refresh", ""); recorder.Code != 400 {
+		t.Errorf("invalid id: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestRefreshGizmoWithPool(t *testing.T) {
+	testConfig()
+	config.Admin.Token = "admin-token"
+	config.Accounts.List = []AccountConfig{{Name: "team", AccessToken: testAccessToken(), PUID: "user-team"}}
+	upstream := &gizmoUpstream{FakeUpstream: NewFakeUpstream()}
+	router, _ := testRouter(t, upstream, true)
+
+	recorder := adminRequest(router, http.MethodPost, "/admin/gizmos/g-abc/refresh", "")
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), `"refreshed":true`) || atomic.LoadInt32(&upstream.fetches) != 1 {
+		t.Errorf("refresh: %d %s, %d fetches", recorder.Code, recorder.Body, upstream.fetches)
+	}
+	upstream.err = errors.New("gizmo g-missing: upstream returned 404 Not Found")
+	recorder = adminRequest(router, http.MethodPost, "/admin/gizmos/g-missing/refresh", "")
+	var response struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(recorder.Body.Bytes(), &response); recorder.Code != 502 || response.Error.Code != "gizmo_fetch_failed" {
+		t.Errorf("failed refresh: %d %s", recorder.Code, recorder.Body)
+	}
+}
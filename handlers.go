@@ -1,18 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	http "github.com/bogdanfinn/fhttp"
-	tlsclient "github.com/bogdanfinn/tls-client"
-	"github.com/bogdanfinn/tls-client/profiles"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	arkose "github.com/xqdoo00o/funcaptcha"
 )
 
 func optionsHandler(c *gin.Context) {
@@ -24,296 +22,291 @@ func optionsHandler(c *gin.Context) {
 		"message": "pong",
 	})
 }
-func dalle(c *gin.Context) {
-	var originalRequest APIRequest
-	_ = c.BindJSON(&originalRequest)
-	accessToken := c.GetHeader("Authorization")
-	puid := c.GetHeader("PUid")
-	translatedRequest := NewChatGPTRequest()
-	token, err := arkose.GetOpenAIAuthToken(puid, ProxyUrl)
-	if err != nil {
-		fmt.Println("arkose 获取失败，再来")
-		return
+
+// gateway holds the dependencies shared by the http handlers.
+type gateway struct {
+	upstream   Upstream
+	keys       *keyStore
+	proxies    *proxyPool
+	accounts   *accountPool
+	caps       *capLimiter
+	keyLimiter *keyLimiter
+	ledger     *ledger
+	models     *modelCatalog
+	gizmos     *gizmoCache
+	images     *imageFetcher
+}
+
+func newGateway(upstream Upstream, keys *keyStore, keyLimiter *keyLimiter, ledger *ledger, proxies *proxyPool, accounts *accountPool) *gateway {
+	return &gateway{
+		upstream:   upstream,
+		keys:       keys,
+		keyLimiter: keyLimiter,
+		ledger:     ledger,
+		proxies:    proxies,
+		accounts:   accounts,
+		caps:       newCapLimiter(config.Caps),
+		models:     newModelCatalog(upstream),
+		gizmos:     newGizmoCache(upstream),
+		images:     newImageFetcher(proxies),
 	}
-	translatedRequest.ArkoseToken = token
-	translatedRequest.Model = "gpt-4-gizmo"
-	jsonStr := `{
-    "gizmo": {
-      "id": "g-2fkFE8rbu",
-      "name": "DALL·E",
-      "author_name": "ChatGPT",
-      "author": {
-        "user_id": "user-u7SVk5APwT622QC7DPe41GHJ",
-        "display_name": "ChatGPT",
-        "link_to": null,
-        "selected_display": "name",
-        "is_verified": true
-      },
-      "config": {
-        "context_message": null,
-        "model_slug": null,
-        "assistant_welcome_message": "Hello",
-        "enabled_tools": [
-          {
-            "tool_id": "dalle"
-          }
-        ],
-        "files": [],
-        "tags": [
-          "public",
-          "first_party"
-        ]
-      },
-      "description": "Let me turn your imagination into imagery",
-      "owner_id": "user-u7SVk5APwT622QC7DPe41GHJ",
-      "updated_at": "2023-11-12T19:29:32.777742+00:00",
-      "profile_pic_permalink": "https://files.oaiusercontent.com/file-SxYQO0Fq1ZkPagkFtg67DRVb?se=2123-10-12T23%3A57%3A32Z&sp=r&sv=2021-08-06&sr=b&rscc=max-age%3D31536000%2C%20immutable&rscd=attachment%3B%20filename%3Dagent_3.webp&sig=pLlQh8oUktqQzhM09SDDxn5aakqFuM2FAPptuA0mbqc%3D",
-      "share_recipient": "marketplace",
-      "version": null,
-      "live_version": null,
-      "short_url": "g-2fkFE8rbu-dall-e",
-      "product_features": {
-        "attachments": {
-          "type": "retrieval",
-          "accepted_mime_types": [
-            "text/x-ruby",
-            "text/x-tex",
-            "application/vnd.openxmlformats-officedocument.presentationml.presentation",
-            "application/msword",
-            "application/x-latext",
-            "text/x-typescript",
-            "text/x-script.python",
-            "text/x-c++",
-            "text/x-php",
-            "text/x-sh",
-            "text/plain",
-            "text/html",
-            "application/pdf",
-            "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-            "text/x-c",
-            "application/json",
-            "text/markdown",
-            "text/x-java",
-            "text/javascript",
-            "text/x-csharp"
-          ],
-          "image_mime_types": [
-            "image/gif",
-            "image/jpeg",
-            "image/png",
-            "image/webp"
-          ],
-          "can_accept_all_mime_types": true
-        }
-      }
-    },
-    "kind": "gizmo_interaction",
-    "gizmo_id": "g-2fkFE8rbu"
-  }`
-	var data map[string]interface{}
-	_ = json.Unmarshal([]byte(jsonStr), &data)
-	translatedRequest.ConversationMode = data
-	for _, message := range originalRequest.Messages {
-		if message.Role == "system" {
-			message.Role = "critic"
-		}
-		translatedRequest.AddMessage(message.Role, message.Content)
-	}
-	marshal, _ := json.Marshal(translatedRequest)
-	fmt.Println(string(marshal))
-	response, _ := POSTConversation(translatedRequest, accessToken, puid, ProxyUrl)
-	fmt.Println(response.StatusCode)
-	fmt.Println(response.Status)
-	//HandleRequestError(c, response)
-	var continueInfo *ContinueInfo
-	var responsePart string
-	responsePart, continueInfo = Handler(c, response, true)
-	fmt.Println(continueInfo == nil)
-	fmt.Println(responsePart)
-	defer response.Body.Close()
 }
-func chatCompletions(c *gin.Context) {
-	proxyUrl := ProxyUrl
+
+func (g *gateway) chatCompletions(c *gin.Context) {
 	var originalRequest APIRequest
-	err := c.BindJSON(&originalRequest)
-	if err != nil {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "Request must be proper JSON",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+	if !bindChatRequest(c, &originalRequest) {
 		return
 	}
+	c.Set(usageModelKey, originalRequest.Model)
 
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "missing header parameter Authorization",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+	cred := requestCredential(c)
+
+	route, ok := g.resolveRoute(c, originalRequest.Model, cred)
+	if !ok {
 		return
 	}
-	puid := c.GetHeader("PUid")
-	if puid == "" {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "missing header parameter PUid",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+	if !g.reserveCapacity(c, route.Slug) {
 		return
 	}
-	accessToken := ""
-	if authHeader != "" {
-		customAccessToken := strings.Replace(authHeader, "Bearer ", "", 1)
-		// Check if customAccessToken starts with sk-
-		if strings.HasPrefix(customAccessToken, "eyJhbGciOiJSUzI1NiI") {
-			accessToken = customAccessToken
-		}
-	}
-	if accessToken == "" {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "wrong header parameter Authorization",
-			"type":    "invalid_request_error",
-			"param":   nil,
-			"code":    err.Error(),
-		}})
+	cred = requestCredential(c)
+
+	images, ok := g.loadImages(c, originalRequest)
+	if !ok {
 		return
 	}
 
 	// Convert the chat request to a ChatGPT request
-	translatedRequest := ConvertAPIRequest(originalRequest, puid, proxyUrl)
-
-	response, err := POSTConversation(translatedRequest, accessToken, puid, proxyUrl)
+	arkoseToken, err := g.upstream.ArkoseToken(cred)
 	if err != nil {
-		c.JSON(500, gin.H{
-			"error": "error sending request",
-		})
+		fmt.Println("Error getting Arkose token: ", err)
+	}
+	translatedRequest := ConvertAPIRequest(originalRequest, route, arkoseToken, images)
+	meta := newCompletionMeta(route)
+	writer := newCompletionWriter(c, meta, originalRequest.Stream)
+	writer.limits = newReplyLimits(originalRequest)
+	if originalRequest.usesTools() {
+		// A tool call must not reach the client as text before it is parsed
+		writer.hold = holdToolCall
+	}
+	if originalRequest.usesResponseFormat() {
+		writer.hold = holdAll
+	}
+
+	start := time.Now()
+	response, cred, ok := g.conversation(c, translatedRequest, cred)
+	if !ok {
 		return
 	}
-	defer response.Body.Close()
-	if HandleRequestError(c, response) {
+	promptTokens := countPromptTokens(originalRequest.Messages)
+	for _, prompt := range gatewayPrompts(originalRequest) {
+		promptTokens += tokensPerMessage + countTokens("system") + countTokens(prompt)
+	}
+	// Each exchange with the upstream is recorded on its own, the first
+	// carries the prompt and each continuation the text it added
+	upstreamReply, ok := g.readReply(c, writer, translatedRequest, response, cred, usageRecord{Time: start, Kind: usageCompletion, PromptTokens: promptTokens})
+	if !ok {
 		return
 	}
-	var fullResponse string
-	defer response.Body.Close()
-	for i := 3; i > 0; i-- {
-		var continueInfo *ContinueInfo
-		var responsePart string
-		responsePart, continueInfo = Handler(c, response, originalRequest.Stream)
-		fullResponse += responsePart
-		if continueInfo == nil {
-			break
+	completionTokens := upstreamReply.CompletionTokens
+	reply := completionReply{Content: upstreamReply.Text, FinishReason: upstreamReply.FinishReason}
+	if originalRequest.usesTools() {
+		if content, calls := extractToolCalls(upstreamReply.Text, originalRequest.Tools, originalRequest.parallelToolCalls()); len(calls) > 0 {
+			reply = completionReply{Content: content, ToolCalls: calls, FinishReason: "tool_calls"}
+			if originalRequest.functions {
+				reply = completionReply{Content: content, FunctionCall: &calls[0].Function, FinishReason: "function_call"}
+			}
 		}
-		println("Continuing conversation")
-		translatedRequest.Messages = nil
-		translatedRequest.Action = "continue"
-		translatedRequest.ConversationID = continueInfo.ConversationID
-		translatedRequest.ParentMessageID = continueInfo.ParentID
-		response, err = POSTConversation(translatedRequest, accessToken, puid, proxyUrl)
-		if err != nil {
-			c.JSON(500, gin.H{
-				"error": "error sending request",
-			})
-			return
+	}
+	// A reply cut for length is returned as is, like OpenAI does
+	if originalRequest.usesResponseFormat() && len(reply.ToolCalls) == 0 && reply.FunctionCall == nil && reply.FinishReason != "length" {
+		content, err := originalRequest.checkStructuredReply(upstreamReply.Text)
+		// Ask for a correction in the same conversation, the model sees
+		// its own reply and what is wrong with it
+		for attempt := 0; err != nil && attempt < config.ResponseFormat.RepairAttempts && upstreamReply.Last != nil; attempt++ {
+			fmt.Println("Asking for a corrected reply: ", err)
+			prompt := repairPrompt(originalRequest, err)
+			repair := translatedRequest
+			repair.Messages = nil
+			repair.AddMessage("user", prompt)
+			writer.Discard()
+			record := usageRecord{Time: time.Now(), Kind: usageRepair, PromptTokens: tokensPerMessage + countTokens("user") + countTokens(prompt)}
+			promptTokens += record.PromptTokens
+			response, sendErr := g.followUp(c.Request.Context(), repair, upstreamReply.Last, cred)
+			if sendErr != nil {
+				c.JSON(500, gin.H{
+					"error": "error sending request",
+				})
+				return
+			}
+			if HandleRequestError(c, response) {
+				response.Body.Close()
+				return
+			}
+			if upstreamReply, ok = g.readReply(c, writer, repair, response, cred, record); !ok {
+				return
+			}
+			completionTokens += upstreamReply.CompletionTokens
+			reply.FinishReason = upstreamReply.FinishReason
+			content, err = originalRequest.checkStructuredReply(upstreamReply.Text)
 		}
-		if HandleRequestError(c, response) {
+		if err != nil {
+			c.Set(usedTokensKey, promptTokens+completionTokens)
+			c.Error(err)
+			c.Header("Content-Type", "application/json")
+			c.JSON(502, gin.H{"error": gin.H{
+				"message": "The model did not produce a reply matching response_format: " + err.Error(),
+				"type":    "upstream_error",
+				"param":   "response_format",
+				"code":    "response_format_mismatch",
+			}})
 			return
 		}
+		reply.Content = content
 	}
+	tokens := newUsage(promptTokens, completionTokens)
+	c.Set(usedTokensKey, tokens.TotalTokens)
 	if !originalRequest.Stream {
-		completion := NewChatCompletion(fullResponse)
-		completion.Model = originalRequest.Model
+		completion := NewChatCompletion(meta, reply)
+		completion.Usage = tokens
 		c.JSON(200, completion)
 	} else {
+		if err := writer.Finish(reply); err != nil {
+			abortStream(c, err, true)
+			return
+		}
+		if originalRequest.StreamOptions != nil && originalRequest.StreamOptions.IncludeUsage {
+			usageChunk := UsageChunk(meta, tokens)
+			c.Writer.WriteString("data: " + usageChunk.String() + "\n\n")
+		}
 		c.String(200, "data: [DONE]\n\n")
 	}
 
 }
 
-func ConvertAPIRequest(apiRequest APIRequest, puid string, proxyUrl string) ChatGPTRequest {
+// ConvertAPIRequest translates a chat request. images holds the loaded
+// image inputs of each message, nil when there are none.
+func ConvertAPIRequest(apiRequest APIRequest, route ResolvedRoute, arkoseToken string, images [][]*imageInput) ChatGPTRequest {
 	chatgptRequest := NewChatGPTRequest()
-	token, err := arkose.GetOpenAIAuthToken(puid, proxyUrl)
-	if err == nil {
-		chatgptRequest.ArkoseToken = token
-	} else {
-		fmt.Println("Error getting Arkose token: ", err)
-		return chatgptRequest
-	}
-	if strings.HasPrefix(apiRequest.Model, "gpt-3.5") {
-		chatgptRequest.Model = "text-davinci-002-render-sha"
-	}
-	if strings.HasPrefix(apiRequest.Model, "gpt-4") {
-		chatgptRequest.Model = apiRequest.Model
-		// Cover some models like gpt-4-32k
-		if len(apiRequest.Model) >= 7 && apiRequest.Model[6] >= 48 && apiRequest.Model[6] <= 57 {
-			chatgptRequest.Model = "gpt-4"
-		}
-	}
+	chatgptRequest.ArkoseToken = arkoseToken
+	chatgptRequest.Model = route.Slug
+	chatgptRequest.ConversationMode = route.ConversationMode
 	if apiRequest.PluginIDs != nil {
 		chatgptRequest.PluginIDs = apiRequest.PluginIDs
 		chatgptRequest.Model = "gpt-4-plugins"
 	}
+	for _, prompt := range gatewayPrompts(apiRequest) {
+		chatgptRequest.AddMessage("critic", prompt)
+	}
+	// Tool results only carry the id of their call, the name comes from the
+	// assistant message that made it
+	names := map[string]string{}
 	for _, message := range apiRequest.Messages {
-		if message.Role == "system" {
-			message.Role = "critic"
+		for _, call := range message.ToolCalls {
+			names[call.ID] = call.Function.Name
+		}
+	}
+	for i, message := range apiRequest.Messages {
+		role, text := toolMessageText(message, names)
+		if role == "system" || role == "developer" {
+			role = "critic"
+		}
+		if images != nil && len(images[i]) > 0 {
+			chatgptRequest.AddMultimodalMessage(role, text, images[i])
+			continue
 		}
-		chatgptRequest.AddMessage(message.Role, message.Content)
+		chatgptRequest.AddMessage(role, text)
 	}
 	return chatgptRequest
 }
 
-var (
-	jar     = tlsclient.NewCookieJar()
-	options = []tlsclient.HttpClientOption{
-		tlsclient.WithTimeoutSeconds(360),
-		tlsclient.WithClientProfile(profiles.Okhttp4Android13),
-		tlsclient.WithNotFollowRedirects(),
-		tlsclient.WithCookieJar(jar), // create cookieJar instance and pass it as argument
-		// Disable SSL verification
-		tlsclient.WithInsecureSkipVerify(),
-	}
-	client, _ = tlsclient.NewHttpClient(tlsclient.NewNoopLogger(), options...)
-)
-
-func init() {
-	arkose.SetTLSClient(&client)
-}
-func POSTConversation(message ChatGPTRequest, accessToken string, puid string, proxy string) (*http.Response, error) {
-	if proxy != "" {
-		client.SetProxy(proxy)
+// gatewayPrompts are the instructions the gateway adds as system messages
+// for what the web backend cannot do itself.
+func gatewayPrompts(apiRequest APIRequest) []string {
+	var prompts []string
+	for _, prompt := range []string{toolsPrompt(apiRequest), responseFormatPrompt(apiRequest)} {
+		if prompt != "" {
+			prompts = append(prompts, prompt)
+		}
 	}
+	return prompts
+}
 
-	apiUrl := "https://chat.openai.com/backend-api/conversation"
+// upstreamReply is a reply read from the upstream with the continuations
+// it took.
+type upstreamReply struct {
+	Text string
+	// Last is where the reply ended in the upstream conversation
+	Last             *ContinueInfo
+	FinishReason     string
+	CompletionTokens int
+}
 
-	// JSONify the body and add it to the request
-	bodyJson, err := json.Marshal(message)
-	if err != nil {
-		return &http.Response{}, err
+// readReply reads the reply in response, asking the upstream to continue
+// it while it is cut off for length, and records each exchange starting
+// with record. It writes the error and returns false when the upstream
+// fails.
+func (g *gateway) readReply(c *gin.Context, w *completionWriter, request ChatGPTRequest, response *http.Response, cred Credential, record usageRecord) (upstreamReply, bool) {
+	reply := upstreamReply{FinishReason: "stop"}
+	for i := 3; i > 0; i-- {
+		part, continueInfo, err := Handler(w, response)
+		response.Body.Close()
+		if err != nil {
+			// The text streamed before the failure was still generated
+			c.Set(usedTokensKey, recordedTokens(c)+record.PromptTokens+countTokens(part))
+			abortStream(c, err, w.stream)
+			return reply, false
+		}
+		w.EndPart(part)
+		reply.Text += part
+		record.CompletionTokens = countTokens(part)
+		record.LatencyMs = time.Since(record.Time).Milliseconds()
+		addUsage(c, record)
+		reply.CompletionTokens += record.CompletionTokens
+		if continueInfo != nil {
+			reply.Last = continueInfo
+		}
+		if w.finishReason != "" {
+			reply.FinishReason = w.finishReason
+			break
+		}
+		if continueInfo == nil || !continueInfo.Truncated {
+			break
+		}
+		if i == 1 {
+			reply.FinishReason = "length"
+			break
+		}
+		println("Continuing conversation")
+		record = usageRecord{Time: time.Now(), Kind: usageContinuation}
+		request.Messages = nil
+		request.Action = "continue"
+		response, err = g.followUp(c.Request.Context(), request, continueInfo, cred)
+		if err != nil {
+			c.JSON(500, gin.H{
+				"error": "error sending request",
+			})
+			return reply, false
+		}
+		if HandleRequestError(c, response) {
+			response.Body.Close()
+			return reply, false
+		}
 	}
+	return reply, true
+}
 
-	request, err := http.NewRequest(http.MethodPost, apiUrl, bytes.NewBuffer(bodyJson))
-	if err != nil {
-		return &http.Response{}, err
-	}
-	// Clear cookies
-	if puid != "" {
-		request.Header.Set("Cookie", "_puid="+puid+";")
-	}
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36")
-	request.Header.Set("Accept", "*/*")
-	if accessToken != "" {
-		request.Header.Set("Authorization", "Bearer "+accessToken)
-	}
+// followUp sends request as the next turn of the conversation in info,
+// after the assistant message it ends with. Arkose tokens are single use,
+// every turn fetches its own.
+func (g *gateway) followUp(ctx context.Context, request ChatGPTRequest, info *ContinueInfo, cred Credential) (*http.Response, error) {
+	request.ConversationID = info.ConversationID
+	request.ParentMessageID = info.ParentID
+	arkoseToken, err := g.upstream.ArkoseToken(cred)
 	if err != nil {
-		return &http.Response{}, err
+		fmt.Println("Error getting Arkose token: ", err)
 	}
-	response, err := client.Do(request)
-	return response, err
+	request.ArkoseToken = arkoseToken
+	return g.upstream.Conversation(ctx, request, cred)
 }
 
 func HandleRequestError(c *gin.Context, response *http.Response) bool {
@@ -344,102 +337,246 @@ func HandleRequestError(c *gin.Context, response *http.Response) bool {
 	return false
 }
 
+// ContinueInfo is the upstream message a reply ended with, to continue the
+// conversation from.
 type ContinueInfo struct {
 	ConversationID string `json:"conversation_id"`
 	ParentID       string `json:"parent_id"`
+	// Truncated is set when the upstream stopped for length
+	Truncated bool `json:"-"`
+}
+
+// UpstreamError is an error the upstream reported inside its event stream.
+type UpstreamError struct {
+	Detail interface{}
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream error: %v", e.Detail)
 }
 
-func Handler(c *gin.Context, response *http.Response, stream bool) (string, *ContinueInfo) {
+func Handler(w *completionWriter, response *http.Response) (string, *ContinueInfo, error) {
 	maxTokens := false
 
-	// Create a bufio.Reader from the response body
-	reader := bufio.NewReader(response.Body)
+	responses := newResponseStream(response.Body)
 
-	// Read the response byte by byte until a newline character is encountered
-	if stream {
-		// Response content type is text/event-stream
-		c.Header("Content-Type", "text/event-stream")
-	} else {
-		// Response content type is application/json
-		c.Header("Content-Type", "application/json")
+	policy := config.Stream.RewritePolicy
+	if !w.stream {
+		// Nothing is sent before the reply is complete, so a rewrite
+		// cannot contradict it
+		policy = rewriteFollow
 	}
-	var finishReason string
-	var previousText StringStruct
-	var originalResponse ChatGPTResponse
-	var isRole = true
+	text := newTextDelta(policy)
+	// last is where a follow-up turn continues from, the latest event of
+	// the assistant reply. The stream reuses its response, so only the ids
+	// are kept.
+	var last *ContinueInfo
 	for {
-		line, err := reader.ReadString('\n')
-		fmt.Println("打印每行数据")
-		fmt.Println(line)
+		next, err := responses.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", nil
+			return text.Emitted(), nil, err
 		}
-		if len(line) < 6 {
+		originalResponse := next
+		if originalResponse.Message.Author.Role != "assistant" || originalResponse.Message.Content.ContentType != "text" || len(originalResponse.Message.Content.Parts) == 0 {
 			continue
 		}
-		// Remove "data: " from the beginning of the line
-		line = line[6:]
-		// Check if line starts with [DONE]
-		if !strings.HasPrefix(line, "[DONE]") {
-			// Parse the line as JSON
-
-			err = json.Unmarshal([]byte(line), &originalResponse)
-			if err != nil {
-				continue
-			}
-			if originalResponse.Error != nil {
-				c.JSON(500, gin.H{"error": originalResponse.Error})
-				return "", nil
-			}
-			if originalResponse.Message.Author.Role != "assistant" || originalResponse.Message.Content.Parts == nil {
-				continue
-			}
-			if originalResponse.Message.Metadata.MessageType != "next" && originalResponse.Message.Metadata.MessageType != "continue" || originalResponse.Message.EndTurn != nil {
-				continue
-			}
-			responseString := ConvertToString(&originalResponse, &previousText, isRole)
-			isRole = false
-			if stream {
-				_, err = c.Writer.WriteString(responseString)
-				if err != nil {
-					return "", nil
-				}
-			}
-			// Flush the response writer buffer to ensure that the client receives each line as it's written
-			c.Writer.Flush()
-
-			if originalResponse.Message.Metadata.FinishDetails != nil {
-				if originalResponse.Message.Metadata.FinishDetails.Type == "max_tokens" {
-					maxTokens = true
-				}
-				finishReason = originalResponse.Message.Metadata.FinishDetails.Type
-			}
+		if messageType := originalResponse.Message.Metadata.MessageType; messageType != "" && messageType != "next" && messageType != "continue" {
+			continue
+		}
+		last = continueInfo(originalResponse, false)
+		if _, err := text.Next(originalResponse.Message.ID, originalResponse.Message.Content.Text()); err != nil {
+			return text.Emitted(), nil, err
+		}
+		kept, err := w.Write(text.Emitted())
+		if err != nil {
+			return text.Emitted(), nil, err
+		}
+		if w.finishReason != "" {
+			// The reply is complete, the caller closing the response is what
+			// stops the upstream generation, as it does for the web client
+			return text.Emitted()[:kept], last, nil
+		}
 
-		} else {
-			if stream {
-				finalLine := StopChunk(finishReason)
-				c.Writer.WriteString("data: " + finalLine.String() + "\n\n")
-			}
+		if originalResponse.Message.Metadata.FinishDetails != nil {
+			maxTokens = originalResponse.Message.Metadata.FinishDetails.Type == "max_tokens"
 		}
 	}
-	if !maxTokens {
-		return previousText.Text, nil
+	if text.Diverged() {
+		// Only with rewrite_policy ignore, the reply keeps the streamed text
+		fmt.Printf("upstream rewrote streamed text %d times, reply keeps the %d streamed bytes instead of %d\n", text.rewrites, len(text.Emitted()), len(text.Text()))
 	}
-	return previousText.Text, &ContinueInfo{
-		ConversationID: originalResponse.ConversationID,
-		ParentID:       originalResponse.Message.ID,
+	if last != nil {
+		last.Truncated = maxTokens
 	}
+	return text.Emitted(), last, nil
 }
 
-func ConvertToString(chatgptResponse *ChatGPTResponse, previousText *StringStruct, role bool) string {
-	translatedResponse := NewChatCompletionChunk(strings.ReplaceAll(chatgptResponse.Message.Content.Parts[0], *&previousText.Text, ""))
-	if role {
-		translatedResponse.Choices[0].Delta.Role = chatgptResponse.Message.Author.Role
+func continueInfo(response *ChatGPTResponse, truncated bool) *ContinueInfo {
+	return &ContinueInfo{
+		ConversationID: response.ConversationID,
+		ParentID:       response.Message.ID,
+		Truncated:      truncated,
 	}
-	previousText.Text = chatgptResponse.Message.Content.Parts[0]
-	return "data: " + translatedResponse.String() + "\n\n"
+}
 
+// abortStream reports a failed upstream stream to the client, as a JSON
+// error if nothing was sent yet or as a final error event otherwise.
+func abortStream(c *gin.Context, err error, stream bool) {
+	code := "upstream_error"
+	switch {
+	case errors.Is(err, ErrStreamTruncated):
+		code = "stream_truncated"
+	case errors.Is(err, ErrStreamMalformed):
+		code = "stream_malformed"
+	case errors.Is(err, ErrStreamRewritten):
+		code = "stream_rewritten"
+	}
+	body := gin.H{"error": gin.H{
+		"message": err.Error(),
+		"type":    "upstream_error",
+		"param":   nil,
+		"code":    code,
+	}}
+	c.Error(err)
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		body = gin.H{"error": upstreamErr.Detail}
+	}
+	if !c.Writer.Written() {
+		c.Header("Content-Type", "application/json")
+		c.JSON(502, body)
+		return
+	}
+	if stream {
+		payload, _ := json.Marshal(body)
+		c.Writer.WriteString("data: " + string(payload) + "\n\ndata: [DONE]\n\n")
+		c.Writer.Flush()
+	}
+}
+
+// completionWriter streams a reply to the client as it arrives. A reply
+// spans every part the upstream was asked to continue.
+type completionWriter struct {
+	c      *gin.Context
+	meta   completionMeta
+	stream bool
+	// hold returns how much of the reply may be sent so far, the rest is
+	// held until the reply is finished. nil sends everything.
+	hold   func(string) int
+	limits replyLimits
+	// finishReason is set once limits ended the reply
+	finishReason string
+	// reply is the text of the finished parts, sent how much of it the
+	// client got
+	reply string
+	sent  int
+	role  bool
+}
+
+func newCompletionWriter(c *gin.Context, meta completionMeta, stream bool) *completionWriter {
+	if stream {
+		c.Header("Content-Type", "text/event-stream")
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+	return &completionWriter{c: c, meta: meta, stream: stream}
+}
+
+// Write streams what is new in part, the text of the current part so far.
+// It returns how much of part the reply keeps, less than all of it once
+// the limits end the reply.
+func (w *completionWriter) Write(part string) (int, error) {
+	full := w.reply + part
+	kept := len(part)
+	if end, reason := w.limits.cut(full); reason != "" {
+		// What was sent stays sent
+		if end < w.sent {
+			end = w.sent
+		}
+		if kept = end - len(w.reply); kept < 0 {
+			kept = 0
+		}
+		full = full[:len(w.reply)+kept]
+		w.finishReason = reason
+	}
+	if !w.stream {
+		return kept, nil
+	}
+	n := len(full)
+	if w.hold != nil {
+		n = w.hold(full)
+	}
+	if held := w.limits.hold(full); w.finishReason == "" && held < n {
+		n = held
+	}
+	if n <= w.sent {
+		return kept, nil
+	}
+	return kept, w.send(full[w.sent:n], n)
+}
+
+func (w *completionWriter) send(content string, sent int) error {
+	chunk := NewChatCompletionChunk(w.meta, content)
+	if !w.role {
+		chunk.Choices[0].Delta.Role = "assistant"
+		w.role = true
+	}
+	w.sent = sent
+	return w.chunk(chunk)
+}
+
+func (w *completionWriter) chunk(chunk ChatCompletionChunk) error {
+	if _, err := w.c.Writer.WriteString("data: " + chunk.String() + "\n\n"); err != nil {
+		return err
+	}
+	// Flush the response writer buffer to ensure that the client receives each line as it's written
+	w.c.Writer.Flush()
+	return nil
+}
+
+// Discard drops the reply so far, to read it again. Nothing of it may
+// have been sent.
+func (w *completionWriter) Discard() {
+	w.reply, w.sent, w.finishReason = "", 0, ""
+}
+
+// EndPart adds a finished part to the reply.
+func (w *completionWriter) EndPart(part string) {
+	w.reply += part
+}
+
+// Finish sends what was held back, the tool or function calls and the
+// finish reason.
+// The reply content must extend what was streamed, the reply is built
+// from the emitted text and only held text is cut out of it; should it
+// not, the rewrite policy decides.
+func (w *completionWriter) Finish(reply completionReply) error {
+	sent := w.reply[:w.sent]
+	var rest string
+	if strings.HasPrefix(reply.Content, sent) {
+		rest = reply.Content[len(sent):]
+	} else if config.Stream.RewritePolicy == RewriteError {
+		return &StreamError{Kind: ErrStreamRewritten, Data: reply.Content}
+	} else {
+		fmt.Printf("reply does not extend the %d streamed bytes, keeping them\n", len(sent))
+	}
+	if rest != "" || !w.role {
+		if err := w.send(rest, len(w.reply)); err != nil {
+			return err
+		}
+	}
+	if len(reply.ToolCalls) > 0 {
+		if err := w.chunk(ToolCallsChunk(w.meta, reply.ToolCalls)); err != nil {
+			return err
+		}
+	}
+	if reply.FunctionCall != nil {
+		if err := w.chunk(FunctionCallChunk(w.meta, *reply.FunctionCall)); err != nil {
+			return err
+		}
+	}
+	return w.chunk(StopChunk(w.meta, reply.FinishReason))
 }
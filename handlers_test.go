@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testAccessToken is an unsigned access token that parses like the web
+// backend's and expires in a day.
+func testAccessToken() string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	header := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload := encode(map[string]interface{}{
+		"exp": time.Now().Add(24 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"https://api.openai.com/auth": map[string]string{
+			"user_id":           "user-test",
+			"chatgpt_plan_type": "plus",
+		},
+	})
+	return header + "." + payload + ".c2lnbmF0dXJl"
+}
+
+// testConfig resets config to the defaults, with everything kept in
+// memory.
+func testConfig() {
+	config = defaultConfig()
+	config.Keys.File = ""
+	config.Keys.UsageFile = ""
+	config.Ledger.File = ""
+	config.Gizmos.CacheDir = ""
+}
+
+// testGateway serves the gateway routes over upstream with the default
+// config, and returns a key to call them with.
+func testGateway(t *testing.T, upstream Upstream) (*gin.Engine, string) {
+	t.Helper()
+	testConfig()
+	return testRouter(t, upstream, false)
+}
+
+// testRouter serves the gateway routes over upstream with the current
+// config, and returns a key to call them with, a pool key if pool is set.
+func testRouter(t *testing.T, upstream Upstream, pool bool) (*gin.Engine, string) {
+	t.Helper()
+	keys, err := loadKeyStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyLimiter, err := loadKeyLimiter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := openLedger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := Credential{AccessToken: testAccessToken(), PUID: "user-test"}
+	if pool {
+		cred = Credential{}
+	}
+	plain, _, err := keys.Create("test", cred, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(upstream, keys, keyLimiter, ledger, newProxyPool(config), newAccountPool(config.Accounts))
+	return newRouter(g), plain
+}
+
+// snapshot is a conversation event of the snapshot protocol.
+func snapshot(id string, text string, finish string) string {
+	metadata := map[string]interface{}{"message_type": "next"}
+	if finish != "" {
+		metadata["finish_details"] = map[string]string{"type": finish}
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"id":       id,
+			"author":   map[string]string{"role": "assistant"},
+			"content":  map[string]interface{}{"content_type": "text", "parts": []string{text}},
+			"metadata": metadata,
+		},
+		"conversation_id": "conv-1",
+		"error":           nil,
+	})
+	return string(data)
+}
+
+func postChat(t *testing.T, router *gin.Engine, key string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+key)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// readChunks decodes a streamed completion, it fails the test unless the
+// stream ends with [DONE].
+func readChunks(t *testing.T, body string) []map[string]interface{} {
+	t.Helper()
+	var chunks []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	done := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if !done {
+		t.Fatalf("stream did not end with [DONE]:\n%s", body)
+	}
+	return chunks
+}
+
+// streamedText joins the content deltas and returns the finish reason of
+// the stream.
+func streamedText(chunks []map[string]interface{}) (string, interface{}) {
+	var text strings.Builder
+	var finish interface{}
+	for _, chunk := range chunks {
+		choices, _ := chunk["choices"].([]interface{})
+		for _, choice := range choices {
+			choice := choice.(map[string]interface{})
+			delta := choice["delta"].(map[string]interface{})
+			content, _ := delta["content"].(string)
+			text.WriteString(content)
+			if reason := choice["finish_reason"]; reason != nil {
+				finish = reason
+			}
+		}
+	}
+	return text.String(), finish
+}
+
+func TestChatCompletion(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hel", ""), snapshot("m1", "Hello", "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4","messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hello world"}]}`)
+	if recorder.Code != 200 {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	message := completion.Choices[0].Message
+	if message.Content == nil || *message.Content != "Hello" || completion.Choices[0].FinishReason != "stop" {
+		t.Errorf("got %s", recorder.Body)
+	}
+	if completion.Model != "gpt-4" || !strings.HasPrefix(completion.ID, "chatcmpl-") {
+		t.Errorf("got model %q, id %q", completion.Model, completion.ID)
+	}
+	if completion.Usage.CompletionTokens != 1 || completion.Usage.TotalTokens != completion.Usage.PromptTokens+1 {
+		t.Errorf("got usage %+v", completion.Usage)
+	}
+
+	requests := upstream.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("upstream got %d requests", len(requests))
+	}
+	sent := requests[0]
+	if sent.Model != "gpt-4" || sent.Action != "next" || len(sent.Messages) != 2 {
+		t.Fatalf("upstream got %+v", sent)
+	}
+	if role, text := sent.Messages[0].Author.Role, sent.Messages[0].Content.Parts[0]; role != "critic" || text != "Be brief." {
+		t.Errorf("system message sent as %s %q", role, text)
+	}
+	if role, text := sent.Messages[1].Author.Role, sent.Messages[1].Content.Parts[0]; role != "user" || text != "hello world" {
+		t.Errorf("user message sent as %s %q", role, text)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(
+		snapshot("m1", "Hel", ""),
+		snapshot("m1", "Hello", ""),
+		snapshot("m1", "Hello, world", "stop"),
+		"[DONE]",
+	)})
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != 200 {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Content-Type %q", contentType)
+	}
+	chunks := readChunks(t, recorder.Body.String())
+	text, finish := streamedText(chunks)
+	if text != "Hello, world" || finish != "stop" {
+		t.Errorf("streamed %q, finish reason %v", text, finish)
+	}
+	first := chunks[0]["choices"].([]interface{})[0].(map[string]interface{})["delta"].(map[string]interface{})
+	if first["role"] != "assistant" {
+		t.Errorf("first delta %v has no role", first)
+	}
+	last := chunks[len(chunks)-1]
+	if choices := last["choices"].([]interface{}); len(choices) != 0 || last["usage"] == nil {
+		t.Errorf("last chunk %v is not the usage chunk", last)
+	}
+	for _, chunk := range chunks {
+		if chunk["id"] != chunks[0]["id"] {
+			t.Errorf("chunk ids differ: %v and %v", chunk["id"], chunks[0]["id"])
+		}
+	}
+}
+
+func TestChatCompletionContinues(t *testing.T) {
+	upstream := NewFakeUpstream(
+		FakeReply{Body: SSEBody(snapshot("m1", "Hello", "max_tokens"), "[DONE]")},
+		FakeReply{Body: SSEBody(snapshot("m2", ", world", "stop"), "[DONE]")},
+	)
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	text, finish := streamedText(readChunks(t, recorder.Body.String()))
+	if text != "Hello, world" || finish != "stop" {
+		t.Errorf("streamed %q, finish reason %v", text, finish)
+	}
+	requests := upstream.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("upstream got %d requests", len(requests))
+	}
+	if next := requests[1]; next.Action != "continue" || next.ConversationID != "conv-1" || next.ParentMessageID != "m1" || len(next.Messages) != 0 {
+		t.Errorf("continuation sent as %+v", next)
+	}
+}
+
+func TestChatCompletionStreamRewritten(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello wor", ""), snapshot("m1", "Hi there, world!", "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	chunks := readChunks(t, recorder.Body.String())
+	text, _ := streamedText(chunks)
+	last := chunks[len(chunks)-1]
+	if text != "Hello wor" || last["error"] == nil || last["error"].(map[string]interface{})["code"] != "stream_rewritten" {
+		t.Errorf("streamed %q, then %v", text, last)
+	}
+
+	// Without streaming there is nothing to contradict
+	recorder = postChat(t, router, key, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if content := completion.Choices[0].Message.Content; content == nil || *content != "Hi there, world!" {
+		t.Errorf("got %s", recorder.Body)
+	}
+}
+
+func TestChatCompletionUpstreamErrors(t *testing.T) {
+	for name, reply := range map[string]FakeReply{
+		"status":    {StatusCode: 403, Body: `{"detail":"Only one message at a time."}`},
+		"truncated": {Body: SSEBody(snapshot("m1", "Hel", ""))},
+		"error":     {Err: fmt.Errorf("connection refused")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			router, key := testGateway(t, NewFakeUpstream(reply))
+			recorder := postChat(t, router, key, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+			var body struct {
+				Error json.RawMessage `json:"error"`
+			}
+			if recorder.Code < 400 || json.Unmarshal(recorder.Body.Bytes(), &body) != nil || body.Error == nil {
+				t.Errorf("status %d: %s", recorder.Code, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestChatCompletionToolCalls(t *testing.T) {
+	reply := "Let me check.\n```json\n{\"tool_calls\": [{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\",}}]}\n```"
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", reply[:20], ""), snapshot("m1", reply, "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+	request := `{"model":"gpt-4","stream":%t,"messages":[{"role":"user","content":"weather in Paris?"}],"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]}`
+
+	recorder := postChat(t, router, key, fmt.Sprintf(request, false))
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	choice := completion.Choices[0]
+	if choice.FinishReason != "tool_calls" || len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("got %s", recorder.Body)
+	}
+
+	recorder = postChat(t, router, key, fmt.Sprintf(request, true))
+	chunks := readChunks(t, recorder.Body.String())
+	text, finish := streamedText(chunks)
+	if text != "Let me check." || finish != "tool_calls" {
+		t.Errorf("streamed %q, finish reason %v", text, finish)
+	}
+	if !strings.Contains(recorder.Body.String(), `"tool_calls":[{"index":0,`) {
+		t.Errorf("no tool call delta in %s", recorder.Body)
+	}
+}
+
+func TestChatCompletionUnsupportedParams(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"temperature":0.2,"seed":7,"service_tier":"flex","store":true,"metadata":{"team":"a"}}`
+
+	recorder := postChat(t, router, key, body)
+	if ignored := recorder.Header().Get("X-Ignored-Params"); recorder.Code != 200 || ignored != "temperature,seed,service_tier,store,metadata" {
+		t.Errorf("status %d, X-Ignored-Params %q", recorder.Code, ignored)
+	}
+
+	config.Compat.Mode = CompatStrict
+	for param, value := range map[string]string{"seed": "7", "service_tier": `"flex"`, "store": "true", "metadata": `{"team":"a"}`} {
+		recorder = postChat(t, router, key, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"`+param+`":`+value+`}`)
+		var response struct {
+			Error struct {
+				Param string `json:"param"`
+				Code  string `json:"code"`
+			} `json:"error"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != 400 || response.Error.Param != param || response.Error.Code != "unsupported_parameter" {
+			t.Errorf("%s: status %d: %s", param, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func TestChatCompletionFunctionCall(t *testing.T) {
+	reply := "```json\n{\"tool_calls\": [{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}, {\"name\": \"get_weather\", \"arguments\": {\"city\": \"Rome\"}}]}\n```"
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", reply, "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+	request := `{"model":"gpt-4","stream":%t,"messages":[{"role":"user","content":"weather?"}],"functions":[{"name":"get_weather","parameters":{"type":"object"}}],"function_call":{"name":"get_weather"}}`
+
+	recorder := postChat(t, router, key, fmt.Sprintf(request, false))
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	choice := completion.Choices[0]
+	call := choice.Message.FunctionCall
+	if choice.FinishReason != "function_call" || call == nil || call.Name != "get_weather" || call.Arguments != `{"city": "Paris"}` || choice.Message.Content != nil || len(choice.Message.ToolCalls) != 0 {
+		t.Errorf("got %s", recorder.Body)
+	}
+	if prompt := upstream.Requests()[0].Messages[0].Content.Parts[0].(string); !strings.Contains(prompt, "You must call the tool get_weather.") {
+		t.Errorf("function_call not in the prompt %q", prompt)
+	}
+
+	recorder = postChat(t, router, key, fmt.Sprintf(request, true))
+	_, finish := streamedText(readChunks(t, recorder.Body.String()))
+	if finish != "function_call" || !strings.Contains(recorder.Body.String(), `"delta":{"function_call":{"name":"get_weather","arguments":"{\"city\": \"Paris\"}"}}`) {
+		t.Errorf("streamed %s", recorder.Body)
+	}
+
+	for body, param := range map[string]string{
+		`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"functions":[{"name":"f"}],"function_call":{"name":"g"}}`:                          "function_call",
+		`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"functions":[{"name":"f"}],"tools":[{"type":"function","function":{"name":"f"}}]}`: "functions",
+	} {
+		recorder = postChat(t, router, key, body)
+		if recorder.Code != 400 || !strings.Contains(recorder.Body.String(), `"param":"`+param+`"`) {
+			t.Errorf("status %d: %s", recorder.Code, recorder.Body)
+		}
+	}
+}
+
+// tokenUpstream hands out a new arkose token on every call.
+type tokenUpstream struct {
+	*FakeUpstream
+	tokens int32
+}
+
+func (u *tokenUpstream) ArkoseToken(Credential) (string, error) {
+	return fmt.Sprintf("arkose-%d", atomic.AddInt32(&u.tokens, 1)), nil
+}
+
+func TestChatCompletionRepairTurn(t *testing.T) {
+	// The backend may end the stream with events of other messages
+	trailing := `{"message":{"id":"m-tool","author":{"role":"tool"},"content":{"content_type":"text","parts":["done"]},"metadata":{}},"conversation_id":"conv-1","error":null}`
+	upstream := &tokenUpstream{FakeUpstream: NewFakeUpstream(
+		FakeReply{Body: SSEBody(snapshot("m1", "Sure! Here it is", "stop"), trailing, "[DONE]")},
+		FakeReply{Body: SSEBody(snapshot("m2", `{"ok": true}`, "stop"), "[DONE]")},
+	)}
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4","messages":[{"role":"user","content":"reply in json"}],"response_format":{"type":"json_object"}}`)
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if content := completion.Choices[0].Message.Content; content == nil || *content != `{"ok": true}` {
+		t.Errorf("got %s", recorder.Body)
+	}
+	requests := upstream.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("upstream got %d requests", len(requests))
+	}
+	first, repair := requests[0], requests[1]
+	if repair.ConversationID != "conv-1" || repair.ParentMessageID != "m1" {
+		t.Errorf("repair turn sent in %q after %q", repair.ConversationID, repair.ParentMessageID)
+	}
+	if first.ArkoseToken == "" || repair.ArkoseToken == "" || first.ArkoseToken == repair.ArkoseToken {
+		t.Errorf("arkose tokens %q and %q", first.ArkoseToken, repair.ArkoseToken)
+	}
+}
+
+// frameBody serves one frame per read and records the reads.
+type frameBody struct {
+	frames []string
+	reads  int32
+	closed int32
+}
+
+func (b *frameBody) Read(p []byte) (int, error) {
+	n := int(atomic.AddInt32(&b.reads, 1))
+	if atomic.LoadInt32(&b.closed) != 0 {
+		return 0, errors.New("read after close")
+	}
+	if n > len(b.frames) {
+		return 0, io.EOF
+	}
+	return copy(p, b.frames[n-1]), nil
+}
+
+func (b *frameBody) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return nil
+}
+
+// frameUpstream answers every conversation with a new frameBody.
+type frameUpstream struct {
+	*FakeUpstream
+	frames []string
+	bodies []*frameBody
+}
+
+func (u *frameUpstream) Conversation(ctx context.Context, request ChatGPTRequest, cred Credential) (*fhttp.Response, error) {
+	response, err := u.FakeUpstream.Conversation(ctx, request, cred)
+	if err != nil {
+		return nil, err
+	}
+	body := &frameBody{frames: u.frames}
+	u.bodies = append(u.bodies, body)
+	response.Body = body
+	return response, nil
+}
+
+func TestChatCompletionStopsReadingAtTheCut(t *testing.T) {
+	frames := []string{SSEBody(snapshot("m1", "Hel", "")), SSEBody(snapshot("m1", "Hello wor", "")), SSEBody(snapshot("m1", "Hello world. STOP and more", ""))}
+	for i := 0; i < 50; i++ {
+		frames = append(frames, SSEBody(snapshot("m1", "Hello world. STOP and more"+strings.Repeat(" more", i), "")))
+	}
+	frames = append(frames, SSEBody(snapshot("m1", "Hello world. STOP and more", "stop"), "[DONE]"))
+
+	for limit, want := range map[string]string{`"stop":["STOP"]`: "Hello world. ", `"max_tokens":3`: "Hello world."} {
+		for _, stream := range []bool{false, true} {
+			upstream := &frameUpstream{FakeUpstream: NewFakeUpstream(FakeReply{}), frames: frames}
+			router, key := testGateway(t, upstream)
+			recorder := postChat(t, router, key, fmt.Sprintf(`{"model":"gpt-4","stream":%t,%s,"messages":[{"role":"user","content":"hi"}]}`, stream, limit))
+
+			var text string
+			if stream {
+				text, _ = streamedText(readChunks(t, recorder.Body.String()))
+			} else {
+				var completion ChatCompletion
+				if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil {
+					t.Fatal(err)
+				}
+				text = *completion.Choices[0].Message.Content
+			}
+			if text != want {
+				t.Errorf("%s, stream %t: got %q, want %q", limit, stream, text, want)
+			}
+			if len(upstream.bodies) != 1 {
+				t.Fatalf("%s, stream %t: %d upstream requests", limit, stream, len(upstream.bodies))
+			}
+			// The third frame reaches the limit, nothing after it is read
+			body := upstream.bodies[0]
+			if reads, closed := atomic.LoadInt32(&body.reads), atomic.LoadInt32(&body.closed); reads != 3 || closed == 0 {
+				t.Errorf("%s, stream %t: %d reads, closed %t", limit, stream, reads, closed != 0)
+			}
+		}
+	}
+}
+
+func TestChatCompletionHoldsSplitStopSequence(t *testing.T) {
+	frames := []string{
+		SSEBody(snapshot("m1", "Hello wor", "")),
+		SSEBody(snapshot("m1", "Hello world. S", "")),
+		SSEBody(snapshot("m1", "Hello world. STO", "")),
+		SSEBody(snapshot("m1", "Hello world. STOP and more", "")),
+		SSEBody(snapshot("m1", "Hello world. STOP and more", "stop"), "[DONE]"),
+	}
+	upstream := &frameUpstream{FakeUpstream: NewFakeUpstream(FakeReply{}), frames: frames}
+	router, key := testGateway(t, upstream)
+	recorder := postChat(t, router, key, `{"model":"gpt-4","stream":true,"stop":["STOP"],"messages":[{"role":"user","content":"hi"}]}`)
+
+	chunks := readChunks(t, recorder.Body.String())
+	for _, chunk := range chunks {
+		for _, choice := range chunk["choices"].([]interface{}) {
+			content, _ := choice.(map[string]interface{})["delta"].(map[string]interface{})["content"].(string)
+			if strings.Contains(content, "S") {
+				t.Errorf("chunk %q streams the start of the stop sequence", content)
+			}
+		}
+	}
+	if text, finish := streamedText(chunks); text != "Hello world. " || finish != "stop" {
+		t.Errorf("got %q, finish %v", text, finish)
+	}
+	if reads := atomic.LoadInt32(&upstream.bodies[0].reads); reads != 4 {
+		t.Errorf("%d reads, want the stream cut at the fourth frame", reads)
+	}
+}
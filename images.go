@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImageRequest is the OpenAI /v1/images/generations request.
+type ImageRequest struct {
+	Prompt         string `json:"prompt"`
+	Model          string `json:"model"`
+	N              int    `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+	Quality        string `json:"quality"`
+	Style          string `json:"style"`
+	User           string `json:"user"`
+}
+
+type ImageResponse struct {
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
+
+type ImageData struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+// imageAsset is a generated image found in a multimodal message part.
+type imageAsset struct {
+	FileID        string
+	RevisedPrompt string
+	// Cred is the credential of the conversation that generated the
+	// image, its file can only be downloaded as that account.
+	Cred Credential
+}
+
+const maxImagesPerRequest = 10
+
+// imageOrientations maps the DALL·E 3 sizes to how the prompt asks for them.
+var imageOrientations = map[string]string{
+	"1024x1024": "square",
+	"1792x1024": "wide",
+	"1024x1792": "tall",
+}
+
+func invalidImageRequest(c *gin.Context, message string, param interface{}) {
+	c.JSON(400, gin.H{"error": gin.H{
+		"message": message,
+		"type":    "invalid_request_error",
+		"param":   param,
+		"code":    nil,
+	}})
+}
+
+// dalle serves /v1/images/generations by asking the DALL·E gizmo for one
+// image per conversation until n images are collected.
+func (g *gateway) dalle(c *gin.Context) {
+	var request ImageRequest
+	if err := c.BindJSON(&request); err != nil {
+		invalidImageRequest(c, "Request must be proper JSON", nil)
+		return
+	}
+	if request.Model == "" {
+		request.Model = "dall-e-3"
+	}
+	if request.N == 0 {
+		request.N = 1
+	}
+	if request.Size == "" {
+		request.Size = "1024x1024"
+	}
+	if request.ResponseFormat == "" {
+		request.ResponseFormat = "url"
+	}
+	switch {
+	case strings.TrimSpace(request.Prompt) == "":
+		invalidImageRequest(c, "prompt is required", "prompt")
+		return
+	case request.N < 1 || request.N > maxImagesPerRequest:
+		invalidImageRequest(c, fmt.Sprintf("n must be between 1 and %d", maxImagesPerRequest), "n")
+		return
+	case imageOrientations[request.Size] == "":
+		invalidImageRequest(c, fmt.Sprintf("size must be one of 1024x1024, 1792x1024 or 1024x1792, got %q", request.Size), "size")
+		return
+	case request.ResponseFormat != "url" && request.ResponseFormat != "b64_json":
+		invalidImageRequest(c, "response_format must be url or b64_json", "response_format")
+		return
+	}
+	c.Set(usageModelKey, request.Model)
+
+	cred := requestCredential(c)
+	route, ok := g.resolveRoute(c, request.Model, cred)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	var assets []imageAsset
+	var reply string
+	for attempt := 0; attempt < request.N && len(assets) < request.N; attempt++ {
+		// Every conversation counts against the cap, the account pool may
+		// have moved the request to another account in between
+		if !g.reserveCapacity(c, route.Slug) {
+			return
+		}
+		generated, text, err := g.generateImages(c, request, route, requestCredential(c))
+		if err != nil {
+			return
+		}
+		assets = append(assets, generated...)
+		reply = text
+	}
+	if len(assets) == 0 {
+		if reply == "" {
+			reply = "no image was generated"
+		}
+		c.JSON(400, gin.H{"error": gin.H{
+			"message": reply,
+			"type":    "invalid_request_error",
+			"param":   "prompt",
+			"code":    "image_generation_failed",
+		}})
+		return
+	}
+	if len(assets) > request.N {
+		assets = assets[:request.N]
+	}
+
+	promptTokens := countTokens(request.Prompt)
+	c.Set(usedTokensKey, promptTokens)
+	addUsage(c, usageRecord{
+		Time:         start,
+		Kind:         usageImage,
+		PromptTokens: promptTokens,
+		Images:       len(assets),
+		LatencyMs:    time.Since(start).Milliseconds(),
+	})
+	result := ImageResponse{Created: time.Now().Unix()}
+	for _, asset := range assets {
+		url, err := g.upstream.FileDownloadURL(asset.FileID, asset.Cred)
+		if err != nil {
+			c.JSON(502, gin.H{"error": gin.H{
+				"message": err.Error(),
+				"type":    "upstream_error",
+				"param":   nil,
+				"code":    "file_download_failed",
+			}})
+			return
+		}
+		data := ImageData{RevisedPrompt: asset.RevisedPrompt}
+		if request.ResponseFormat == "url" {
+			data.URL = url
+		} else {
+			image, err := g.upstream.Download(url)
+			if err != nil {
+				c.JSON(502, gin.H{"error": gin.H{
+					"message": err.Error(),
+					"type":    "upstream_error",
+					"param":   nil,
+					"code":    "file_download_failed",
+				}})
+				return
+			}
+			data.B64JSON = base64.StdEncoding.EncodeToString(image)
+		}
+		result.Data = append(result.Data, data)
+	}
+	c.JSON(200, result)
+}
+
+// generateImages runs one DALL·E conversation. It returns the images it
+// produced and the assistant's reply, which explains a refusal. Errors are
+// already written to c.
+func (g *gateway) generateImages(c *gin.Context, request ImageRequest, route ResolvedRoute, cred Credential) ([]imageAsset, string, error) {
+	translatedRequest := NewChatGPTRequest()
+	token, err := g.upstream.ArkoseToken(cred)
+	if err != nil {
+		fmt.Println("Error getting Arkose token: ", err)
+	}
+	translatedRequest.ArkoseToken = token
+	translatedRequest.Model = route.Slug
+	translatedRequest.ConversationMode = route.ConversationMode
+	translatedRequest.AddMessage("user", fmt.Sprintf(
+		"Create exactly one %s (%s) image for the following prompt:\n%s",
+		imageOrientations[request.Size], request.Size, request.Prompt))
+
+	response, cred, ok := g.conversation(c, translatedRequest, cred)
+	if !ok {
+		return nil, "", errors.New("conversation failed")
+	}
+	defer response.Body.Close()
+
+	var assets []imageAsset
+	var reply string
+	seen := map[string]bool{}
+	responses := newResponseStream(response.Body)
+	for {
+		next, err := responses.Next()
+		if err == io.EOF {
+			return assets, reply, nil
+		}
+		if err != nil {
+			abortStream(c, err, false)
+			return nil, "", err
+		}
+		message := next.Message
+		if message.Author.Role == "assistant" && message.Content.ContentType == "text" {
+			reply = message.Content.Text()
+		}
+		for _, asset := range message.Content.ImageAssets() {
+			if !seen[asset.FileID] {
+				seen[asset.FileID] = true
+				asset.Cred = cred
+				assets = append(assets, asset)
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+)
+
+// imageReply is a DALL·E conversation producing file id, followed by a
+// moderation event and the assistant's reply.
+func imageReply(fileID string) string {
+	tool, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"id":     "tool-" + fileID,
+			"author": map[string]string{"role": "tool"},
+			"content": map[string]interface{}{
+				"content_type": "multimodal_text",
+				"parts": []interface{}{map[string]interface{}{
+					"content_type":  "image_asset_pointer",
+					"asset_pointer": "file-service://" + fileID,
+					"metadata":      map[string]interface{}{"dalle": map[string]string{"prompt": "revised " + fileID}},
+				}},
+			},
+			"metadata": map[string]interface{}{},
+		},
+		"conversation_id": "conv-1",
+	})
+	return SSEBody(string(tool), `{"type":"moderation","conversation_id":"conv-1"}`, snapshot("m1", "Here is your image.", "stop"), "[DONE]")
+}
+
+func postImages(t *testing.T, router *gin.Engine, key string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+key)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestImageGenerations(t *testing.T) {
+	for _, format := range []string{"url", "b64_json"} {
+		upstream := NewFakeUpstream(FakeReply{Body: imageReply("file-1")}, FakeReply{Body: imageReply("file-2")})
+		router, key := testGateway(t, upstream)
+		recorder := postImages(t, router, key, fmt.Sprintf(`{"prompt":"a cat","n":2,"size":"1792x1024","response_format":%q}`, format))
+		var response ImageResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != 200 {
+			t.Fatalf("%s: status %d, body %s", format, recorder.Code, recorder.Body)
+		}
+		if len(response.Data) != 2 || len(upstream.requests) != 2 {
+			t.Fatalf("%s: %d images from %d conversations", format, len(response.Data), len(upstream.requests))
+		}
+		for i, image := range response.Data {
+			url := fmt.Sprintf("https://files.fake.invalid/file-%d", i+1)
+			want := ImageData{URL: url, RevisedPrompt: fmt.Sprintf("revised file-%d", i+1)}
+			if format == "b64_json" {
+				want = ImageData{B64JSON: base64.StdEncoding.EncodeToString([]byte("fake file " + url)), RevisedPrompt: want.RevisedPrompt}
+			}
+			if image != want {
+				t.Errorf("%s: image %d is %+v, want %+v", format, i, image, want)
+			}
+		}
+		if prompt := upstream.requests[0].Messages[0].Content.Parts[0]; !strings.Contains(fmt.Sprint(prompt), "wide (1792x1024)") {
+			t.Errorf("%s: prompt %q does not ask for the size", format, prompt)
+		}
+	}
+}
+
+func TestImageGenerationsValidation(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: imageReply("file-1")})
+	router, key := testGateway(t, upstream)
+	for body, param := range map[string]string{
+		`{"prompt":""}`:                               "prompt",
+		`{"prompt":"a cat","n":0}`:                    "",
+		`{"prompt":"a cat","n":11}`:                   "n",
+		`{"prompt":"a cat","size":"512x512"}`:         "size",
+		`{"prompt":"a cat","response_format":"webp"}`: "response_format",
+	} {
+		recorder := postImages(t, router, key, body)
+		if param == "" {
+			// n defaults to 1
+			if recorder.Code != 200 {
+				t.Errorf("%s: status %d, body %s", body, recorder.Code, recorder.Body)
+			}
+			continue
+		}
+		var response struct {
+			Error struct {
+				Param string `json:"param"`
+			} `json:"error"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != 400 || response.Error.Param != param {
+			t.Errorf("%s: status %d, body %s", body, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+// ownerUpstream records the account of every conversation and file lookup.
+type ownerUpstream struct {
+	*FakeUpstream
+	mu            sync.Mutex
+	conversations []string
+	downloads     map[string]string
+}
+
+func (u *ownerUpstream) Conversation(ctx context.Context, request ChatGPTRequest, cred Credential) (*fhttp.Response, error) {
+	u.mu.Lock()
+	u.conversations = append(u.conversations, cred.PUID)
+	u.mu.Unlock()
+	return u.FakeUpstream.Conversation(ctx, request, cred)
+}
+
+func (u *ownerUpstream) FileDownloadURL(fileID string, cred Credential) (string, error) {
+	u.mu.Lock()
+	u.downloads[fileID] = cred.PUID
+	u.mu.Unlock()
+	return u.FakeUpstream.FileDownloadURL(fileID, cred)
+}
+
+func TestImageGenerationsFailover(t *testing.T) {
+	testConfig()
+	config.Accounts.List = []AccountConfig{
+		{Name: "a", AccessToken: testAccessToken(), PUID: "user-a"},
+		{Name: "b", AccessToken: testAccessToken(), PUID: "user-b"},
+	}
+	// The second conversation fails on account a and moves to b
+	upstream := &ownerUpstream{FakeUpstream: NewFakeUpstream(
+		FakeReply{Body: imageReply("file-1")},
+		FakeReply{StatusCode: 500, Body: `{"detail":"error"}`},
+		FakeReply{Body: imageReply("file-2")},
+	), downloads: map[string]string{}}
+	router, key := testRouter(t, upstream, true)
+
+	recorder := postImages(t, router, key, `{"prompt":"a cat","n":2}`)
+	if recorder.Code != 200 {
+		t.Fatalf("status %d, body %s", recorder.Code, recorder.Body)
+	}
+	if want := []string{"user-a", "user-a", "user-b"}; !reflect.DeepEqual(upstream.conversations, want) {
+		t.Fatalf("conversations as %v, want %v", upstream.conversations, want)
+	}
+	if want := map[string]string{"file-1": "user-a", "file-2": "user-b"}; !reflect.DeepEqual(upstream.downloads, want) {
+		t.Errorf("files looked up as %v, want %v", upstream.downloads, want)
+	}
+}
+
+func TestImageGenerationsCap(t *testing.T) {
+	testConfig()
+	config.Caps.Rules = []CapRule{{Model: "gpt-4-gizmo", Requests: 3, Window: Duration(time.Hour)}}
+	upstream := NewFakeUpstream(FakeReply{Body: imageReply("file-1")}, FakeReply{Body: imageReply("file-2")}, FakeReply{Body: imageReply("file-3")})
+	router, key := testRouter(t, upstream, false)
+
+	// One slot is taken per conversation
+	recorder := postImages(t, router, key, `{"prompt":"a cat","n":2}`)
+	if remaining := recorder.Header().Get("x-ratelimit-remaining-requests"); recorder.Code != 200 || remaining != "1" {
+		t.Fatalf("status %d, %q requests remaining", recorder.Code, remaining)
+	}
+	if recorder = postImages(t, router, key, `{"prompt":"a cat","n":2}`); recorder.Code != 429 {
+		t.Errorf("over the cap: status %d, body %s", recorder.Code, recorder.Body)
+	}
+	if requests := upstream.Requests(); len(requests) != 3 {
+		t.Errorf("upstream got %d conversations, want 3", len(requests))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// maxImageRedirects bounds the redirects followed for an image url.
+const maxImageRedirects = 5
+
+var errPrivateImageURL = errors.New("image urls must not point to local or private addresses")
+
+// publicAddress reports whether an image url may be fetched from ip.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
+
+// imageFetcher downloads image_url inputs through the proxies. Addresses are
+// checked once resolved, on every hop of a redirect: a direct connection is
+// checked as it is dialed, a proxied one by resolving its host before the
+// request is handed to the proxy.
+type imageFetcher struct {
+	proxies *proxyPool
+	// allow reports whether an address may be connected to.
+	allow func(net.IP) bool
+}
+
+func newImageFetcher(proxies *proxyPool) *imageFetcher {
+	return &imageFetcher{proxies: proxies, allow: publicAddress}
+}
+
+// checkHost resolves host and fails if any of its addresses is not allowed.
+func (f *imageFetcher) checkHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !f.allow(addr.IP) {
+			return errPrivateImageURL
+		}
+	}
+	return nil
+}
+
+func (f *imageFetcher) client(proxy string) (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	transport := &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+	if proxy == directProxy {
+		// The dialer sees the resolved address of every connection
+		dialer.Control = func(_ string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !f.allow(ip) {
+				return errPrivateImageURL
+			}
+			return nil
+		}
+	} else {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		// The proxy resolves the host itself, check it before it does
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			if err := f.checkHost(request.Context(), request.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+	}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.Client.Timeout),
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) > maxImageRedirects {
+				return fmt.Errorf("image url redirected more than %d times", maxImageRedirects)
+			}
+			return checkImageURL(request.URL.String())
+		},
+	}, nil
+}
+
+// Fetch downloads an image url checked by checkImageURL.
+func (f *imageFetcher) Fetch(raw string) ([]byte, error) {
+	proxy := f.proxies.Pick(Credential{}.sessionKey(), nil)
+	client, err := f.client(proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer client.CloseIdleConnections()
+	response, err := client.Get(raw)
+	if err != nil {
+		// The url error repeats the url, which the client already knows
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image url returned %s", response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	for address, public := range map[string]bool{
+		"8.8.8.8":          true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"127.1.2.3":        false,
+		"10.0.0.1":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::":               false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+		"::ffff:10.0.0.1":  false,
+	} {
+		if got := publicAddress(net.ParseIP(address)); got != public {
+			t.Errorf("publicAddress(%s) = %t", address, got)
+		}
+	}
+}
+
+// listen serves handler on a loopback address of its own, the tests tell
+// apart a "public" and a "private" server by address.
+func listen(t *testing.T, address string, handler http.Handler) *httptest.Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", address+":0")
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", address, err)
+	}
+	server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: handler}}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestImageFetcherChecksResolvedAddresses(t *testing.T) {
+	var privateHits int32
+	private := listen(t, "127.0.0.1", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&privateHits, 1)
+		w.Write([]byte("secret"))
+	}))
+	public := listen(t, "127.0.0.2", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, private.URL+"/metadata", http.StatusFound)
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	privatePort := private.URL[strings.LastIndex(private.URL, ":"):]
+
+	config = defaultConfig()
+	config.Proxy = directProxy
+	fetcher := newImageFetcher(newProxyPool(config))
+	// 127.0.0.2 stands in for the internet
+	fetcher.allow = func(ip net.IP) bool { return ip.Equal(net.ParseIP("127.0.0.2")) }
+
+	if data, err := fetcher.Fetch(public.URL + "/image.png"); err != nil || string(data) != "image" {
+		t.Fatalf("public url: %q, %v", data, err)
+	}
+	for _, raw := range []string{
+		public.URL + "/redirect",
+		"http://localhost" + privatePort + "/",
+		"http://127.1" + privatePort + "/",
+		private.URL + "/",
+	} {
+		if data, err := fetcher.Fetch(raw); err == nil {
+			t.Errorf("%s: fetched %q", raw, data)
+		}
+	}
+	if n := atomic.LoadInt32(&privateHits); n != 0 {
+		t.Errorf("private server got %d requests", n)
+	}
+}
+
+func TestImageFetcherChecksHostsBeforeTheProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		w.Write([]byte("image"))
+	}))
+	defer proxy.Close()
+
+	config = defaultConfig()
+	config.Proxies.List = []string{proxy.URL}
+	fetcher := newImageFetcher(newProxyPool(config))
+
+	if data, err := fetcher.Fetch("http://localhost/latest/meta-data"); err == nil {
+		t.Errorf("fetched %q through the proxy", data)
+	}
+	if n := atomic.LoadInt32(&proxied); n != 0 {
+		t.Errorf("proxy got %d requests", n)
+	}
+	// A public address is handed to the proxy, which answers for it here
+	if data, err := fetcher.Fetch("http://8.8.8.8/image.png"); err != nil || string(data) != "image" {
+		t.Errorf("public url through the proxy: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyRequestsStatusKey holds the capStatus of the requests per minute of
+// the key a request was made with.
+const keyRequestsStatusKey = "key_requests_status"
+
+// usedTokensKey holds the tokens a request consumed, set by the handler
+// for the key limiter to charge once the request is done.
+const usedTokensKey = "used_tokens"
+
+// KeyLimits are the rate limits and quotas of one gateway key. Zero means
+// unlimited.
+type KeyLimits struct {
+	RequestsPerMinute int   `json:"requests_per_minute,omitempty" yaml:"requests_per_minute" toml:"requests_per_minute"`
+	TokensPerMinute   int   `json:"tokens_per_minute,omitempty" yaml:"tokens_per_minute" toml:"tokens_per_minute"`
+	DailyRequests     int64 `json:"daily_requests,omitempty" yaml:"daily_requests" toml:"daily_requests"`
+	DailyTokens       int64 `json:"daily_tokens,omitempty" yaml:"daily_tokens" toml:"daily_tokens"`
+	MonthlyRequests   int64 `json:"monthly_requests,omitempty" yaml:"monthly_requests" toml:"monthly_requests"`
+	MonthlyTokens     int64 `json:"monthly_tokens,omitempty" yaml:"monthly_tokens" toml:"monthly_tokens"`
+}
+
+func (l KeyLimits) validate() error {
+	if l.RequestsPerMinute < 0 || l.TokensPerMinute < 0 || l.DailyRequests < 0 || l.DailyTokens < 0 || l.MonthlyRequests < 0 || l.MonthlyTokens < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// keyUsage counts what a key used in the current UTC day and month.
+type keyUsage struct {
+	Day           string `json:"day"`
+	DayRequests   int64  `json:"day_requests"`
+	DayTokens     int64  `json:"day_tokens"`
+	Month         string `json:"month"`
+	MonthRequests int64  `json:"month_requests"`
+	MonthTokens   int64  `json:"month_tokens"`
+}
+
+// roll starts new periods when the day or month changed.
+func (u *keyUsage) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayRequests, u.DayTokens = day, 0, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthRequests, u.MonthTokens = month, 0, 0
+	}
+}
+
+// tokenBucket refills rate units per minute up to rate.
+type tokenBucket struct {
+	level float64
+	last  time.Time
+}
+
+func (b *tokenBucket) refill(rate int, now time.Time) {
+	if b.last.IsZero() {
+		b.level = float64(rate)
+	} else {
+		b.level = math.Min(float64(rate), b.level+now.Sub(b.last).Minutes()*float64(rate))
+	}
+	b.last = now
+}
+
+// wait is how long until the bucket holds need units.
+func (b *tokenBucket) wait(rate int, need float64) time.Duration {
+	if b.level >= need {
+		return 0
+	}
+	return time.Duration((need - b.level) / float64(rate) * float64(time.Minute))
+}
+
+// limitError is a rejected request, rendered as an OpenAI error.
+type limitError struct {
+	Code       string
+	Type       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+// status reports the bucket of a per minute limit.
+func (b *tokenBucket) status(rate int) capStatus {
+	return capStatus{
+		Limit:     rate,
+		Remaining: int(math.Floor(b.level)),
+		Reset:     b.wait(rate, float64(rate)),
+		Window:    time.Minute,
+	}
+}
+
+// keyLimiter enforces KeyLimits. Token buckets live in memory; the quota
+// counters are saved to keys.usage_file so they survive restarts.
+type keyLimiter struct {
+	path     string
+	mu       sync.Mutex
+	usage    map[string]*keyUsage
+	requests map[string]*tokenBucket
+	tokens   map[string]*tokenBucket
+	dirty    bool
+	// now is the clock of the limiter.
+	now func() time.Time
+}
+
+// loadKeyLimiter reads the quota counters from path, a missing file
+// starts from zero. An empty path keeps them in memory only.
+func loadKeyLimiter(path string) (*keyLimiter, error) {
+	l := &keyLimiter{
+		path:     path,
+		usage:    map[string]*keyUsage{},
+		requests: map[string]*tokenBucket{},
+		tokens:   map[string]*tokenBucket{},
+		now:      time.Now,
+	}
+	if path == "" {
+		return l, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &l.usage); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *keyLimiter) usageLocked(id string, now time.Time) *keyUsage {
+	u, ok := l.usage[id]
+	if !ok {
+		u = &keyUsage{}
+		l.usage[id] = u
+	}
+	u.roll(now)
+	return u
+}
+
+func (l *keyLimiter) bucket(buckets map[string]*tokenBucket, id string, rate int, now time.Time) *tokenBucket {
+	b, ok := buckets[id]
+	if !ok {
+		b = &tokenBucket{}
+		buckets[id] = b
+	}
+	b.refill(rate, now)
+	return b
+}
+
+// Allow checks the quotas and rate limits of key and takes one request
+// from its request bucket. The quotas and the token bucket are charged by
+// Record afterwards, a request is let through as long as the token bucket
+// is not empty.
+func (l *keyLimiter) Allow(id string, limits KeyLimits) *limitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	u := l.usageLocked(id, now)
+	switch {
+	case limits.DailyRequests > 0 && u.DayRequests >= limits.DailyRequests,
+		limits.DailyTokens > 0 && u.DayTokens >= limits.DailyTokens:
+		return quotaExceeded("daily", now, nextDay(now))
+	case limits.MonthlyRequests > 0 && u.MonthRequests >= limits.MonthlyRequests,
+		limits.MonthlyTokens > 0 && u.MonthTokens >= limits.MonthlyTokens:
+		return quotaExceeded("monthly", now, nextMonth(now))
+	}
+	var requests, tokens *tokenBucket
+	if limits.RequestsPerMinute > 0 {
+		requests = l.bucket(l.requests, id, limits.RequestsPerMinute, now)
+		if wait := requests.wait(limits.RequestsPerMinute, 1); wait > 0 {
+			return rateLimited("requests", limits.RequestsPerMinute, wait)
+		}
+	}
+	if limits.TokensPerMinute > 0 {
+		tokens = l.bucket(l.tokens, id, limits.TokensPerMinute, now)
+		if tokens.level <= 0 {
+			return rateLimited("tokens", limits.TokensPerMinute, tokens.wait(limits.TokensPerMinute, 1))
+		}
+	}
+	if requests != nil {
+		requests.level--
+	}
+	return nil
+}
+
+// Status reports the per minute limits of key id, ok is false for the
+// limits it does not have.
+func (l *keyLimiter) Status(id string, limits KeyLimits) (requests capStatus, requestsOK bool, tokens capStatus, tokensOK bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if limits.RequestsPerMinute > 0 {
+		requests, requestsOK = l.bucket(l.requests, id, limits.RequestsPerMinute, now).status(limits.RequestsPerMinute), true
+	}
+	if limits.TokensPerMinute > 0 {
+		tokens, tokensOK = l.bucket(l.tokens, id, limits.TokensPerMinute, now).status(limits.TokensPerMinute), true
+	}
+	return
+}
+
+// Record charges the tokens a request of key consumed and, if it was
+// served, the request itself to the quotas. Requests that failed or were
+// turned away only use their tokens.
+func (l *keyLimiter) Record(id string, limits KeyLimits, tokens int, served bool) {
+	if tokens <= 0 && !served {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	u := l.usageLocked(id, now)
+	if served {
+		u.DayRequests++
+		u.MonthRequests++
+	}
+	u.DayTokens += int64(tokens)
+	u.MonthTokens += int64(tokens)
+	if limits.TokensPerMinute > 0 && tokens > 0 {
+		// The bucket may go negative, later requests wait until it refills
+		l.bucket(l.tokens, id, limits.TokensPerMinute, now).level -= float64(tokens)
+	}
+	l.dirty = true
+}
+
+// Usage returns the current counters of key id.
+func (l *keyLimiter) Usage(id string) keyUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return *l.usageLocked(id, l.now())
+}
+
+// Flush saves the counters if they changed since the last save.
+func (l *keyLimiter) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" || !l.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(l.path); dir != "." {
+		if err = os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp := l.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// run saves the counters every few seconds until the process exits.
+func (l *keyLimiter) run() {
+	for {
+		time.Sleep(5 * time.Second)
+		if err := l.Flush(); err != nil {
+			fmt.Println("Error saving key usage: ", err)
+		}
+	}
+}
+
+// Forget drops the counters of a deleted key.
+func (l *keyLimiter) Forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.usage, id)
+	delete(l.requests, id)
+	delete(l.tokens, id)
+	l.dirty = true
+}
+
+func nextDay(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextMonth(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func quotaExceeded(period string, now time.Time, reset time.Time) *limitError {
+	return &limitError{
+		Code:       "insufficient_quota",
+		Type:       "insufficient_quota",
+		Message:    fmt.Sprintf("You exceeded your current %s quota, it resets at %s.", period, reset.Format(time.RFC3339)),
+		RetryAfter: reset.Sub(now),
+	}
+}
+
+func rateLimited(unit string, limit int, wait time.Duration) *limitError {
+	return &limitError{
+		Code:       "rate_limit_exceeded",
+		Type:       unit,
+		Message:    fmt.Sprintf("Rate limit reached for %s per min. Limit: %d / min. Please try again in %s.", unit, limit, wait.Round(time.Millisecond)),
+		RetryAfter: wait,
+	}
+}
+
+// limitKey applies the limits of the gateway key a request was made with.
+// Requests with a raw upstream token are not limited.
+func (g *gateway) limitKey(c *gin.Context) {
+	value, ok := c.Get(apiKeyKey)
+	if !ok {
+		c.Next()
+		return
+	}
+	key := value.(*APIKey)
+	limits := key.EffectiveLimits()
+	err := g.keyLimiter.Allow(key.ID, limits)
+	requests, requestsOK, tokens, tokensOK := g.keyLimiter.Status(key.ID, limits)
+	if requestsOK {
+		c.Set(keyRequestsStatusKey, requests)
+		setRateLimitHeaders(c, "requests", requests)
+	}
+	if tokensOK {
+		setRateLimitHeaders(c, "tokens", tokens)
+	}
+	if err != nil {
+		seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.AbortWithStatusJSON(429, gin.H{"error": gin.H{
+			"message": err.Message,
+			"type":    err.Type,
+			"param":   nil,
+			"code":    err.Code,
+		}})
+		return
+	}
+	c.Next()
+	g.keyLimiter.Record(key.ID, limits, c.GetInt(usedTokensKey), responseStatus(c) < 400)
+}
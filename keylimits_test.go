@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLimiter is an in-memory limiter on a clock the test moves.
+func testLimiter(t *testing.T, path string, start time.Time) (*keyLimiter, *time.Time) {
+	t.Helper()
+	l, err := loadKeyLimiter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := start
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	l, now := testLimiter(t, "", time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC))
+	limits := KeyLimits{RequestsPerMinute: 2}
+
+	for i := 0; i < 2; i++ {
+		if err := l.Allow("key", limits); err != nil {
+			t.Fatalf("request %d: %v", i, err.Message)
+		}
+	}
+	err := l.Allow("key", limits)
+	if err == nil || err.Code != "rate_limit_exceeded" || err.Type != "requests" || err.RetryAfter != 30*time.Second {
+		t.Fatalf("third request: %+v", err)
+	}
+	*now = now.Add(30 * time.Second)
+	if err := l.Allow("key", limits); err != nil {
+		t.Fatalf("after refill: %v", err.Message)
+	}
+
+	// Tokens are charged afterwards and may overdraw the bucket
+	limits = KeyLimits{TokensPerMinute: 100}
+	if err := l.Allow("tokens", limits); err != nil {
+		t.Fatal(err.Message)
+	}
+	l.Record("tokens", limits, 150, true)
+	err = l.Allow("tokens", limits)
+	if err == nil || err.Code != "rate_limit_exceeded" || err.Type != "tokens" {
+		t.Fatalf("overdrawn token bucket: %+v", err)
+	}
+	*now = now.Add(31 * time.Second)
+	if err := l.Allow("tokens", limits); err != nil {
+		t.Fatalf("after token refill: %v", err.Message)
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	l, now := testLimiter(t, "", time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC))
+
+	daily := KeyLimits{DailyRequests: 1}
+	if err := l.Allow("daily", daily); err != nil {
+		t.Fatal(err.Message)
+	}
+	l.Record("daily", daily, 0, true)
+	err := l.Allow("daily", daily)
+	if err == nil || err.Code != "insufficient_quota" || err.RetryAfter != time.Hour {
+		t.Fatalf("second request of the day: %+v", err)
+	}
+
+	monthly := KeyLimits{MonthlyTokens: 100}
+	if err := l.Allow("monthly", monthly); err != nil {
+		t.Fatal(err.Message)
+	}
+	l.Record("monthly", monthly, 100, true)
+	if err := l.Allow("monthly", monthly); err == nil || err.Code != "insufficient_quota" {
+		t.Fatalf("request over the monthly tokens: %+v", err)
+	}
+
+	*now = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	if err := l.Allow("daily", daily); err != nil {
+		t.Errorf("daily quota kept after midnight: %v", err.Message)
+	}
+	if err := l.Allow("monthly", monthly); err != nil {
+		t.Errorf("monthly quota kept into February: %v", err.Message)
+	}
+	l.Record("monthly", monthly, 0, true)
+	if usage := l.Usage("monthly"); usage.Month != "2024-02" || usage.MonthRequests != 1 || usage.MonthTokens != 0 {
+		t.Errorf("usage after rollover: %+v", usage)
+	}
+}
+
+func TestKeyLimitErrors(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")})
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+	for _, test := range []struct {
+		limits KeyLimits
+		code   string
+	}{
+		{KeyLimits{RequestsPerMinute: 1}, "rate_limit_exceeded"},
+		{KeyLimits{DailyRequests: 1}, "insufficient_quota"},
+	} {
+		testConfig()
+		config.Keys.DefaultLimits = test.limits
+		router, key := testRouter(t, upstream, false)
+		if recorder := postChat(t, router, key, body); recorder.Code != 200 {
+			t.Fatalf("%s: first request: %d %s", test.code, recorder.Code, recorder.Body)
+		}
+		recorder := postChat(t, router, key, body)
+		var response struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != 429 || response.Error.Code != test.code || recorder.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: got %d %s, Retry-After %q", test.code, recorder.Code, recorder.Body, recorder.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestKeyUsageSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key_usage.json")
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	l, _ := testLimiter(t, path, start)
+	limits := KeyLimits{DailyRequests: 2}
+	l.Allow("key", limits)
+	l.Record("key", limits, 42, true)
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, _ := testLimiter(t, path, start.Add(time.Hour))
+	if usage := restarted.Usage("key"); usage.DayRequests != 1 || usage.DayTokens != 42 || usage.MonthRequests != 1 || usage.MonthTokens != 42 {
+		t.Fatalf("usage after restart: %+v", usage)
+	}
+	restarted.Allow("key", limits)
+	restarted.Record("key", limits, 0, true)
+	if err := restarted.Allow("key", limits); err == nil || err.Code != "insufficient_quota" {
+		t.Errorf("daily quota not carried over a restart: %+v", err)
+	}
+}
+
+func TestSetLimitsWhileLimiting(t *testing.T) {
+	testConfig()
+	keys, _ := loadKeyStore("")
+	plain, key, err := keys.Create("limited", Credential{AccessToken: testAccessToken()}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			keys.SetLimits(key.ID, &KeyLimits{RequestsPerMinute: i})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if k, ok := keys.Lookup(plain); ok {
+				k.EffectiveLimits()
+				k.view()
+			}
+		}
+	}()
+	wg.Wait()
+	if k, _ := keys.Lookup(plain); k.EffectiveLimits().RequestsPerMinute != 100 {
+		t.Errorf("limits %+v, want 100 requests per minute", k.EffectiveLimits())
+	}
+}
+
+func TestKeyQuotaChargedAfterResponse(t *testing.T) {
+	testConfig()
+	upstream := NewFakeUpstream(
+		FakeReply{StatusCode: 500, Body: `{"detail":"error"}`},
+		// The stream breaks off after some text
+		FakeReply{Body: SSEBody(snapshot("m1", "Hello there", ""))},
+		FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")},
+	)
+	keys, _ := loadKeyStore("")
+	keyLimiter, _ := loadKeyLimiter("")
+	ledger, _ := openLedger("")
+	g := newGateway(upstream, keys, keyLimiter, ledger, newProxyPool(config), newAccountPool(config.Accounts))
+	plain, key, err := keys.Create("quota", Credential{AccessToken: testAccessToken(), PUID: "user-test"}, false, &KeyLimits{DailyRequests: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter(g)
+	body := `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+
+	if recorder := postChat(t, router, plain, body); recorder.Code != 500 {
+		t.Fatalf("upstream failure: status %d", recorder.Code)
+	}
+	if usage := keyLimiter.Usage(key.ID); usage.DayRequests != 0 || usage.DayTokens != 0 {
+		t.Errorf("usage after an upstream failure %+v", usage)
+	}
+	postChat(t, router, plain, body)
+	usage := keyLimiter.Usage(key.ID)
+	if want := int64(countPromptTokens([]apiMessage{{Role: "user", Content: messageContent{{Type: "text", Text: "hi"}}}}) + countTokens("Hello there")); usage.DayRequests != 0 || usage.DayTokens != want {
+		t.Errorf("usage after an aborted stream %+v, want %d tokens", usage, want)
+	}
+	if recorder := postChat(t, router, plain, body); recorder.Code != 200 {
+		t.Fatalf("served request: status %d, %s", recorder.Code, recorder.Body)
+	}
+	if usage := keyLimiter.Usage(key.ID); usage.DayRequests != 1 {
+		t.Errorf("usage after a served request %+v", usage)
+	}
+	if recorder := postChat(t, router, plain, body); recorder.Code != 429 {
+		t.Errorf("over the daily quota: status %d", recorder.Code)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyPrefix marks keys issued by the gateway, as opposed to raw upstream
+// access tokens.
+const apiKeyPrefix = "sk-"
+
+const (
+	// credentialKey holds the resolved upstream Credential in the gin context.
+	credentialKey = "credential"
+	// apiKeyKey holds the *APIKey the request authenticated with, if any.
+	apiKeyKey = "api_key"
+)
+
+// APIKey is a gateway-issued key and the upstream credential it stands for.
+// Only a hash of the key itself is stored.
+type APIKey struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Hash        string    `json:"hash"`
+	Prefix      string    `json:"prefix"`
+	CreatedAt   time.Time `json:"created_at"`
+	AccessToken string    `json:"access_token"`
+	PUID        string    `json:"puid"`
+	BaseURL     string    `json:"base_url,omitempty"`
+	// Pool keys have no credential of their own, their requests are served
+	// by the account pool.
+	Pool bool `json:"pool,omitempty"`
+	// Limits overrides keys.default_limits for this key.
+	Limits *KeyLimits `json:"limits,omitempty"`
+}
+
+// EffectiveLimits returns the limits of the key, keys.default_limits
+// unless it has its own.
+func (k *APIKey) EffectiveLimits() KeyLimits {
+	if k.Limits != nil {
+		return *k.Limits
+	}
+	return config.Keys.DefaultLimits
+}
+
+func (k *APIKey) Credential() Credential {
+	baseURL := k.BaseURL
+	if baseURL == "" {
+		baseURL = config.Upstream.BaseURLFor(k.PUID)
+	}
+	return Credential{AccessToken: k.AccessToken, PUID: k.PUID, BaseURL: baseURL}
+}
+
+// apiKeyView is what the admin api shows, without any secret.
+type apiKeyView struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	CreatedAt time.Time `json:"created_at"`
+	PUID      string    `json:"puid"`
+	BaseURL   string    `json:"base_url,omitempty"`
+	Pool      bool      `json:"pool,omitempty"`
+	Limits    KeyLimits `json:"limits"`
+	Usage     keyUsage  `json:"usage"`
+}
+
+func (k *APIKey) view() apiKeyView {
+	return apiKeyView{ID: k.ID, Name: k.Name, Prefix: k.Prefix, CreatedAt: k.CreatedAt, PUID: k.PUID, BaseURL: k.BaseURL, Pool: k.Pool, Limits: k.EffectiveLimits()}
+}
+
+// keyStore keeps API keys in memory and persists them to keys.file.
+type keyStore struct {
+	mu     sync.RWMutex
+	path   string
+	byHash map[string]*APIKey
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// loadKeyStore reads path, a missing file is an empty store. An empty path
+// keeps keys in memory only.
+func loadKeyStore(path string) (*keyStore, error) {
+	store := &keyStore{path: path, byHash: map[string]*APIKey{}}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []*APIKey
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		store.byHash[key.Hash] = key
+	}
+	return store, nil
+}
+
+func (s *keyStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	keys := make([]*APIKey, 0, len(s.byHash))
+	for _, key := range s.byHash {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err = os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	// The file holds upstream access tokens, keep it private
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Create issues a new key for the credential, or for the account pool if
+// pool is set, and returns it in plain text. The plain key is not kept and
+// cannot be shown again.
+func (s *keyStore) Create(name string, cred Credential, pool bool, limits *KeyLimits) (string, *APIKey, error) {
+	plain := apiKeyPrefix + randomHex(24)
+	key := &APIKey{
+		ID:          "key-" + randomHex(6),
+		Name:        name,
+		Hash:        hashAPIKey(plain),
+		Prefix:      plain[:len(apiKeyPrefix)+6],
+		CreatedAt:   time.Now(),
+		AccessToken: cred.AccessToken,
+		PUID:        cred.PUID,
+		BaseURL:     cred.BaseURL,
+		Pool:        pool,
+		Limits:      limits,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[key.Hash] = key
+	if err := s.saveLocked(); err != nil {
+		delete(s.byHash, key.Hash)
+		return "", nil, err
+	}
+	return plain, key, nil
+}
+
+func (s *keyStore) Lookup(plain string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.byHash[hashAPIKey(plain)]
+	return key, ok
+}
+
+// SetLimits replaces the limits of key id, nil restores the defaults. The
+// key is replaced by an updated copy rather than changed in place, requests
+// in flight keep reading the key they authenticated with.
+func (s *keyStore) SetLimits(id string, limits *KeyLimits) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, key := range s.byHash {
+		if key.ID == id {
+			updated := *key
+			updated.Limits = limits
+			s.byHash[hash] = &updated
+			if err := s.saveLocked(); err != nil {
+				s.byHash[hash] = key
+				return nil, err
+			}
+			return &updated, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *keyStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, key := range s.byHash {
+		if key.ID == id {
+			delete(s.byHash, hash)
+			if err := s.saveLocked(); err != nil {
+				s.byHash[hash] = key
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *keyStore) List() []*APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]*APIKey, 0, len(s.byHash))
+	for _, key := range s.byHash {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+func invalidAPIKey(c *gin.Context, message string) {
+	c.AbortWithStatusJSON(401, gin.H{"error": gin.H{
+		"message": message,
+		"type":    "invalid_request_error",
+		"param":   nil,
+		"code":    "invalid_api_key",
+	}})
+}
+
+// authenticate resolves the caller's upstream credential before the
+// handler runs. Gateway keys are looked up in the key store; raw upstream
+// access tokens with a PUid header are accepted while
+// keys.allow_upstream_tokens is set. Unless required, requests without
+// Authorization pass through with no credential.
+func (g *gateway) authenticate(required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			if required {
+				invalidAPIKey(c, "missing header parameter Authorization")
+				return
+			}
+			c.Next()
+			return
+		}
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			key, ok := g.keys.Lookup(token)
+			if !ok {
+				invalidAPIKey(c, "Incorrect API key provided")
+				return
+			}
+			c.Set(apiKeyKey, key)
+			if key.Pool {
+				// Only requests sent upstream take an account, see
+				// acquireAccount; others read as the next one
+				if acc, ok := g.accounts.Peek(); ok {
+					c.Set(credentialKey, acc.Credential())
+				}
+				c.Next()
+				return
+			}
+			if !checkAccessToken(c, key.AccessToken) {
+				return
+			}
+			c.Set(credentialKey, key.Credential())
+			c.Next()
+			return
+		}
+		if !config.Keys.AllowUpstreamTokens {
+			invalidAPIKey(c, "Incorrect API key provided, use a key issued by this gateway")
+			return
+		}
+		// Upstream access tokens are RS256 JWTs
+		if !strings.HasPrefix(token, "eyJhbGciOiJSUzI1NiI") {
+			invalidAPIKey(c, "wrong header parameter Authorization")
+			return
+		}
+		puid := c.GetHeader("PUid")
+		if puid == "" {
+			invalidAPIKey(c, "missing header parameter PUid")
+			return
+		}
+		if !checkAccessToken(c, token) {
+			return
+		}
+		c.Set(credentialKey, Credential{
+			AccessToken: token,
+			PUID:        puid,
+			BaseURL:     config.Upstream.BaseURLFor(puid),
+		})
+		c.Next()
+	}
+}
+
+// requestCredential returns the credential resolved by authenticate, the
+// zero Credential if the request carried none.
+func requestCredential(c *gin.Context) Credential {
+	cred, _ := c.Get(credentialKey)
+	credential, _ := cred.(Credential)
+	return credential
+}
+
+type createKeyRequest struct {
+	Name        string     `json:"name"`
+	AccessToken string     `json:"access_token"`
+	PUID        string     `json:"puid"`
+	BaseURL     string     `json:"base_url"`
+	Pool        bool       `json:"pool"`
+	Limits      *KeyLimits `json:"limits"`
+}
+
+func (g *gateway) createKey(c *gin.Context) {
+	var request createKeyRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	if request.Pool {
+		if request.AccessToken != "" || request.PUID != "" || request.BaseURL != "" {
+			c.JSON(400, gin.H{"error": gin.H{
+				"message": "pool keys are served by the account pool and take no credential",
+				"type":    "invalid_request_error",
+				"param":   "pool",
+				"code":    nil,
+			}})
+			return
+		}
+	} else if request.AccessToken == "" {
+		c.JSON(400, gin.H{"error": gin.H{
+			"message": "access_token is required",
+			"type":    "invalid_request_error",
+			"param":   "access_token",
+			"code":    nil,
+		}})
+		return
+	} else if _, err := parseAccessToken(request.AccessToken); err != nil {
+		c.JSON(400, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "invalid_request_error",
+			"param":   "access_token",
+			"code":    nil,
+		}})
+		return
+	}
+	if request.BaseURL != "" {
+		if err := validateBaseURL(request.BaseURL); err != nil {
+			c.JSON(400, gin.H{"error": gin.H{
+				"message": err.Error(),
+				"type":    "invalid_request_error",
+				"param":   "base_url",
+				"code":    nil,
+			}})
+			return
+		}
+	}
+	if request.Limits != nil {
+		if err := request.Limits.validate(); err != nil {
+			c.JSON(400, gin.H{"error": gin.H{
+				"message": err.Error(),
+				"type":    "invalid_request_error",
+				"param":   "limits",
+				"code":    nil,
+			}})
+			return
+		}
+	}
+	plain, key, err := g.keys.Create(request.Name, Credential{
+		AccessToken: request.AccessToken,
+		PUID:        request.PUID,
+		BaseURL:     request.BaseURL,
+	}, request.Pool, request.Limits)
+	if err != nil {
+		c.JSON(500, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "internal_server_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+		return
+	}
+	c.JSON(201, gin.H{"key": plain, "id": key.ID, "name": key.Name, "pool": key.Pool, "created_at": key.CreatedAt})
+}
+
+func (g *gateway) listKeys(c *gin.Context) {
+	keys := g.keys.List()
+	views := make([]apiKeyView, 0, len(keys))
+	for _, key := range keys {
+		view := key.view()
+		view.Usage = g.keyLimiter.Usage(key.ID)
+		views = append(views, view)
+	}
+	c.JSON(200, gin.H{"object": "list", "data": views})
+}
+
+func (g *gateway) deleteKey(c *gin.Context) {
+	id := c.Param("id")
+	deleted, err := g.keys.Delete(id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "internal_server_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+		return
+	}
+	if !deleted {
+		c.JSON(404, gin.H{"error": gin.H{
+			"message": "no such key " + id,
+			"type":    "invalid_request_error",
+			"param":   "id",
+			"code":    nil,
+		}})
+		return
+	}
+	g.keyLimiter.Forget(id)
+	c.JSON(200, gin.H{"id": id, "deleted": true})
+}
+
+// setKeyLimits replaces the limits of a key, a null body restores the
+// defaults.
+func (g *gateway) setKeyLimits(c *gin.Context) {
+	var limits *KeyLimits
+	data, err := c.GetRawData()
+	if err == nil {
+		err = json.Unmarshal(data, &limits)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": gin.H{
+			"message": "Request must be proper JSON",
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    err.Error(),
+		}})
+		return
+	}
+	if limits != nil {
+		if err := limits.validate(); err != nil {
+			c.JSON(400, gin.H{"error": gin.H{
+				"message": err.Error(),
+				"type":    "invalid_request_error",
+				"param":   "limits",
+				"code":    nil,
+			}})
+			return
+		}
+	}
+	id := c.Param("id")
+	key, err := g.keys.SetLimits(id, limits)
+	if err != nil {
+		c.JSON(500, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "internal_server_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+		return
+	}
+	if key == nil {
+		c.JSON(404, gin.H{"error": gin.H{
+			"message": "no such key " + id,
+			"type":    "invalid_request_error",
+			"param":   "id",
+			"code":    nil,
+		}})
+		return
+	}
+	view := key.view()
+	view.Usage = g.keyLimiter.Usage(key.ID)
+	c.JSON(200, view)
+}
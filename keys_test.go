@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKeyStore(t *testing.T) {
+	testConfig()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := loadKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, key, err := keys.Create("test", Credential{AccessToken: testAccessToken(), PUID: "user-test"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plain, apiKeyPrefix) || key.Hash != hashAPIKey(plain) || !strings.HasPrefix(plain, key.Prefix) {
+		t.Fatalf("key %q stored as %+v", plain, key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), plain) {
+		t.Error("keys file holds the plain key")
+	}
+
+	reloaded, err := loadKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := reloaded.Lookup(plain); !ok || found.ID != key.ID || found.PUID != "user-test" {
+		t.Fatalf("lookup after reload: %+v, %v", found, ok)
+	}
+	if _, ok := reloaded.Lookup(plain + "0"); ok {
+		t.Error("unknown key found")
+	}
+
+	// A failed save keeps the key, in memory as on disk
+	if err = os.Mkdir(path+".tmp", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := reloaded.Delete(key.ID); deleted || err == nil {
+		t.Fatalf("delete with a failing save: %v, %v", deleted, err)
+	}
+	if _, ok := reloaded.Lookup(plain); !ok {
+		t.Error("key dropped although the delete was not saved")
+	}
+	if err = os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted, err := reloaded.Delete(key.ID); !deleted || err != nil {
+		t.Fatalf("delete: %v, %v", deleted, err)
+	}
+	if deleted, _ := reloaded.Delete(key.ID); deleted {
+		t.Error("key deleted twice")
+	}
+	if reloaded, _ = loadKeyStore(path); len(reloaded.List()) != 0 {
+		t.Errorf("keys after delete %+v", reloaded.List())
+	}
+}
+
+func adminRequest(router *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+config.Admin.Token)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAuthenticate(t *testing.T) {
+	testConfig()
+	config.Admin.Token = "admin-token"
+	router, _ := testRouter(t, NewFakeUpstream(), false)
+	errorCode := func(recorder *httptest.ResponseRecorder) string {
+		var response struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return response.Error.Code
+	}
+
+	recorder := adminRequest(router, http.MethodPost, "/admin/keys", `{"name":"issued","access_token":"`+testAccessToken()+`","puid":"user-test"}`)
+	var created struct {
+		Key string `json:"key"`
+		ID  string `json:"id"`
+	}
+	if json.Unmarshal(recorder.Body.Bytes(), &created); recorder.Code != 201 || !strings.HasPrefix(created.Key, apiKeyPrefix) {
+		t.Fatalf("create: %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder := adminRequest(router, http.MethodPost, "/admin/keys", `{"name":"bad","access_token":"not-a-token"}`); recorder.Code != 400 {
+		t.Errorf("invalid access token: %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder := getModels(router, created.Key, "/v1/models"); recorder.Code != 200 {
+		t.Errorf("issued key: %d %s", recorder.Code, recorder.Body)
+	}
+	for name, token := range map[string]string{
+		"unknown key":    apiKeyPrefix + strings.Repeat("0", 48),
+		"upstream token": testAccessToken(),
+	} {
+		if recorder := getModels(router, token, "/v1/models"); recorder.Code != 401 || errorCode(recorder) != "invalid_api_key" {
+			t.Errorf("%s: %d %s", name, recorder.Code, recorder.Body)
+		}
+	}
+	if recorder := postChat(t, router, "", `{"model":"gpt-4","messages":[]}`); recorder.Code != 401 {
+		t.Errorf("missing key: %d %s", recorder.Code, recorder.Body)
+	}
+
+	if recorder := adminRequest(router, http.MethodDelete, "/admin/keys/"+created.ID, ""); recorder.Code != 200 {
+		t.Fatalf("delete: %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder := getModels(router, created.Key, "/v1/models"); recorder.Code != 401 {
+		t.Errorf("deleted key: %d %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestPoolKeyAccountRequests(t *testing.T) {
+	testConfig()
+	config.Admin.Token = "admin-token"
+	config.Accounts.List = []AccountConfig{{Name: "team", AccessToken: testAccessToken(), PUID: "user-team"}}
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")})
+	router, key := testRouter(t, upstream, true)
+	requests := func() int64 {
+		var status struct {
+			Data []accountView `json:"data"`
+		}
+		json.Unmarshal(adminRequest(router, http.MethodGet, "/admin/accounts", "").Body.Bytes(), &status)
+		if len(status.Data) != 1 {
+			t.Fatalf("accounts %+v", status.Data)
+		}
+		return status.Data[0].Requests
+	}
+
+	for _, path := range []string{"/v1/models", "/v1/models/gpt-4"} {
+		if recorder := getModels(router, key, path); recorder.Code != 200 {
+			t.Errorf("%s: %d %s", path, recorder.Code, recorder.Body)
+		}
+	}
+	if n := requests(); n != 0 {
+		t.Errorf("listing models took %d account requests", n)
+	}
+	if recorder := postChat(t, router, key, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`); recorder.Code != 200 {
+		t.Fatalf("completion: %d %s", recorder.Code, recorder.Body)
+	}
+	if n := requests(); n != 1 {
+		t.Errorf("completion took %d account requests, want 1", n)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Context keys the handlers use to describe a request to the ledger.
+const (
+	usageRecordsKey = "usage_records"
+	usageModelKey   = "usage_model"
+)
+
+// Record kinds.
+const (
+	usageCompletion   = "chat.completion"
+	usageContinuation = "chat.completion.continuation"
+	usageRepair       = "chat.completion.repair"
+	usageImage        = "image.generation"
+)
+
+var ledgerBucket = []byte("records")
+
+// usageRecord is one upstream exchange: a completion, each continuation of
+// a truncated completion, or an image generation.
+type usageRecord struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Key     string    `json:"key"`
+	KeyName string    `json:"key_name"`
+	// Account is the pool account name, or the redacted PUID of the
+	// request's own credential.
+	Account          string `json:"account"`
+	Model            string `json:"model"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	Images           int    `json:"images"`
+	LatencyMs        int64  `json:"latency_ms"`
+	Status           int    `json:"status"`
+	Error            string `json:"error,omitempty"`
+}
+
+// ledger keeps every usageRecord in a bbolt file, keyed by time so range
+// queries only read the requested period.
+type ledger struct {
+	db *bolt.DB
+}
+
+// openLedger opens or creates the ledger at path. An empty path disables
+// the ledger.
+func openLedger(path string) (*ledger, error) {
+	if path == "" {
+		return &ledger{}, nil
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ledgerBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ledger{db: db}, nil
+}
+
+func (l *ledger) Enabled() bool {
+	return l.db != nil
+}
+
+func (l *ledger) Close() error {
+	if l.db == nil {
+		return nil
+	}
+	return l.db.Close()
+}
+
+// ledgerKey orders records by time, the sequence keeps records of the same
+// nanosecond apart.
+func ledgerKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// Add stores records. Concurrent requests are batched into one transaction.
+func (l *ledger) Add(records ...usageRecord) error {
+	if l.db == nil || len(records) == 0 {
+		return nil
+	}
+	return l.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ledgerBucket)
+		for _, record := range records {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(ledgerKey(record.Time, seq), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Each calls fn with the records in [from, to) in time order.
+func (l *ledger) Each(from, to time.Time, fn func(usageRecord) error) error {
+	if l.db == nil {
+		return nil
+	}
+	end := ledgerKey(to, 0)
+	return l.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(ledgerBucket).Cursor()
+		for k, v := cursor.Seek(ledgerKey(from, 0)); k != nil && bytes.Compare(k, end) < 0; k, v = cursor.Next() {
+			var record usageRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addUsage attaches a record to the request for recordUsage to store.
+func addUsage(c *gin.Context, record usageRecord) {
+	value, _ := c.Get(usageRecordsKey)
+	records, _ := value.([]usageRecord)
+	c.Set(usageRecordsKey, append(records, record))
+}
+
+// recordedTokens sums the tokens of the exchanges added with addUsage.
+func recordedTokens(c *gin.Context) int {
+	value, _ := c.Get(usageRecordsKey)
+	records, _ := value.([]usageRecord)
+	tokens := 0
+	for _, record := range records {
+		tokens += record.PromptTokens + record.CompletionTokens
+	}
+	return tokens
+}
+
+// recordUsage stores what the handler reported with addUsage once the
+// request is done. Requests that failed before reaching the upstream are
+// recorded as a single kind record without tokens.
+func (g *gateway) recordUsage(kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		value, _ := c.Get(usageRecordsKey)
+		records, _ := value.([]usageRecord)
+		if len(records) == 0 {
+			records = []usageRecord{{Kind: kind, LatencyMs: time.Since(start).Milliseconds()}}
+		}
+		var keyID, keyName string
+		if value, ok := c.Get(apiKeyKey); ok {
+			key := value.(*APIKey)
+			keyID, keyName = key.ID, key.Name
+		}
+		// The PUID is a session cookie, only its redacted form is stored
+		accountName := redactPUID(requestCredential(c).PUID)
+		if acc := requestAccount(c); acc != nil {
+			accountName = acc.Name
+		}
+		status := responseStatus(c)
+		var errorMessage string
+		if last := c.Errors.Last(); last != nil {
+			errorMessage = last.Error()
+		}
+		for i := range records {
+			record := &records[i]
+			if record.Time.IsZero() {
+				record.Time = start
+			}
+			record.Key, record.KeyName, record.Account = keyID, keyName, accountName
+			if record.Model == "" {
+				record.Model = c.GetString(usageModelKey)
+			}
+			record.TotalTokens = record.PromptTokens + record.CompletionTokens
+			record.Status = status
+			record.Error = errorMessage
+		}
+		if err := g.ledger.Add(records...); err != nil {
+			fmt.Println("Error recording usage: ", err)
+		}
+	}
+}
+
+// responseStatus is the status a request ended with. A stream that fails
+// after the headers were sent still reports 200, it counts as the 502
+// abortStream stands for.
+func responseStatus(c *gin.Context) int {
+	var streamErr *StreamError
+	if last := c.Errors.Last(); last != nil && errors.As(last.Err, &streamErr) {
+		return 502
+	}
+	return c.Writer.Status()
+}
+
+// usageDimensions are what /admin/usage can group by.
+var usageDimensions = map[string]func(usageRecord) string{
+	"key":      func(r usageRecord) string { return r.Key },
+	"key_name": func(r usageRecord) string { return r.KeyName },
+	"account":  func(r usageRecord) string { return r.Account },
+	"model":    func(r usageRecord) string { return r.Model },
+	"kind":     func(r usageRecord) string { return r.Kind },
+	"day":      func(r usageRecord) string { return r.Time.UTC().Format("2006-01-02") },
+	"month":    func(r usageRecord) string { return r.Time.UTC().Format("2006-01") },
+}
+
+// usageRow sums the records of one group.
+type usageRow struct {
+	Group            []string
+	Requests         int64
+	Continuations    int64
+	Errors           int64
+	PromptTokens     int64
+	CompletionTokens int64
+	TotalTokens      int64
+	Images           int64
+	LatencyMs        int64
+}
+
+func (r *usageRow) add(record usageRecord) {
+	// Repairs are follow-up exchanges of a request like continuations
+	if record.Kind == usageContinuation || record.Kind == usageRepair {
+		r.Continuations++
+	} else {
+		r.Requests++
+	}
+	if record.Status >= 400 || record.Error != "" {
+		r.Errors++
+	}
+	r.PromptTokens += int64(record.PromptTokens)
+	r.CompletionTokens += int64(record.CompletionTokens)
+	r.TotalTokens += int64(record.TotalTokens)
+	r.Images += int64(record.Images)
+	r.LatencyMs += record.LatencyMs
+}
+
+var usageMetrics = []string{"requests", "continuations", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "images", "avg_latency_ms"}
+
+func (r *usageRow) metrics() []int64 {
+	var avgLatency int64
+	if n := r.Requests + r.Continuations; n > 0 {
+		avgLatency = r.LatencyMs / n
+	}
+	return []int64{r.Requests, r.Continuations, r.Errors, r.PromptTokens, r.CompletionTokens, r.TotalTokens, r.Images, avgLatency}
+}
+
+// usageQuery is the period and filters of an /admin/usage request.
+type usageQuery struct {
+	From, To time.Time
+	Key      string
+	Account  string
+	Model    string
+}
+
+func (q usageQuery) matches(r usageRecord) bool {
+	return (q.Key == "" || q.Key == r.Key || q.Key == r.KeyName) &&
+		(q.Account == "" || q.Account == r.Account) &&
+		(q.Model == "" || q.Model == r.Model)
+}
+
+// parseUsageTime reads a date, which is inclusive as the end of a period,
+// or an RFC 3339 time.
+func parseUsageTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseUsageQuery reads from, to, key, account and model. The period
+// defaults to the last 30 days.
+func parseUsageQuery(c *gin.Context) (usageQuery, bool) {
+	now := time.Now().UTC()
+	q := usageQuery{
+		From:    time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -29),
+		To:      now.Add(time.Second),
+		Key:     c.Query("key"),
+		Account: c.Query("account"),
+		Model:   c.Query("model"),
+	}
+	for _, param := range []string{"from", "to"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseUsageTime(value, param == "to")
+		if err != nil {
+			invalidUsageQuery(c, fmt.Sprintf("%s must be a date like 2006-01-02 or an RFC 3339 time", param), param)
+			return q, false
+		}
+		if param == "from" {
+			q.From = t
+		} else {
+			q.To = t
+		}
+	}
+	return q, true
+}
+
+func invalidUsageQuery(c *gin.Context, message string, param string) {
+	c.JSON(400, gin.H{"error": gin.H{
+		"message": message,
+		"type":    "invalid_request_error",
+		"param":   param,
+		"code":    nil,
+	}})
+}
+
+// usageFormat returns the export format, json or csv.
+func usageFormat(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		invalidUsageQuery(c, "format must be json or csv", "format")
+		return "", false
+	}
+	return format, true
+}
+
+func (g *gateway) ledgerEnabled(c *gin.Context) bool {
+	if g.ledger.Enabled() {
+		return true
+	}
+	c.JSON(404, gin.H{"error": gin.H{
+		"message": "usage ledger is disabled, set ledger.file to enable it",
+		"type":    "invalid_request_error",
+		"param":   nil,
+		"code":    "ledger_disabled",
+	}})
+	return false
+}
+
+// usageSummary serves /admin/usage: the records of a period summed by the
+// dimensions in group_by, "key,model,day" by default.
+func (g *gateway) usageSummary(c *gin.Context) {
+	if !g.ledgerEnabled(c) {
+		return
+	}
+	query, ok := parseUsageQuery(c)
+	if !ok {
+		return
+	}
+	format, ok := usageFormat(c)
+	if !ok {
+		return
+	}
+	var groupBy []string
+	for _, dimension := range strings.Split(c.DefaultQuery("group_by", "key,model,day"), ",") {
+		dimension = strings.TrimSpace(dimension)
+		if dimension == "" {
+			continue
+		}
+		if usageDimensions[dimension] == nil {
+			invalidUsageQuery(c, fmt.Sprintf("cannot group by %q, use key, key_name, account, model, kind, day or month", dimension), "group_by")
+			return
+		}
+		groupBy = append(groupBy, dimension)
+	}
+
+	rows := map[string]*usageRow{}
+	err := g.ledger.Each(query.From, query.To, func(record usageRecord) error {
+		if !query.matches(record) {
+			return nil
+		}
+		group := make([]string, len(groupBy))
+		for i, dimension := range groupBy {
+			group[i] = usageDimensions[dimension](record)
+		}
+		id := strings.Join(group, "\x00")
+		row, ok := rows[id]
+		if !ok {
+			row = &usageRow{Group: group}
+			rows[id] = row
+		}
+		row.add(record)
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "server_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+		return
+	}
+	sorted := make([]*usageRow, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Group, sorted[j].Group
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	if format == "csv" {
+		table := [][]string{append(append([]string{}, groupBy...), usageMetrics...)}
+		for _, row := range sorted {
+			line := append([]string{}, row.Group...)
+			for _, metric := range row.metrics() {
+				line = append(line, strconv.FormatInt(metric, 10))
+			}
+			table = append(table, line)
+		}
+		writeCSV(c, "usage.csv", table)
+		return
+	}
+	data := make([]gin.H, 0, len(sorted))
+	for _, row := range sorted {
+		item := gin.H{}
+		for i, dimension := range groupBy {
+			item[dimension] = row.Group[i]
+		}
+		for i, metric := range row.metrics() {
+			item[usageMetrics[i]] = metric
+		}
+		data = append(data, item)
+	}
+	c.JSON(200, gin.H{
+		"object":   "list",
+		"from":     query.From,
+		"to":       query.To,
+		"group_by": groupBy,
+		"data":     data,
+	})
+}
+
+var usageRecordColumns = []string{"time", "kind", "key", "key_name", "account", "model", "prompt_tokens", "completion_tokens", "total_tokens", "images", "latency_ms", "status", "error"}
+
+// usageRecords serves /admin/usage/records, every record of a period for
+// export.
+func (g *gateway) usageRecords(c *gin.Context) {
+	if !g.ledgerEnabled(c) {
+		return
+	}
+	query, ok := parseUsageQuery(c)
+	if !ok {
+		return
+	}
+	format, ok := usageFormat(c)
+	if !ok {
+		return
+	}
+	records := []usageRecord{}
+	err := g.ledger.Each(query.From, query.To, func(record usageRecord) error {
+		if query.matches(record) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "server_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+		return
+	}
+	if format == "json" {
+		c.JSON(200, gin.H{"object": "list", "from": query.From, "to": query.To, "data": records})
+		return
+	}
+	table := [][]string{usageRecordColumns}
+	for _, r := range records {
+		table = append(table, []string{
+			r.Time.UTC().Format(time.RFC3339Nano), r.Kind, r.Key, r.KeyName, r.Account, r.Model,
+			strconv.Itoa(r.PromptTokens), strconv.Itoa(r.CompletionTokens), strconv.Itoa(r.TotalTokens),
+			strconv.Itoa(r.Images), strconv.FormatInt(r.LatencyMs, 10), strconv.Itoa(r.Status), r.Error,
+		})
+	}
+	writeCSV(c, "usage_records.csv", table)
+}
+
+func writeCSV(c *gin.Context, filename string, table [][]string) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(table); err != nil {
+		c.JSON(500, gin.H{"error": gin.H{
+			"message": err.Error(),
+			"type":    "server_error",
+			"param":   nil,
+			"code":    nil,
+		}})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(200, "text/csv; charset=utf-8", buf.Bytes())
+}
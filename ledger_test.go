@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ledgerModels returns the models of the records in [from, to).
+func ledgerModels(t *testing.T, l *ledger, from, to time.Time) []string {
+	t.Helper()
+	var models []string
+	err := l.Each(from, to, func(record usageRecord) error {
+		models = append(models, record.Model)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models
+}
+
+func TestLedgerOrderAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	l, err := openLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	// Records of the same nanosecond keep the order they were added in
+	if err = l.Add(usageRecord{Time: t0.Add(2 * time.Second), Model: "late"}, usageRecord{Time: t0, Model: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Add(usageRecord{Time: t0.Add(time.Second), Model: "third"}, usageRecord{Time: t0, Model: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first", "second", "third"}
+	if got := ledgerModels(t, l, t0, t0.Add(2*time.Second)); !reflect.DeepEqual(got, want) {
+		t.Errorf("records %v, want %v", got, want)
+	}
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = openLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	want = append(want, "late")
+	if got := ledgerModels(t, l, t0.Add(-time.Hour), t0.Add(time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reopening %v, want %v", got, want)
+	}
+}
+
+// testLedgerRouter serves the gateway routes over upstream with a ledger
+// in a temporary file and the admin api enabled.
+func testLedgerRouter(t *testing.T, upstream Upstream) (*gin.Engine, string, *ledger) {
+	t.Helper()
+	testConfig()
+	config.Admin.Token = "admin-token"
+	keys, _ := loadKeyStore("")
+	keyLimiter, _ := loadKeyLimiter("")
+	l, err := openLedger(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	plain, _, err := keys.Create("test", Credential{AccessToken: testAccessToken(), PUID: "user-test"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(upstream, keys, keyLimiter, l, newProxyPool(config), newAccountPool(config.Accounts))
+	return newRouter(g), plain, l
+}
+
+func getAdmin(router *gin.Engine, path string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set("Authorization", "Bearer "+config.Admin.Token)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestUsageSummary(t *testing.T) {
+	router, _, l := testLedgerRouter(t, NewFakeUpstream())
+	day1 := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	err := l.Add(
+		usageRecord{Time: day1, Kind: usageCompletion, Key: "k1", Model: "gpt-4", PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, LatencyMs: 100, Status: 200},
+		usageRecord{Time: day1.Add(time.Second), Kind: usageContinuation, Key: "k1", Model: "gpt-4", CompletionTokens: 3, TotalTokens: 3, LatencyMs: 50, Status: 200},
+		usageRecord{Time: day1.Add(time.Minute), Kind: usageCompletion, Key: "k1", Model: "gpt-3.5", PromptTokens: 1, TotalTokens: 1, Status: 200},
+		usageRecord{Time: day2, Kind: usageCompletion, Key: "k2", Model: "gpt-4", Status: 502, Error: "upstream stream truncated"},
+		usageRecord{Time: day2.AddDate(0, 0, 1), Kind: usageCompletion, Key: "k2", Model: "gpt-4", Status: 200},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := getAdmin(router, "/admin/usage?group_by=key,model&from=2024-05-10&to=2024-05-11")
+	var summary struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &summary); err != nil || recorder.Code != 200 {
+		t.Fatalf("status %d, body %s", recorder.Code, recorder.Body)
+	}
+	want := []map[string]interface{}{
+		{"key": "k1", "model": "gpt-3.5", "requests": 1.0, "continuations": 0.0, "errors": 0.0, "prompt_tokens": 1.0, "completion_tokens": 0.0, "total_tokens": 1.0, "images": 0.0, "avg_latency_ms": 0.0},
+		{"key": "k1", "model": "gpt-4", "requests": 1.0, "continuations": 1.0, "errors": 0.0, "prompt_tokens": 10.0, "completion_tokens": 8.0, "total_tokens": 18.0, "images": 0.0, "avg_latency_ms": 75.0},
+		{"key": "k2", "model": "gpt-4", "requests": 1.0, "continuations": 0.0, "errors": 1.0, "prompt_tokens": 0.0, "completion_tokens": 0.0, "total_tokens": 0.0, "images": 0.0, "avg_latency_ms": 0.0},
+	}
+	if !reflect.DeepEqual(summary.Data, want) {
+		t.Errorf("summary %v, want %v", summary.Data, want)
+	}
+
+	recorder = getAdmin(router, "/admin/usage?group_by=day&from=2024-05-10&to=2024-05-11&format=csv")
+	table, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTable := [][]string{
+		append([]string{"day"}, usageMetrics...),
+		{"2024-05-10", "2", "1", "0", "11", "8", "19", "0", "50"},
+		{"2024-05-11", "1", "0", "1", "0", "0", "0", "0", "0"},
+	}
+	if !reflect.DeepEqual(table, wantTable) {
+		t.Errorf("csv %v, want %v", table, wantTable)
+	}
+
+	recorder = getAdmin(router, "/admin/usage/records?key=k2&from=2024-05-01&to=2024-05-31&format=csv")
+	table, err = csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 3 || !reflect.DeepEqual(table[0], usageRecordColumns) || table[1][2] != "k2" || table[1][11] != "502" {
+		t.Errorf("records csv %v", table)
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); !strings.Contains(disposition, "usage_records.csv") {
+		t.Errorf("Content-Disposition %q", disposition)
+	}
+
+	recorder = getAdmin(router, "/admin/usage?group_by=week")
+	if recorder.Code != 400 {
+		t.Errorf("unknown group_by: status %d", recorder.Code)
+	}
+}
+
+func TestUsageRecordsStreamErrorStatus(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hel", ""))})
+	router, key, l := testLedgerRouter(t, upstream)
+	postChat(t, router, key, `{"model":"gpt-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+
+	var records []usageRecord
+	l.Each(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), func(record usageRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if len(records) != 1 || records[0].Status != 502 || !strings.Contains(records[0].Error, "truncated") {
+		t.Errorf("records %+v, want one 502 for the truncated stream", records)
+	}
+	// The PUID of the key's credential is a secret
+	if len(records) == 1 && records[0].Account != redactPUID("user-test") {
+		t.Errorf("account recorded as %q", records[0].Account)
+	}
+}
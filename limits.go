@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CapRule limits how many requests one upstream account may send to the
+// models matching Model within Window, mirroring the message caps of the
+// web backend.
+type CapRule struct {
+	// Model is matched against the upstream slug with path.Match, e.g. "gpt-4*".
+	Model string `yaml:"model" toml:"model"`
+	// Accounts restricts the rule to these pool account names or PUIDs,
+	// empty applies it to every account.
+	Accounts []string `yaml:"accounts,omitempty" toml:"accounts"`
+	Requests int      `yaml:"requests" toml:"requests"`
+	Window   Duration `yaml:"window" toml:"window"`
+}
+
+func (r CapRule) matches(slug string, ids []string) bool {
+	if matched, _ := path.Match(r.Model, slug); !matched {
+		return false
+	}
+	if len(r.Accounts) == 0 {
+		return true
+	}
+	for _, account := range r.Accounts {
+		for _, id := range ids {
+			if id != "" && id == account {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capWindow is the sliding window of one account and rule.
+type capWindow struct {
+	rule    CapRule
+	times   []time.Time
+	waiting int
+}
+
+// prune drops the requests that left the window.
+func (w *capWindow) prune(now time.Time) {
+	window := time.Duration(w.rule.Window)
+	i := 0
+	for i < len(w.times) && now.Sub(w.times[i]) >= window {
+		i++
+	}
+	w.times = w.times[i:]
+}
+
+// reset is how long until the oldest request leaves the window.
+func (w *capWindow) reset(now time.Time) time.Duration {
+	if len(w.times) == 0 {
+		return 0
+	}
+	return w.times[0].Add(time.Duration(w.rule.Window)).Sub(now)
+}
+
+// capStatus is reported in the x-ratelimit-* headers.
+type capStatus struct {
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+	Window    time.Duration
+}
+
+func (w *capWindow) status(now time.Time) capStatus {
+	return capStatus{
+		Limit:     w.rule.Requests,
+		Remaining: w.rule.Requests - len(w.times),
+		Reset:     w.reset(now),
+		Window:    time.Duration(w.rule.Window),
+	}
+}
+
+// capReservation is the request slot a request took in a window.
+type capReservation struct {
+	window *capWindow
+	at     time.Time
+}
+
+// capReservationKey holds the *capReservation of a request, a failover to
+// another account moves it there.
+const capReservationKey = "cap_reservation"
+
+// capExceededError is returned when a request could not get capacity in
+// time or the wait queue was full.
+type capExceededError struct {
+	Status     capStatus
+	RetryAfter time.Duration
+	QueueFull  bool
+}
+
+func (e *capExceededError) Error() string {
+	message := fmt.Sprintf("usage cap of %d requests per %s reached", e.Status.Limit, e.Status.Window)
+	if e.QueueFull {
+		message += " and the wait queue is full"
+	}
+	return message
+}
+
+// capLimiter enforces caps.rules with one sliding window per account and
+// rule. Requests over the cap wait in a bounded queue until capacity frees
+// up or caps.max_wait passes.
+type capLimiter struct {
+	cfg     CapsConfig
+	mu      sync.Mutex
+	windows map[string]*capWindow
+}
+
+func newCapLimiter(cfg CapsConfig) *capLimiter {
+	return &capLimiter{cfg: cfg, windows: map[string]*capWindow{}}
+}
+
+// window returns the window of the first rule matching slug for account,
+// nil if the model is not capped. Callers hold l.mu.
+func (l *capLimiter) window(account string, ids []string, slug string) *capWindow {
+	for i, rule := range l.cfg.Rules {
+		if !rule.matches(slug, ids) {
+			continue
+		}
+		key := account + "\x00" + strconv.Itoa(i)
+		w, ok := l.windows[key]
+		if !ok {
+			w = &capWindow{rule: rule}
+			l.windows[key] = w
+		}
+		return w
+	}
+	return nil
+}
+
+// Available reports whether account could send a request to slug now.
+func (l *capLimiter) Available(account string, ids []string, slug string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.window(account, ids, slug)
+	if w == nil {
+		return true
+	}
+	w.prune(time.Now())
+	return len(w.times) < w.rule.Requests
+}
+
+// Reserve takes one request of account's cap for slug, waiting for
+// capacity if needed. ok is false when no rule caps slug.
+func (l *capLimiter) Reserve(ctx context.Context, account string, ids []string, slug string) (status capStatus, res *capReservation, ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.window(account, ids, slug)
+	if w == nil {
+		return capStatus{}, nil, false, nil
+	}
+	deadline := time.Now().Add(time.Duration(l.cfg.MaxWait))
+	queued := false
+	defer func() {
+		if queued {
+			w.waiting--
+		}
+	}()
+	for {
+		now := time.Now()
+		w.prune(now)
+		if len(w.times) < w.rule.Requests {
+			w.times = append(w.times, now)
+			return w.status(now), &capReservation{window: w, at: now}, true, nil
+		}
+		reset := w.reset(now)
+		if !queued {
+			if w.waiting >= l.cfg.MaxQueue {
+				return w.status(now), nil, true, &capExceededError{Status: w.status(now), RetryAfter: reset, QueueFull: true}
+			}
+			w.waiting++
+			queued = true
+		}
+		if now.Add(reset).After(deadline) {
+			return w.status(now), nil, true, &capExceededError{Status: w.status(now), RetryAfter: reset}
+		}
+		// Sleep until the oldest request leaves the window, then compete
+		// for the slot with the other waiters
+		l.mu.Unlock()
+		timer := time.NewTimer(reset)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			l.mu.Lock()
+			return w.status(time.Now()), nil, true, ctx.Err()
+		}
+		l.mu.Lock()
+	}
+}
+
+// Move gives res back and takes a slot of account's cap for slug instead,
+// without waiting: the request is already on its way. res is nil if the
+// request had no slot, the returned reservation if the new account has no
+// cap for slug.
+func (l *capLimiter) Move(res *capReservation, account string, ids []string, slug string) (capStatus, *capReservation, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if res != nil {
+		for i, at := range res.window.times {
+			if at.Equal(res.at) {
+				res.window.times = append(res.window.times[:i:i], res.window.times[i+1:]...)
+				break
+			}
+		}
+	}
+	w := l.window(account, ids, slug)
+	if w == nil {
+		return capStatus{}, nil, false
+	}
+	now := time.Now()
+	w.prune(now)
+	w.times = append(w.times, now)
+	return w.status(now), &capReservation{window: w, at: now}, true
+}
+
+// capAccount identifies the upstream account a request is sent as: the
+// pool account, or else the PUID or token of its own credential. ids are
+// what caps.rules[].accounts is matched against.
+func capAccount(c *gin.Context) (string, []string) {
+	if acc := requestAccount(c); acc != nil {
+		return acc.capAccount()
+	}
+	cred := requestCredential(c)
+	if cred.PUID != "" {
+		return "puid:" + cred.PUID, []string{cred.PUID}
+	}
+	return "token:" + cred.sessionKey(), nil
+}
+
+func (a *account) capAccount() (string, []string) {
+	return "account:" + a.Name, []string{a.Name, a.PUID}
+}
+
+// setRateLimitHeaders reports status in the x-ratelimit-* headers of unit,
+// "requests" or "tokens".
+func setRateLimitHeaders(c *gin.Context, unit string, status capStatus) {
+	remaining := status.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Header("x-ratelimit-limit-"+unit, strconv.Itoa(status.Limit))
+	c.Header("x-ratelimit-remaining-"+unit, strconv.Itoa(remaining))
+	c.Header("x-ratelimit-reset-"+unit, status.Reset.Round(time.Millisecond).String())
+}
+
+// setCapHeaders reports the cap of a request, unless the requests per
+// minute of its key leave fewer requests.
+func setCapHeaders(c *gin.Context, status capStatus) {
+	if value, ok := c.Get(keyRequestsStatusKey); ok && value.(capStatus).Remaining <= status.Remaining {
+		return
+	}
+	setRateLimitHeaders(c, "requests", status)
+}
+
+// moveCapacity moves the slot of a request that fails over to the account
+// now in c.
+func (g *gateway) moveCapacity(c *gin.Context, slug string) {
+	res, _ := c.Get(capReservationKey)
+	reservation, _ := res.(*capReservation)
+	account, ids := capAccount(c)
+	status, reservation, ok := g.caps.Move(reservation, account, ids, slug)
+	c.Set(capReservationKey, reservation)
+	if ok {
+		setCapHeaders(c, status)
+	}
+}
+
+// reserveCapacity takes one request of the caller's cap for slug. Pool
+// requests move to another account with capacity left before waiting. It
+// writes 429 with Retry-After and returns false when no capacity frees up
+// in time.
+func (g *gateway) reserveCapacity(c *gin.Context, slug string) bool {
+	if acc := requestAccount(c); acc != nil {
+		tried := map[string]bool{}
+		for {
+			account, ids := capAccount(c)
+			if g.caps.Available(account, ids, slug) {
+				break
+			}
+			tried[acc.Name] = true
+			next, ok := g.accounts.Acquire(tried)
+			if !ok {
+				break
+			}
+			acc = next
+			c.Set(accountKey, acc)
+			c.Set(credentialKey, acc.Credential())
+		}
+	}
+	account, ids := capAccount(c)
+	status, res, ok, err := g.caps.Reserve(c.Request.Context(), account, ids, slug)
+	if !ok {
+		return true
+	}
+	setCapHeaders(c, status)
+	if err == nil {
+		c.Set(capReservationKey, res)
+		return true
+	}
+	capErr, isCap := err.(*capExceededError)
+	if !isCap {
+		// The client went away while waiting
+		c.Abort()
+		return false
+	}
+	retryAfter := int(math.Ceil(capErr.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(429, gin.H{"error": gin.H{
+		"message": fmt.Sprintf("Rate limit reached for %s: %s. Please try again in %ds.", slug, capErr.Error(), retryAfter),
+		"type":    "requests",
+		"param":   nil,
+		"code":    "rate_limit_exceeded",
+	}})
+	return false
+}
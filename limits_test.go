@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+
+	config.Keys.DefaultLimits = KeyLimits{RequestsPerMinute: 10, TokensPerMinute: 1000}
+	recorder := postChat(t, router, key, body)
+	for header, want := range map[string]string{
+		"x-ratelimit-limit-requests":     "10",
+		"x-ratelimit-remaining-requests": "9",
+		"x-ratelimit-limit-tokens":       "1000",
+		"x-ratelimit-remaining-tokens":   "1000",
+	} {
+		if got := recorder.Header().Get(header); got != want {
+			t.Errorf("%s: %q, want %q", header, got, want)
+		}
+	}
+
+	// The cap leaves fewer requests than the key, it is the one reported
+	config.Caps.Rules = []CapRule{{Model: "gpt-4*", Requests: 3, Window: Duration(time.Hour)}}
+	router, key = testRouter(t, upstream, false)
+	recorder = postChat(t, router, key, body)
+	if limit, remaining := recorder.Header().Get("x-ratelimit-limit-requests"), recorder.Header().Get("x-ratelimit-remaining-requests"); limit != "3" || remaining != "2" {
+		t.Errorf("got limit %q, remaining %q", limit, remaining)
+	}
+
+	config.Keys.DefaultLimits = KeyLimits{RequestsPerMinute: 1}
+	router, key = testRouter(t, upstream, false)
+	postChat(t, router, key, body)
+	recorder = postChat(t, router, key, body)
+	if recorder.Code != 429 || recorder.Header().Get("x-ratelimit-remaining-requests") != "0" || recorder.Header().Get("x-ratelimit-limit-requests") != "1" {
+		t.Errorf("status %d, headers %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestCapMovesWithFailover(t *testing.T) {
+	upstream := NewFakeUpstream(
+		FakeReply{StatusCode: 403, Body: `{"detail":"account deactivated"}`},
+		FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")},
+	)
+	testConfig()
+	config.Accounts.List = []AccountConfig{
+		{Name: "first", AccessToken: testAccessToken()},
+		{Name: "second", AccessToken: testAccessToken()},
+	}
+	config.Caps.Rules = []CapRule{{Model: "gpt-4*", Requests: 1, Window: Duration(time.Hour)}}
+	keys, _ := loadKeyStore("")
+	keyLimiter, _ := loadKeyLimiter("")
+	ledger, _ := openLedger("")
+	g := newGateway(upstream, keys, keyLimiter, ledger, newProxyPool(config), newAccountPool(config.Accounts))
+	key, _, err := keys.Create("pool", Credential{}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := postChat(t, newRouter(g), key, `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), "Hello") {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if remaining := recorder.Header().Get("x-ratelimit-remaining-requests"); remaining != "0" {
+		t.Errorf("remaining %q after the request moved", remaining)
+	}
+	first, _ := g.accounts.accounts[0].capAccount()
+	second, _ := g.accounts.accounts[1].capAccount()
+	if !g.caps.Available(first, nil, "gpt-4") {
+		t.Error("the failed account still holds the slot")
+	}
+	if g.caps.Available(second, nil, "gpt-4") {
+		t.Error("the account that served the request holds no slot")
+	}
+}
+
+func TestCapLimiterMove(t *testing.T) {
+	limiter := newCapLimiter(CapsConfig{Rules: []CapRule{
+		{Model: "gpt-4*", Accounts: []string{"a"}, Requests: 2, Window: Duration(time.Hour)},
+		{Model: "gpt-4*", Requests: 1, Window: Duration(time.Hour)},
+	}})
+	_, first, _, _ := limiter.Reserve(context.Background(), "account:a", []string{"a"}, "gpt-4")
+	_, second, _, err := limiter.Reserve(context.Background(), "account:a", []string{"a"}, "gpt-4")
+	if err != nil || first == nil || second == nil {
+		t.Fatalf("reservations %v %v: %v", first, second, err)
+	}
+	// The slot taken first is given back, the later one stays
+	status, moved, ok := limiter.Move(first, "account:b", []string{"b"}, "gpt-4")
+	if !ok || moved == nil || status.Limit != 1 || status.Remaining != 0 {
+		t.Fatalf("moved to b: %+v, %v", status, ok)
+	}
+	if w := first.window; len(w.times) != 1 || !w.times[0].Equal(second.at) {
+		t.Errorf("a keeps %v, want the second reservation", w.times)
+	}
+	if _, res, ok := limiter.Move(moved, "account:c", []string{"c"}, "gpt-3.5"); ok || res != nil {
+		t.Errorf("uncapped model got a reservation")
+	}
+	if !limiter.Available("account:b", []string{"b"}, "gpt-4") {
+		t.Errorf("b keeps the slot after it moved on")
+	}
+}
@@ -1,19 +1,70 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
-	"github.com/gin-gonic/gin"
-)
+	"os"
 
-const (
-	Port = ":9333"
-	// ProxyUrl 如果不使用代理，设为空""即可
-	ProxyUrl = "http://127.0.0.1:7890"
-	// DisableHistory 默认true不开启网页历史记录
-	DisableHistory = true
+	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	cfg, printOnly, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printOnly {
+		// Printed before validating, to inspect a config that is rejected
+		_, _ = cfg.WriteTo(os.Stdout)
+	}
+	if err = cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printOnly {
+		return
+	}
+	config = cfg
+	proxies := newProxyPool(config)
+	upstream, err := newUpstream(config, proxies)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	keys, err := loadKeyStore(config.Keys.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keys:", err)
+		os.Exit(1)
+	}
+
+	keyLimiter, err := loadKeyLimiter(config.Keys.UsageFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keys:", err)
+		os.Exit(1)
+	}
+
+	ledger, err := openLedger(config.Ledger.File)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ledger:", err)
+		os.Exit(1)
+	}
+
+	g := newGateway(upstream, keys, keyLimiter, ledger, proxies, newAccountPool(config.Accounts))
+	go g.watchTokens()
+	go keyLimiter.run()
+
+	s := initServer(config.Listen, config.Server, newRouter(g))
+	fmt.Println(s.ListenAndServe().Error())
+	if err = keyLimiter.Flush(); err != nil {
+		fmt.Println("Error saving key usage: ", err)
+	}
+	if err = ledger.Close(); err != nil {
+		fmt.Println("Error closing usage ledger: ", err)
+	}
+}
+
+func newRouter(g *gateway) *gin.Engine {
 	router := gin.Default()
 	router.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -21,9 +72,24 @@ func main() {
 		})
 	})
 	router.OPTIONS("/v1/chat/completions", optionsHandler)
-	router.POST("/v1/chat/completions", chatCompletions)
-	router.POST("/v1/chat/dalle", dalle)
+	router.POST("/v1/chat/completions", g.authenticate(true), g.acquireAccount, g.recordUsage(usageCompletion), g.limitKey, g.chatCompletions)
+	router.POST("/v1/images/generations", g.authenticate(true), g.acquireAccount, g.recordUsage(usageImage), g.limitKey, g.dalle)
+	router.GET("/v1/models", g.authenticate(false), g.listModels)
+	router.GET("/v1/models/:model", g.authenticate(false), g.retrieveModel)
 
-	s := initServer(Port, router)
-	fmt.Println(s.ListenAndServe().Error())
+	admin := router.Group("/admin", adminAuth)
+	admin.GET("/gizmos", g.listGizmos)
+	admin.POST("/gizmos/:id/refresh", g.refreshGizmo)
+	admin.GET("/keys", g.listKeys)
+	admin.POST("/keys", g.createKey)
+	admin.DELETE("/keys/:id", g.deleteKey)
+	admin.PUT("/keys/:id/limits", g.setKeyLimits)
+	admin.GET("/tokens", g.listTokens)
+	admin.GET("/proxies", g.listProxies)
+	admin.GET("/accounts", g.listAccounts)
+	admin.POST("/accounts/:name/reset", g.resetAccount)
+	admin.GET("/usage", g.usageSummary)
+	admin.GET("/usage/records", g.usageRecords)
+	admin.GET("/metrics", gin.WrapH(expvar.Handler()))
+	return router
 }
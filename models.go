@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpstreamModel is one entry of the web backend's model list.
+type UpstreamModel struct {
+	Slug        string   `json:"slug"`
+	MaxTokens   int      `json:"max_tokens"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type upstreamModelList struct {
+	Models []UpstreamModel `json:"models"`
+}
+
+// Model is the OpenAI model object.
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+type cachedModels struct {
+	models    []UpstreamModel
+	fetchedAt time.Time
+}
+
+// modelCatalog lists the models the gateway can route: the configured ones
+// plus whatever the web backend reports, cached per account since the plan
+// of the account decides what it reports.
+type modelCatalog struct {
+	upstream Upstream
+	mu       sync.Mutex
+	cache    map[string]cachedModels
+	// started is reported as the creation time of every model, the
+	// backend reports none.
+	started time.Time
+	// refresh is held while fetching, so requests arriving after expiry
+	// wait for a single fetch instead of each sending their own.
+	refresh sync.Mutex
+	// now is the clock of the cache.
+	now func() time.Time
+}
+
+func newModelCatalog(upstream Upstream) *modelCatalog {
+	return &modelCatalog{upstream: upstream, cache: map[string]cachedModels{}, started: time.Now(), now: time.Now}
+}
+
+func (m *modelCatalog) cached(key string) (cachedModels, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cached, ok := m.cache[key]
+	return cached, ok && m.now().Sub(cached.fetchedAt) < time.Duration(config.Models.CacheTTL)
+}
+
+// upstreamModels returns the cached backend list, refreshing it when it is
+// older than models.cache_ttl. Stale entries are kept if a refresh fails.
+func (m *modelCatalog) upstreamModels(cred Credential) []UpstreamModel {
+	if cred.AccessToken == "" {
+		return nil
+	}
+	key := cred.sessionKey()
+	if cached, fresh := m.cached(key); fresh {
+		return cached.models
+	}
+	m.refresh.Lock()
+	defer m.refresh.Unlock()
+	// Another request may have refreshed the list while this one waited
+	cached, fresh := m.cached(key)
+	if fresh {
+		return cached.models
+	}
+	models, err := m.upstream.Models(cred)
+	if err != nil {
+		fmt.Println("Error fetching upstream models: ", err)
+		return cached.models
+	}
+	now := m.now()
+	m.mu.Lock()
+	// Drop the lists of expired or replaced access tokens
+	for other, cached := range m.cache {
+		if now.Sub(cached.fetchedAt) >= time.Duration(config.Models.CacheTTL) {
+			delete(m.cache, other)
+		}
+	}
+	m.cache[key] = cachedModels{models: models, fetchedAt: now}
+	m.mu.Unlock()
+	return models
+}
+
+// List merges the configured and upstream models that routes resolve,
+// sorted by id.
+func (m *modelCatalog) List(cred Credential) []Model {
+	seen := map[string]bool{}
+	var list []Model
+	add := func(id string, ownedBy string) {
+		if id == "" || seen[id] {
+			return
+		}
+		seen[id] = true
+		if _, ok := config.Routes.Resolve(id); !ok {
+			return
+		}
+		list = append(list, Model{ID: id, Object: "model", Created: m.started.Unix(), OwnedBy: ownedBy})
+	}
+	for _, id := range config.Models.List {
+		add(id, "openai")
+	}
+	for _, id := range config.Routes.Names() {
+		add(id, "openai")
+	}
+	for _, model := range m.upstreamModels(cred) {
+		add(model.Slug, "chatgpt")
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (g *gateway) listModels(c *gin.Context) {
+	c.JSON(200, ModelList{
+		Object: "list",
+		Data:   g.models.List(requestCredential(c)),
+	})
+}
+
+func (g *gateway) retrieveModel(c *gin.Context) {
+	id := c.Param("model")
+	for _, model := range g.models.List(requestCredential(c)) {
+		if model.ID == id {
+			c.JSON(200, model)
+			return
+		}
+	}
+	modelNotFound(c, id)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelsUpstream reports models, after release is closed if it is set.
+type modelsUpstream struct {
+	*FakeUpstream
+	models []UpstreamModel
+	// byPUID overrides models per account
+	byPUID  map[string][]UpstreamModel
+	err     error
+	release chan struct{}
+	fetches int32
+}
+
+func (u *modelsUpstream) Models(cred Credential) ([]UpstreamModel, error) {
+	atomic.AddInt32(&u.fetches, 1)
+	if u.release != nil {
+		<-u.release
+	}
+	if u.byPUID != nil {
+		return u.byPUID[cred.PUID], u.err
+	}
+	return u.models, u.err
+}
+
+func getModels(router *gin.Engine, key string, path string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	request.Header.Set("Authorization", "Bearer "+key)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestListModels(t *testing.T) {
+	testConfig()
+	// Only models the routes resolve are listed
+	config.Models.List = []string{"custom-model", "gpt-4-32k", "gpt-4"}
+	config.Routes = ModelRoutes{{Model: "gpt-4", Aliases: []string{"gpt-4*"}}}
+	upstream := &modelsUpstream{FakeUpstream: NewFakeUpstream(), models: []UpstreamModel{{Slug: "gpt-4o"}, {Slug: "gpt-4"}, {Slug: "o1-preview"}}}
+	router, key := testRouter(t, upstream, false)
+
+	recorder := getModels(router, key, "/v1/models")
+	var list ModelList
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil || recorder.Code != 200 {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	var created int64
+	if len(list.Data) > 0 {
+		created = list.Data[0].Created
+	}
+	want := []Model{
+		{ID: "gpt-4", Object: "model", Created: created, OwnedBy: "openai"},
+		{ID: "gpt-4-32k", Object: "model", Created: created, OwnedBy: "openai"},
+		{ID: "gpt-4o", Object: "model", Created: created, OwnedBy: "chatgpt"},
+	}
+	if list.Object != "list" || created == 0 || !reflect.DeepEqual(list.Data, want) {
+		t.Errorf("models %+v, want %+v", list.Data, want)
+	}
+
+	recorder = getModels(router, key, "/v1/models/gpt-4o")
+	var model Model
+	if json.Unmarshal(recorder.Body.Bytes(), &model); recorder.Code != 200 || model.ID != "gpt-4o" {
+		t.Errorf("gpt-4o: %d %s", recorder.Code, recorder.Body)
+	}
+	for _, id := range []string{"gpt-4*", "o1-preview", "custom-model"} {
+		recorder = getModels(router, key, "/v1/models/"+id)
+		var response struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(recorder.Body.Bytes(), &response); recorder.Code != 404 || response.Error.Code != "model_not_found" {
+			t.Errorf("%s: %d %s", id, recorder.Code, recorder.Body)
+		}
+	}
+	if fetches := atomic.LoadInt32(&upstream.fetches); fetches != 1 {
+		t.Errorf("upstream list fetched %d times, want 1", fetches)
+	}
+}
+
+func TestModelCachePerAccount(t *testing.T) {
+	testConfig()
+	upstream := &modelsUpstream{FakeUpstream: NewFakeUpstream(), byPUID: map[string][]UpstreamModel{
+		"user-plus": {{Slug: "gpt-4"}, {Slug: "gpt-4o"}},
+		"user-free": {{Slug: "text-davinci-002-render-sha"}},
+	}}
+	catalog := newModelCatalog(upstream)
+	// Both accounts share the base url
+	plus := Credential{AccessToken: testAccessToken(), PUID: "user-plus"}
+	free := Credential{AccessToken: testAccessToken(), PUID: "user-free"}
+	for i := 0; i < 2; i++ {
+		if models := catalog.upstreamModels(plus); len(models) != 2 {
+			t.Errorf("plus account models %+v", models)
+		}
+		if models := catalog.upstreamModels(free); len(models) != 1 {
+			t.Errorf("free account models %+v", models)
+		}
+	}
+	if fetches := atomic.LoadInt32(&upstream.fetches); fetches != 2 {
+		t.Errorf("fetched %d times, want once per account", fetches)
+	}
+}
+
+func TestModelCacheTTL(t *testing.T) {
+	testConfig()
+	config.Models.CacheTTL = Duration(time.Minute)
+	upstream := &modelsUpstream{FakeUpstream: NewFakeUpstream(), models: []UpstreamModel{{Slug: "gpt-4o"}}}
+	catalog := newModelCatalog(upstream)
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	catalog.now = func() time.Time { return now }
+	cred := Credential{AccessToken: testAccessToken()}
+
+	catalog.upstreamModels(cred)
+	now = now.Add(59 * time.Second)
+	catalog.upstreamModels(cred)
+	if fetches := atomic.LoadInt32(&upstream.fetches); fetches != 1 {
+		t.Fatalf("fetched %d times within the ttl", fetches)
+	}
+	now = now.Add(time.Second)
+	upstream.models = []UpstreamModel{{Slug: "gpt-4o"}, {Slug: "o1"}}
+	if models := catalog.upstreamModels(cred); len(models) != 2 || atomic.LoadInt32(&upstream.fetches) != 2 {
+		t.Fatalf("after the ttl: %+v, %d fetches", models, upstream.fetches)
+	}
+
+	// A failed refresh keeps the stale list
+	now = now.Add(time.Hour)
+	upstream.err = errors.New("unavailable")
+	if models := catalog.upstreamModels(cred); len(models) != 2 {
+		t.Errorf("failed refresh: %+v", models)
+	}
+}
+
+func TestModelRefreshSingleFlight(t *testing.T) {
+	testConfig()
+	upstream := &modelsUpstream{FakeUpstream: NewFakeUpstream(), models: []UpstreamModel{{Slug: "gpt-4o"}}, release: make(chan struct{})}
+	catalog := newModelCatalog(upstream)
+	cred := Credential{AccessToken: testAccessToken()}
+
+	var started, done sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			started.Done()
+			if models := catalog.upstreamModels(cred); len(models) != 1 {
+				t.Errorf("models %+v", models)
+			}
+		}()
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	done.Wait()
+	if fetches := atomic.LoadInt32(&upstream.fetches); fetches != 1 {
+		t.Errorf("concurrent requests fetched the list %d times, want 1", fetches)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+)
+
+// directProxy stands for connecting without a proxy when none is configured.
+const directProxy = ""
+
+// proxyEntry is one proxy of the pool and what is known about its health.
+type proxyEntry struct {
+	URL     string
+	Healthy bool
+	// Latency is the duration of the last successful health check.
+	Latency             time.Duration
+	Requests            int64
+	Checks              int64
+	Failures            int64
+	ConsecutiveFailures int
+	LastError           string
+	LastCheck           time.Time
+}
+
+// proxyPool hands out upstream proxies. Every credential is pinned to one
+// proxy so the backend sees it from a stable address; proxies that keep
+// failing are taken out of rotation until a health check succeeds again.
+type proxyPool struct {
+	cfg     ProxiesConfig
+	mu      sync.Mutex
+	entries []*proxyEntry
+	pins    map[string]string
+}
+
+// newProxyPool builds the pool from proxies.list, or from the single proxy
+// setting when the list is empty.
+func newProxyPool(cfg Config) *proxyPool {
+	urls := cfg.Proxies.List
+	if len(urls) == 0 {
+		urls = []string{cfg.Proxy}
+	}
+	pool := &proxyPool{cfg: cfg.Proxies, pins: map[string]string{}}
+	for _, u := range urls {
+		pool.entries = append(pool.entries, &proxyEntry{URL: u, Healthy: true})
+	}
+	return pool
+}
+
+func (p *proxyPool) entry(proxy string) *proxyEntry {
+	for _, e := range p.entries {
+		if e.URL == proxy {
+			return e
+		}
+	}
+	return nil
+}
+
+// Pick returns the proxy pinned to key, pinning a healthy one with the
+// fewest credentials if there is none yet or the pinned proxy is unhealthy
+// or in avoid. When every proxy is down the one checked longest ago is used
+// rather than failing the request outright.
+func (p *proxyPool) Pick(key string, avoid map[string]bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if proxy, ok := p.pins[key]; ok && !avoid[proxy] {
+		if e := p.entry(proxy); e != nil && e.Healthy {
+			return proxy
+		}
+	}
+	pinned := map[string]int{}
+	for _, proxy := range p.pins {
+		pinned[proxy]++
+	}
+	var best *proxyEntry
+	for _, e := range p.entries {
+		if !e.Healthy || avoid[e.URL] {
+			continue
+		}
+		if best == nil || pinned[e.URL] < pinned[best.URL] {
+			best = e
+		}
+	}
+	if best == nil {
+		for _, e := range p.entries {
+			if best == nil || e.LastCheck.Before(best.LastCheck) {
+				best = e
+			}
+		}
+	}
+	p.pins[key] = best.URL
+	return best.URL
+}
+
+// Unpin forgets the proxy of key, e.g. when its session is evicted.
+func (p *proxyPool) Unpin(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pins, key)
+}
+
+// Len reports how many proxies are in the pool.
+func (p *proxyPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// Report records the outcome of a request or health check sent through
+// proxy. A nil err re-admits the proxy, proxies.fail_threshold consecutive
+// errors take it out of rotation.
+func (p *proxyPool) Report(proxy string, latency time.Duration, err error, check bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entry(proxy)
+	if e == nil {
+		return
+	}
+	if check {
+		e.Checks++
+		e.LastCheck = time.Now()
+	} else {
+		e.Requests++
+	}
+	if err == nil {
+		if check {
+			e.Latency = latency
+		}
+		if !e.Healthy {
+			fmt.Println("Proxy " + redactProxy(proxy) + " recovered")
+		}
+		e.Healthy = true
+		e.ConsecutiveFailures = 0
+		return
+	}
+	e.Failures++
+	e.ConsecutiveFailures++
+	e.LastError = err.Error()
+	if e.Healthy && e.ConsecutiveFailures >= p.cfg.FailThreshold {
+		fmt.Println("Proxy "+redactProxy(proxy)+" removed after repeated errors: ", err)
+		e.Healthy = false
+	}
+}
+
+// check sends one health check request through every proxy.
+func (p *proxyPool) check(clientCfg ClientConfig) {
+	p.mu.Lock()
+	proxies := make([]string, 0, len(p.entries))
+	for _, e := range p.entries {
+		proxies = append(proxies, e.URL)
+	}
+	p.mu.Unlock()
+
+	clientCfg.Timeout = p.cfg.CheckTimeout
+	var wg sync.WaitGroup
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy string) {
+			defer wg.Done()
+			start := time.Now()
+			err := checkProxy(clientCfg, proxy, p.cfg.CheckURL)
+			p.Report(proxy, time.Since(start), err, true)
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+// checkProxy reaches proxies.check_url through proxy. Any http response
+// counts, the backend may well answer a bare GET with an error status.
+func checkProxy(clientCfg ClientConfig, proxy string, checkURL string) error {
+	client, err := newClient(clientCfg, proxy)
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+	request, err := http.NewRequest(http.MethodGet, checkURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// run health checks the pool every proxies.check_interval.
+func (p *proxyPool) run(clientCfg ClientConfig) {
+	for {
+		p.check(clientCfg)
+		time.Sleep(time.Duration(p.cfg.CheckInterval))
+	}
+}
+
+// redactProxy hides the password of a proxy url.
+func redactProxy(proxy string) string {
+	if proxy == directProxy {
+		return "direct"
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return proxy
+	}
+	return u.Redacted()
+}
+
+type proxyStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMs int64     `json:"latency_ms"`
+	Requests  int64     `json:"requests"`
+	Failures  int64     `json:"failures"`
+	ErrorRate float64   `json:"error_rate"`
+	Pinned    int       `json:"pinned"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+// Status reports every proxy, healthy ones first.
+func (p *proxyPool) Status() []proxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pinned := map[string]int{}
+	for _, proxy := range p.pins {
+		pinned[proxy]++
+	}
+	list := make([]proxyStatus, 0, len(p.entries))
+	for _, e := range p.entries {
+		status := proxyStatus{
+			URL:       redactProxy(e.URL),
+			Healthy:   e.Healthy,
+			LatencyMs: e.Latency.Milliseconds(),
+			Requests:  e.Requests,
+			Failures:  e.Failures,
+			Pinned:    pinned[e.URL],
+			LastError: e.LastError,
+			LastCheck: e.LastCheck,
+		}
+		if attempts := e.Requests + e.Checks; attempts > 0 {
+			status.ErrorRate = float64(e.Failures) / float64(attempts)
+		}
+		list = append(list, status)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Healthy && !list[j].Healthy })
+	return list
+}
+
+func (g *gateway) listProxies(c *gin.Context) {
+	c.JSON(200, gin.H{"object": "list", "data": g.proxies.Status()})
+}
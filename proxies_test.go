@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// connectProxy is an http proxy for https targets. A failing one refuses
+// every CONNECT.
+type connectProxy struct {
+	fail     bool
+	connects int32
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddInt32(&p.connects, 1)
+	if p.fail {
+		http.Error(w, "upstream unreachable", http.StatusBadGateway)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	go io.Copy(target, buffered)
+	io.Copy(conn, target)
+}
+
+func TestProxyFailover(t *testing.T) {
+	var conversations int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/backend-api/conversation" {
+			atomic.AddInt32(&conversations, 1)
+		}
+		io.WriteString(w, SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]"))
+	}))
+	defer backend.Close()
+	bad, good := &connectProxy{fail: true}, &connectProxy{}
+	badServer, goodServer := httptest.NewServer(bad), httptest.NewServer(good)
+	defer badServer.Close()
+	defer goodServer.Close()
+
+	cfg := defaultConfig()
+	cfg.Proxies.List = []string{badServer.URL, goodServer.URL}
+	cfg.Proxies.FailThreshold = 1
+	pool := newProxyPool(cfg)
+	upstream := &webUpstream{sessions: newSessionManager(cfg.Client, pool), proxies: pool}
+	cred := Credential{AccessToken: "token", BaseURL: backend.URL}
+
+	for i := 0; i < 2; i++ {
+		response, err := upstream.Conversation(context.Background(), ChatGPTRequest{Action: "next", Model: "gpt-4"}, cred)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != 200 || len(body) == 0 {
+			t.Fatalf("request %d: status %d, body %q", i, response.StatusCode, body)
+		}
+	}
+	if n := atomic.LoadInt32(&conversations); n != 2 {
+		t.Errorf("backend got %d conversations, want 2", n)
+	}
+	// The credential is pinned to the working proxy after the first failure
+	if n := atomic.LoadInt32(&bad.connects); n != 1 {
+		t.Errorf("failing proxy got %d CONNECTs, want 1", n)
+	}
+	if n := atomic.LoadInt32(&good.connects); n < 1 {
+		t.Errorf("working proxy got no CONNECT")
+	}
+	for _, status := range pool.Status() {
+		if healthy := status.URL != badServer.URL; status.Healthy != healthy {
+			t.Errorf("proxy %s healthy: %t, want %t", status.URL, status.Healthy, healthy)
+		}
+	}
+	if proxy := pool.Pick(cred.sessionKey(), nil); proxy != goodServer.URL {
+		t.Errorf("credential pinned to %s, want %s", proxy, goodServer.URL)
+	}
+}
+
+// testProxyUpstream sends through two working CONNECT proxies to backend.
+func testProxyUpstream(t *testing.T, backend *httptest.Server) (*webUpstream, *proxyPool, Credential) {
+	t.Helper()
+	first, second := httptest.NewServer(&connectProxy{}), httptest.NewServer(&connectProxy{})
+	t.Cleanup(first.Close)
+	t.Cleanup(second.Close)
+	cfg := defaultConfig()
+	cfg.Proxies.List = []string{first.URL, second.URL}
+	cfg.Proxies.FailThreshold = 1
+	pool := newProxyPool(cfg)
+	upstream := &webUpstream{sessions: newSessionManager(cfg.Client, pool), proxies: pool}
+	return upstream, pool, Credential{AccessToken: "token", BaseURL: backend.URL}
+}
+
+func TestProxyHealthUnchangedOnCancel(t *testing.T) {
+	var conversations int32
+	received, release := make(chan struct{}, 2), make(chan struct{})
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&conversations, 1)
+		received <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+	upstream, pool, cred := testProxyUpstream(t, backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	if _, err := upstream.Conversation(ctx, ChatGPTRequest{Action: "next", Model: "gpt-4"}, cred); err == nil {
+		t.Fatal("cancelled conversation succeeded")
+	}
+	if n := atomic.LoadInt32(&conversations); n != 1 {
+		t.Errorf("backend got %d conversations, want 1", n)
+	}
+	for _, status := range pool.Status() {
+		if !status.Healthy || status.Failures != 0 || status.Requests != 0 {
+			t.Errorf("proxy %s: healthy %t, %d failures, %d requests after a cancel", status.URL, status.Healthy, status.Failures, status.Requests)
+		}
+	}
+}
+
+func TestProxyNoResendAfterPost(t *testing.T) {
+	var conversations int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&conversations, 1)
+		// Drop the connection once the request arrived
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	backend.EnableHTTP2 = false
+	upstream, _, cred := testProxyUpstream(t, backend)
+
+	if _, err := upstream.Conversation(context.Background(), ChatGPTRequest{Action: "next", Model: "gpt-4"}, cred); err == nil {
+		t.Fatal("conversation on a dropped connection succeeded")
+	}
+	if n := atomic.LoadInt32(&conversations); n != 1 {
+		t.Errorf("backend got %d conversations, want 1", n)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// replyLimits are the stop sequences and token budget of a request. The
+// web backend takes neither, so the gateway cuts the reply itself.
+type replyLimits struct {
+	Stop []string
+	// MaxTokens is the completion budget, 0 for none.
+	MaxTokens int
+	// counted is the part of the reply whose tokens are already known.
+	counted tokenPrefix
+}
+
+// tokenPrefix is a prefix of the reply and its number of tokens. It ends
+// where no later text can change how the text before it is tokenized, so
+// only the text after it is encoded again as the reply grows.
+type tokenPrefix struct {
+	text   string
+	tokens int
+}
+
+func newReplyLimits(r APIRequest) replyLimits {
+	var limits replyLimits
+	for _, stop := range r.Stop {
+		if stop != "" {
+			limits.Stop = append(limits.Stop, stop)
+		}
+	}
+	// max_completion_tokens replaces the deprecated max_tokens
+	if r.MaxCompletionTokens != nil {
+		limits.MaxTokens = *r.MaxCompletionTokens
+	} else if r.MaxTokens != nil {
+		limits.MaxTokens = *r.MaxTokens
+	}
+	return limits
+}
+
+// cut returns where the reply text ends and the finish reason, "" while
+// neither a stop sequence nor the budget was reached. The stop sequence is
+// not part of the reply.
+func (l *replyLimits) cut(text string) (int, string) {
+	end, reason := len(text), ""
+	for _, stop := range l.Stop {
+		if i := strings.Index(text, stop); i >= 0 && i < end {
+			end, reason = i, "stop"
+		}
+	}
+	// A token is at least one byte, shorter text cannot be over budget
+	if l.MaxTokens == 0 || end <= l.MaxTokens {
+		return end, reason
+	}
+	enc := tokenizer()
+	if enc == nil {
+		return end, reason
+	}
+	if len(l.counted.text) > end || !strings.HasPrefix(text, l.counted.text) {
+		// The reply was rewritten or cut before the counted prefix
+		l.counted = tokenPrefix{}
+	}
+	start := len(l.counted.text)
+	tokens := enc.EncodeOrdinary(text[start:end])
+	if l.counted.tokens+len(tokens) <= l.MaxTokens {
+		l.advance(text[:end], tokens, func(token int) int { return len(enc.Decode([]int{token})) })
+		return end, reason
+	}
+	kept := start + len(enc.Decode(tokens[:l.MaxTokens-l.counted.tokens]))
+	// The last token may end inside a multi-byte character
+	for kept > start && !utf8.ValidString(text[start:kept]) {
+		kept--
+	}
+	return kept, "length"
+}
+
+// advance moves the counted prefix of text over tokens, the encoding of
+// text past the prefix, up to the last token boundary that later text
+// cannot move: a space after anything but whitespace, which no piece of
+// the cl100k_base pre-tokenizer runs across.
+func (l *replyLimits) advance(text string, tokens []int, size func(int) int) {
+	at, count := len(l.counted.text), l.counted.tokens
+	settled, settledCount := at, count
+	for i := 0; i < len(tokens)-1; i++ {
+		at += size(tokens[i])
+		count++
+		if text[at] != ' ' {
+			continue
+		}
+		if last, _ := utf8.DecodeLastRuneInString(text[:at]); last != utf8.RuneError && !unicode.IsSpace(last) {
+			settled, settledCount = at, count
+		}
+	}
+	l.counted = tokenPrefix{text: text[:settled], tokens: settledCount}
+}
+
+// hold returns how much of text can be streamed: a suffix that may be the
+// start of a stop sequence is held until the next chunk decides it.
+func (l replyLimits) hold(text string) int {
+	n := len(text)
+	for _, stop := range l.Stop {
+		for size := len(stop) - 1; size > 0; size-- {
+			if size <= len(text) && strings.HasSuffix(text, stop[:size]) {
+				if len(text)-size < n {
+					n = len(text) - size
+				}
+				break
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestCutCountsIncrementally grows replies chunk by chunk and checks that
+// counting only the new text cuts where counting the whole text does.
+func TestCutCountsIncrementally(t *testing.T) {
+	words := []string{"Hello", " world", ".", " ", "  ", "\n", "\n\n", "語", " 語言", "é", "'s", " don't", "1234567", " aaaaaaaa", "　", " ", "!!", "\t", "x"}
+	r := rand.New(rand.NewSource(1))
+	settled := 0
+	for i := 0; i < 200; i++ {
+		var text strings.Builder
+		for n := 1 + r.Intn(60); n > 0; n-- {
+			text.WriteString(words[r.Intn(len(words))])
+		}
+		full := text.String()
+		limits := replyLimits{MaxTokens: 1 + r.Intn(40)}
+		for end := 0; end <= len(full); end += 1 + r.Intn(6) {
+			fresh := replyLimits{MaxTokens: limits.MaxTokens}
+			wantEnd, wantReason := fresh.cut(full[:end])
+			gotEnd, gotReason := limits.cut(full[:end])
+			if gotEnd != wantEnd || gotReason != wantReason {
+				t.Fatalf("%q with %d tokens: cut at %d %q, want %d %q", full[:end], limits.MaxTokens, gotEnd, gotReason, wantEnd, wantReason)
+			}
+			if limits.counted.text != "" {
+				settled++
+			}
+			if gotReason != "" {
+				break
+			}
+		}
+	}
+	if settled == 0 {
+		t.Error("the counted prefix never advanced")
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// CompatLenient ignores request parameters the gateway cannot honor and
+	// reports them in the X-Ignored-Params response header.
+	CompatLenient = "lenient"
+	// CompatStrict rejects them, and unknown parameters, with an
+	// invalid_request_error naming the param.
+	CompatStrict = "strict"
+)
+
+// messageContent is the content of a chat message: a plain string or an
+// array of typed parts. A string is read as a single text part.
+type messageContent []contentPart
+
+type contentPart struct {
+	Type       string          `json:"type"`
+	Text       string          `json:"text,omitempty"`
+	Refusal    string          `json:"refusal,omitempty"`
+	ImageURL   *imageURL       `json:"image_url,omitempty"`
+	InputAudio *inputAudio     `json:"input_audio,omitempty"`
+	File       json.RawMessage `json:"file,omitempty"`
+}
+
+type imageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type inputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+func (m *messageContent) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*m = nil
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*m = messageContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var parts []contentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return &paramError{Param: "messages", Message: "Invalid type for 'content': expected a string or an array of content parts."}
+	}
+	*m = parts
+	return nil
+}
+
+func (m messageContent) MarshalJSON() ([]byte, error) {
+	if len(m) == 1 && m[0].Type == "text" {
+		return json.Marshal(m[0].Text)
+	}
+	return json.Marshal([]contentPart(m))
+}
+
+// Text joins the text parts of the content.
+func (m messageContent) Text() string {
+	var texts []string
+	for _, part := range m {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// stopSequences is a single stop string or an array of up to four.
+type stopSequences []string
+
+func (s *stopSequences) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*s = nil
+		return nil
+	}
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = stopSequences{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return &paramError{Param: "stop", Message: "Invalid type for 'stop': expected a string or an array of strings."}
+	}
+	*s = many
+	return nil
+}
+
+type tool struct {
+	Type     string      `json:"type"`
+	Function functionDef `json:"function"`
+}
+
+type functionDef struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type toolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function functionCall `json:"function"`
+}
+
+type functionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// useFunctions checks the deprecated functions and function_call and maps
+// them onto tools and tool_choice. The reply then has a single
+// function_call, as it had before tools.
+func (r *APIRequest) useFunctions() *requestError {
+	if len(r.Tools) > 0 || r.ToolChoice != nil {
+		return invalidParam("functions", "'functions' and 'function_call' cannot be combined with 'tools' and 'tool_choice'.")
+	}
+	for i, f := range r.Functions {
+		if f.Name == "" {
+			return invalidParam(fmt.Sprintf("functions[%d].name", i), "Missing required parameter: 'functions[%d].name'.", i)
+		}
+		r.Tools = append(r.Tools, tool{Type: "function", Function: f})
+	}
+	if r.FunctionCall != nil {
+		switch r.FunctionCall.Mode {
+		case "none", "auto":
+		case "function":
+			if !r.hasTool(r.FunctionCall.Function) {
+				return invalidParam("function_call", "Invalid value for 'function_call': no function named '%s' was specified in the 'functions' parameter.", r.FunctionCall.Function)
+			}
+		default:
+			return invalidParam("function_call", "Invalid value: '%s'. Supported values are: 'none' and 'auto'.", r.FunctionCall.Mode)
+		}
+	}
+	parallel := false
+	r.ToolChoice, r.ParallelToolCalls = r.FunctionCall, &parallel
+	r.functions = true
+	return nil
+}
+
+// toolChoice is "none", "auto", "required", or a named function given as
+// {"type": "function", "function": {"name": ...}}, or as {"name": ...} for
+// the deprecated function_call.
+type toolChoice struct {
+	Mode     string
+	Function string
+}
+
+func (t *toolChoice) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &t.Mode); err == nil {
+		return nil
+	}
+	var named struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return &paramError{Param: "tool_choice", Message: "Invalid type for 'tool_choice': expected a string or an object naming a function."}
+	}
+	t.Mode = "function"
+	t.Function = named.Function.Name
+	if named.Name != "" {
+		t.Function = named.Name
+	}
+	return nil
+}
+
+type responseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *jsonSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type jsonSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// paramError is returned by the UnmarshalJSON methods of the request types,
+// which the json package does not annotate with the field.
+type paramError struct {
+	Param   string
+	Message string
+}
+
+func (e *paramError) Error() string {
+	return e.Message
+}
+
+// requestError is a rejected chat request, rendered as an
+// invalid_request_error.
+type requestError struct {
+	Param   string
+	Code    string
+	Message string
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+func invalidParam(param string, format string, args ...interface{}) *requestError {
+	return &requestError{Param: param, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidRequest(c *gin.Context, err *requestError) {
+	var param, code interface{}
+	if err.Param != "" {
+		param = err.Param
+	}
+	if err.Code != "" {
+		code = err.Code
+	}
+	c.JSON(400, gin.H{"error": gin.H{
+		"message": err.Message,
+		"type":    "invalid_request_error",
+		"param":   param,
+		"code":    code,
+	}})
+}
+
+// decodeChatRequest reads the request body into r. Strict mode rejects
+// parameters the schema does not know.
+func decodeChatRequest(body io.Reader, r *APIRequest, strict bool) *requestError {
+	decoder := json.NewDecoder(body)
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(r)
+	if err == nil {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var paramErr *paramError
+	switch {
+	case errors.As(err, &paramErr):
+		return invalidParam(paramErr.Param, "%s", paramErr.Message)
+	case errors.As(err, &typeErr):
+		return invalidParam(typeErr.Field, "Invalid type for '%s': expected %s, but got %s instead.", typeErr.Field, jsonTypeName(typeErr.Type), article(typeErr.Value))
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestError{Message: "We could not parse the JSON body of your request. The request must be proper JSON."}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return &requestError{Param: field, Code: "unknown_parameter", Message: "Unrecognized request argument supplied: " + field}
+	}
+	return &requestError{Message: err.Error()}
+}
+
+// jsonTypeName names t the way the JSON schema of the API does.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+func article(value string) string {
+	switch value {
+	case "array", "object":
+		return "an " + value
+	case "":
+		return "null"
+	}
+	return "a " + value
+}
+
+func checkRange(param string, value *float64, min, max float64) *requestError {
+	switch {
+	case value == nil:
+		return nil
+	case *value < min:
+		return invalidParam(param, "%v is less than the minimum of %v - '%s'", *value, min, param)
+	case *value > max:
+		return invalidParam(param, "%v is greater than the maximum of %v - '%s'", *value, max, param)
+	}
+	return nil
+}
+
+func checkIntRange(param string, value *int, min, max int) *requestError {
+	if value == nil {
+		return nil
+	}
+	v := float64(*value)
+	return checkRange(param, &v, float64(min), float64(max))
+}
+
+var messageRoles = map[string]bool{"system": true, "developer": true, "user": true, "assistant": true, "tool": true, "function": true}
+
+// validate checks the request against the OpenAI schema: required fields,
+// enums and ranges. It does not decide what the gateway supports.
+func (r *APIRequest) validate() *requestError {
+	if r.Model == "" {
+		return invalidParam("model", "you must provide a model parameter")
+	}
+	if len(r.Messages) == 0 {
+		return invalidParam("messages", "[] is too short - 'messages'")
+	}
+	for i, message := range r.Messages {
+		param := fmt.Sprintf("messages[%d]", i)
+		if !messageRoles[message.Role] {
+			return invalidParam(param+".role", "Invalid value: '%s'. Supported values are: 'system', 'developer', 'user', 'assistant', 'tool' and 'function'.", message.Role)
+		}
+		if message.Content == nil && !(message.Role == "assistant" && (len(message.ToolCalls) > 0 || message.FunctionCall != nil)) {
+			return invalidParam(param+".content", "Invalid value for 'content': expected a string, got null.")
+		}
+		for j, part := range message.Content {
+			switch part.Type {
+			case "text", "image_url", "input_audio", "refusal", "file":
+			default:
+				return invalidParam(fmt.Sprintf("%s.content[%d].type", param, j), "Invalid value: '%s'. Supported values are: 'text', 'image_url', 'input_audio', 'refusal' and 'file'.", part.Type)
+			}
+			if part.Type == "image_url" && (part.ImageURL == nil || part.ImageURL.URL == "") {
+				return invalidParam(fmt.Sprintf("%s.content[%d].image_url", param, j), "Missing required parameter: '%s.content[%d].image_url.url'.", param, j)
+			}
+		}
+		if message.Role == "tool" && message.ToolCallID == "" {
+			return invalidParam(param+".tool_call_id", "Missing required parameter: '%s.tool_call_id'.", param)
+		}
+		if message.Role == "function" && message.Name == "" {
+			return invalidParam(param+".name", "Missing required parameter: '%s.name'.", param)
+		}
+	}
+	if r.StreamOptions != nil && !r.Stream {
+		return invalidParam("stream_options", "The 'stream_options' parameter is only allowed when 'stream' is enabled.")
+	}
+	if err := checkIntRange("max_tokens", r.MaxTokens, 1, 1<<31-1); err != nil {
+		return err
+	}
+	if err := checkIntRange("max_completion_tokens", r.MaxCompletionTokens, 1, 1<<31-1); err != nil {
+		return err
+	}
+	if err := checkIntRange("n", r.N, 1, 128); err != nil {
+		return err
+	}
+	if len(r.Stop) > 4 {
+		return invalidParam("stop", "%s is too long - 'stop'", marshalParam(r.Stop))
+	}
+	if err := checkRange("temperature", r.Temperature, 0, 2); err != nil {
+		return err
+	}
+	if err := checkRange("top_p", r.TopP, 0, 1); err != nil {
+		return err
+	}
+	if err := checkRange("presence_penalty", r.PresencePenalty, -2, 2); err != nil {
+		return err
+	}
+	if err := checkRange("frequency_penalty", r.FrequencyPenalty, -2, 2); err != nil {
+		return err
+	}
+	for token, bias := range r.LogitBias {
+		if _, err := strconv.Atoi(token); err != nil {
+			return invalidParam("logit_bias", "Invalid key in 'logit_bias': %s. You should only be submitting non-negative integers.", token)
+		}
+		bias := bias
+		if err := checkRange("logit_bias", &bias, -100, 100); err != nil {
+			return err
+		}
+	}
+	if err := checkIntRange("top_logprobs", r.TopLogprobs, 0, 20); err != nil {
+		return err
+	}
+	if r.TopLogprobs != nil && !r.Logprobs {
+		return invalidParam("top_logprobs", "'top_logprobs' requires 'logprobs' to be true.")
+	}
+	if len(r.Functions) > 0 || r.FunctionCall != nil {
+		if err := r.useFunctions(); err != nil {
+			return err
+		}
+	}
+	for i, t := range r.Tools {
+		if t.Type != "function" {
+			return invalidParam(fmt.Sprintf("tools[%d].type", i), "Invalid value: '%s'. Supported values are: 'function'.", t.Type)
+		}
+		if t.Function.Name == "" {
+			return invalidParam(fmt.Sprintf("tools[%d].function.name", i), "Missing required parameter: 'tools[%d].function.name'.", i)
+		}
+	}
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Mode {
+		case "none", "auto":
+		case "required", "function":
+			if len(r.Tools) == 0 {
+				return invalidParam("tool_choice", "Invalid value for 'tool_choice': 'tool_choice' is only allowed when 'tools' are specified.")
+			}
+			if r.ToolChoice.Mode == "function" && !r.hasTool(r.ToolChoice.Function) {
+				return invalidParam("tool_choice", "Invalid value for 'tool_choice': no function named '%s' was specified in the 'tools' parameter.", r.ToolChoice.Function)
+			}
+		default:
+			return invalidParam("tool_choice", "Invalid value: '%s'. Supported values are: 'none', 'auto' and 'required'.", r.ToolChoice.Mode)
+		}
+	}
+	if r.ResponseFormat != nil {
+		switch r.ResponseFormat.Type {
+		case "text":
+		case "json_object":
+			if !r.mentionsJSON() {
+				return invalidParam("messages", "'messages' must contain the word 'json' in some form, to use 'response_format' of type 'json_object'.")
+			}
+		case "json_schema":
+			if r.ResponseFormat.JSONSchema == nil || r.ResponseFormat.JSONSchema.Name == "" {
+				return invalidParam("response_format.json_schema", "Missing required parameter: 'response_format.json_schema'.")
+			}
+			if len(r.ResponseFormat.JSONSchema.Schema) > 0 {
+				schema, err := compileJSONSchema(r.ResponseFormat.JSONSchema.Schema)
+				if err != nil {
+					return invalidParam("response_format.json_schema.schema", "Invalid schema for response_format '%s': %s.", r.ResponseFormat.JSONSchema.Name, err)
+				}
+				r.schema = schema
+			}
+		default:
+			return invalidParam("response_format.type", "Invalid value: '%s'. Supported values are: 'text', 'json_object' and 'json_schema'.", r.ResponseFormat.Type)
+		}
+	}
+	return nil
+}
+
+func marshalParam(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// unsupportedParam is a request parameter the gateway cannot honor yet.
+type unsupportedParam struct {
+	Param string
+	// Set reports whether the request asks for anything but the default.
+	Set    func(r *APIRequest) bool
+	Reason string
+}
+
+// unsupportedParams lists what the web backend cannot do: it samples with
+// fixed settings and returns a single choice without logprobs.
+var unsupportedParams = []unsupportedParam{
+	{"n", func(r *APIRequest) bool { return r.N != nil && *r.N != 1 }, "only one choice can be generated per request"},
+	{"temperature", func(r *APIRequest) bool { return r.Temperature != nil && *r.Temperature != 1 }, "the upstream samples at a fixed temperature"},
+	{"top_p", func(r *APIRequest) bool { return r.TopP != nil && *r.TopP != 1 }, "the upstream samples with a fixed top_p"},
+	{"presence_penalty", func(r *APIRequest) bool { return r.PresencePenalty != nil && *r.PresencePenalty != 0 }, "the upstream does not apply penalties"},
+	{"frequency_penalty", func(r *APIRequest) bool { return r.FrequencyPenalty != nil && *r.FrequencyPenalty != 0 }, "the upstream does not apply penalties"},
+	{"logit_bias", func(r *APIRequest) bool { return len(r.LogitBias) > 0 }, "the upstream does not accept logit biases"},
+	{"logprobs", func(r *APIRequest) bool { return r.Logprobs }, "the upstream does not return log probabilities"},
+	{"top_logprobs", func(r *APIRequest) bool { return r.TopLogprobs != nil && *r.TopLogprobs > 0 }, "the upstream does not return log probabilities"},
+	{"seed", func(r *APIRequest) bool { return r.Seed != nil }, "the upstream does not sample deterministically"},
+	{"service_tier", func(r *APIRequest) bool { return r.ServiceTier != "" && r.ServiceTier != "auto" }, "the upstream has a single service tier"},
+	{"store", func(r *APIRequest) bool { return r.Store != nil && *r.Store }, "completions are not stored"},
+	{"metadata", func(r *APIRequest) bool { return len(r.Metadata) > 0 }, "completions are not stored"},
+}
+
+// unsupportedParts are the message content types the gateway cannot send
+// upstream.
+var unsupportedParts = map[string]string{
+	"input_audio": "audio inputs are not supported",
+	"file":        "file inputs are not supported",
+}
+
+// checkSupport applies the compatibility mode to the parameters the
+// gateway cannot honor: strict mode rejects the first one, lenient mode
+// returns them all to be ignored.
+func (r *APIRequest) checkSupport(mode string) ([]string, *requestError) {
+	var ignored []string
+	for _, p := range unsupportedParams {
+		if !p.Set(r) {
+			continue
+		}
+		if mode == CompatStrict {
+			return nil, &requestError{
+				Param:   p.Param,
+				Code:    "unsupported_parameter",
+				Message: fmt.Sprintf("Unsupported parameter: '%s' is not supported by this gateway, %s.", p.Param, p.Reason),
+			}
+		}
+		ignored = append(ignored, p.Param)
+	}
+	for i, message := range r.Messages {
+		for j, part := range message.Content {
+			reason, ok := unsupportedParts[part.Type]
+			if !ok {
+				continue
+			}
+			param := fmt.Sprintf("messages[%d].content[%d].type", i, j)
+			if mode == CompatStrict {
+				return nil, &requestError{
+					Param:   param,
+					Code:    "unsupported_value",
+					Message: fmt.Sprintf("Unsupported value: '%s' content is not supported by this gateway, %s.", part.Type, reason),
+				}
+			}
+			ignored = append(ignored, param)
+		}
+	}
+	return ignored, nil
+}
+
+// bindChatRequest decodes and checks a chat completion request, writing the
+// error and returning false when it is rejected.
+func bindChatRequest(c *gin.Context, r *APIRequest) bool {
+	strict := config.Compat.Mode == CompatStrict
+	if err := decodeChatRequest(c.Request.Body, r, strict); err != nil {
+		invalidRequest(c, err)
+		return false
+	}
+	if err := r.validate(); err != nil {
+		invalidRequest(c, err)
+		return false
+	}
+	ignored, err := r.checkSupport(config.Compat.Mode)
+	if err != nil {
+		invalidRequest(c, err)
+		return false
+	}
+	if len(ignored) > 0 {
+		c.Header("X-Ignored-Params", strings.Join(ignored, ","))
+	}
+	return true
+}
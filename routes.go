@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelRoute maps a public model name, and its aliases, to the upstream
+// model slug and conversation mode. Names may use the wildcards of
+// path.Match, e.g. "gpt-4-[0-9]*".
+type ModelRoute struct {
+	Model   string   `yaml:"model" toml:"model"`
+	Aliases []string `yaml:"aliases,omitempty" toml:"aliases"`
+	// Slug is the upstream model, empty passes the requested name through.
+	Slug string `yaml:"slug,omitempty" toml:"slug"`
+	// ConversationMode is sent as ChatGPTRequest.ConversationMode.
+	ConversationMode map[string]interface{} `yaml:"conversation_mode,omitempty" toml:"conversation_mode"`
+	// GizmoID selects a gizmo interaction when ConversationMode is unset.
+	// Routes matching "gizmo:<id>" use that id when it is empty.
+	GizmoID string `yaml:"gizmo_id,omitempty" toml:"gizmo_id"`
+}
+
+// ResolvedRoute is the outcome of routing one requested model.
+type ResolvedRoute struct {
+	// Model is the model name the client asked for.
+	Model string
+	// Pattern is the route name or alias that matched.
+	Pattern          string
+	Slug             string
+	ConversationMode map[string]interface{}
+	GizmoID          string
+}
+
+type ModelRoutes []ModelRoute
+
+func defaultModelRoutes() ModelRoutes {
+	return ModelRoutes{
+		{Model: "gpt-3.5-turbo", Aliases: []string{"gpt-3.5*"}, Slug: "text-davinci-002-render-sha"},
+		{Model: "text-davinci-002-render-sha", Slug: "text-davinci-002-render-sha"},
+		// Cover some models like gpt-4-32k
+		{Model: "gpt-4", Aliases: []string{"gpt-4-[0-9]*"}, Slug: "gpt-4"},
+		{Model: "gpt-4-plugins", Slug: "gpt-4-plugins"},
+		{Model: "gpt-4*"},
+		{Model: "dall-e-3", Aliases: []string{"dall-e*"}, Slug: "gpt-4-gizmo", GizmoID: "g-2fkFE8rbu"},
+		{Model: gizmoModelPrefix + "g-*", Slug: "gpt-4-gizmo"},
+	}
+}
+
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[\\")
+}
+
+func (r ModelRoute) names() []string {
+	return append([]string{r.Model}, r.Aliases...)
+}
+
+// Resolve finds the route for model. Exact names win over wildcard
+// patterns, which are tried in configuration order.
+func (routes ModelRoutes) Resolve(model string) (ResolvedRoute, bool) {
+	for _, route := range routes {
+		for _, name := range route.names() {
+			if !isPattern(name) && name == model {
+				return route.resolve(model, name), true
+			}
+		}
+	}
+	for _, route := range routes {
+		for _, name := range route.names() {
+			if matched, _ := path.Match(name, model); isPattern(name) && matched {
+				return route.resolve(model, name), true
+			}
+		}
+	}
+	return ResolvedRoute{}, false
+}
+
+func (r ModelRoute) resolve(model string, pattern string) ResolvedRoute {
+	resolved := ResolvedRoute{
+		Model:            model,
+		Pattern:          pattern,
+		Slug:             r.Slug,
+		ConversationMode: r.ConversationMode,
+		GizmoID:          r.GizmoID,
+	}
+	if resolved.Slug == "" {
+		resolved.Slug = model
+	}
+	if resolved.GizmoID == "" && strings.HasPrefix(model, gizmoModelPrefix) {
+		resolved.GizmoID = strings.TrimPrefix(model, gizmoModelPrefix)
+	}
+	return resolved
+}
+
+// resolveRoute routes model and, for gizmo routes, builds the conversation
+// mode from the cached gizmo definition. It writes model_not_found and
+// returns false for unknown models.
+func (g *gateway) resolveRoute(c *gin.Context, model string, cred Credential) (ResolvedRoute, bool) {
+	route, ok := config.Routes.Resolve(model)
+	if !ok {
+		modelNotFound(c, model)
+		return route, false
+	}
+	if route.ConversationMode == nil && route.GizmoID != "" {
+		route.ConversationMode = g.gizmos.ConversationMode(route.GizmoID, cred)
+	}
+	setRouteHeaders(c, route)
+	return route, true
+}
+
+// Names lists every exact model name and alias, for /v1/models.
+func (routes ModelRoutes) Names() []string {
+	var names []string
+	for _, route := range routes {
+		for _, name := range route.names() {
+			if !isPattern(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (routes ModelRoutes) Validate() error {
+	var errs []error
+	for i, route := range routes {
+		if route.Model == "" {
+			errs = append(errs, fmt.Errorf("config: routes[%d]: model is required", i))
+		}
+		for _, name := range route.names() {
+			if _, err := path.Match(name, ""); err != nil {
+				errs = append(errs, fmt.Errorf("config: routes[%d]: invalid pattern %q: %w", i, name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setRouteHeaders echoes the resolved mapping so clients can see where a
+// request was sent.
+func setRouteHeaders(c *gin.Context, route ResolvedRoute) {
+	c.Header("X-Model-Route", route.Pattern)
+	c.Header("X-Upstream-Model", route.Slug)
+	if route.GizmoID != "" {
+		c.Header("X-Upstream-Gizmo-Id", route.GizmoID)
+	}
+}
+
+func modelNotFound(c *gin.Context, model string) {
+	c.JSON(404, gin.H{"error": gin.H{
+		"message": fmt.Sprintf("The model '%s' does not exist", model),
+		"type":    "invalid_request_error",
+		"param":   "model",
+		"code":    "model_not_found",
+	}})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResolveRoute(t *testing.T) {
+	custom := ModelRoutes{
+		{Model: "gpt-*", Slug: "first-pattern"},
+		{Model: "gpt-4*", Slug: "second-pattern"},
+		{Model: "turbo", Aliases: []string{"gpt-4-turbo"}, Slug: "exact"},
+	}
+	for _, test := range []struct {
+		routes  ModelRoutes
+		model   string
+		pattern string
+		slug    string
+		gizmo   string
+	}{
+		{defaultModelRoutes(), "gpt-3.5-turbo", "gpt-3.5-turbo", "text-davinci-002-render-sha", ""},
+		{defaultModelRoutes(), "gpt-3.5-turbo-16k", "gpt-3.5*", "text-davinci-002-render-sha", ""},
+		{defaultModelRoutes(), "gpt-4", "gpt-4", "gpt-4", ""},
+		{defaultModelRoutes(), "gpt-4-32k", "gpt-4-[0-9]*", "gpt-4", ""},
+		{defaultModelRoutes(), "gpt-4-turbo", "gpt-4*", "gpt-4-turbo", ""},
+		{defaultModelRoutes(), "gpt-4-0613", "gpt-4-[0-9]*", "gpt-4", ""},
+		{defaultModelRoutes(), "gpt-4-plugins", "gpt-4-plugins", "gpt-4-plugins", ""},
+		{defaultModelRoutes(), "dall-e-2", "dall-e*", "gpt-4-gizmo", "g-2fkFE8rbu"},
+		{defaultModelRoutes(), "gizmo:g-abc", "gizmo:g-*", "gpt-4-gizmo", "g-abc"},
+		// Exact names and aliases win over patterns listed before them
+		{custom, "gpt-4-turbo", "gpt-4-turbo", "exact", ""},
+		{custom, "turbo", "turbo", "exact", ""},
+		// Patterns are tried in configuration order
+		{custom, "gpt-4o", "gpt-*", "first-pattern", ""},
+	} {
+		route, ok := test.routes.Resolve(test.model)
+		if !ok {
+			t.Errorf("%s: no route", test.model)
+			continue
+		}
+		if route.Model != test.model || route.Pattern != test.pattern || route.Slug != test.slug || route.GizmoID != test.gizmo {
+			t.Errorf("%s: got %+v, want pattern %q, slug %q, gizmo %q", test.model, route, test.pattern, test.slug, test.gizmo)
+		}
+	}
+	for _, model := range []string{"claude-2", "gpt", ""} {
+		if route, ok := defaultModelRoutes().Resolve(model); ok {
+			t.Errorf("%q routed to %+v", model, route)
+		}
+	}
+}
+
+func TestRouteHeaders(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "Hello", "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, `{"model":"gpt-4-0613","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != 200 {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if pattern, slug := recorder.Header().Get("X-Model-Route"), recorder.Header().Get("X-Upstream-Model"); pattern != "gpt-4-[0-9]*" || slug != "gpt-4" {
+		t.Errorf("X-Model-Route %q, X-Upstream-Model %q", pattern, slug)
+	}
+	if requests := upstream.Requests(); len(requests) != 1 || requests[0].Model != "gpt-4" {
+		t.Errorf("upstream got %+v", requests)
+	}
+
+	recorder = postChat(t, router, key, `{"model":"claude-2","messages":[{"role":"user","content":"hi"}]}`)
+	var response struct {
+		Error struct {
+			Param string `json:"param"`
+			Code  string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if recorder.Code != 404 || response.Error.Code != "model_not_found" || response.Error.Param != "model" {
+		t.Errorf("unknown model: %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder.Header().Get("X-Model-Route") != "" {
+		t.Errorf("unknown model has X-Model-Route %q", recorder.Header().Get("X-Model-Route"))
+	}
+	if requests := upstream.Requests(); len(requests) != 1 {
+		t.Errorf("unknown model reached the upstream: %d requests", len(requests))
+	}
+}
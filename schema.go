@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema validates values against a JSON Schema. It covers the subset
+// structured outputs accept: type, enum, const, properties, required,
+// additionalProperties, items, prefixItems, the length, size and range
+// keywords, pattern, anyOf, oneOf, allOf, not and local $refs. Annotations
+// such as format or description are ignored.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// maxRefDepth bounds $refs followed without descending into the value, so
+// a schema referring to itself cannot loop.
+const maxRefDepth = 32
+
+var jsonTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// compileJSONSchema parses schema and checks every subschema, pattern and
+// $ref in it up front, so validating a reply can only fail on the reply.
+func compileJSONSchema(schema json.RawMessage) (*jsonSchema, error) {
+	root, err := decodeJSON(schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	s := &jsonSchema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := s.compile(root, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// decodeJSON decodes data keeping numbers as json.Number, so integers of
+// any size compare exactly.
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+func (s *jsonSchema) compile(schema interface{}, at string) error {
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: a schema must be an object or a boolean", at)
+	}
+	switch t := object["type"].(type) {
+	case nil:
+	case string:
+		if !jsonTypes[t] {
+			return fmt.Errorf("%s/type: unknown type %q", at, t)
+		}
+	case []interface{}:
+		for _, value := range t {
+			if name, ok := value.(string); !ok || !jsonTypes[name] {
+				return fmt.Errorf("%s/type: unknown type %s", at, compactJSON(value))
+			}
+		}
+	default:
+		return fmt.Errorf("%s/type: must be a string or an array of strings", at)
+	}
+	if ref, ok := object["$ref"]; ok {
+		ref, ok := ref.(string)
+		if !ok {
+			return fmt.Errorf("%s/$ref: must be a string", at)
+		}
+		if _, err := s.resolve(ref); err != nil {
+			return fmt.Errorf("%s/$ref: %w", at, err)
+		}
+	}
+	if pattern, ok := object["pattern"]; ok {
+		pattern, ok := pattern.(string)
+		if !ok {
+			return fmt.Errorf("%s/pattern: must be a string", at)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s/pattern: unsupported regular expression: %w", at, err)
+		}
+		s.patterns[pattern] = re
+	}
+	for _, keyword := range []string{"minLength", "maxLength", "minItems", "maxItems", "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf"} {
+		if value, ok := object[keyword]; ok {
+			if _, ok := value.(json.Number); !ok {
+				return fmt.Errorf("%s/%s: must be a number", at, keyword)
+			}
+		}
+	}
+	if required, ok := object["required"]; ok {
+		names, ok := required.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s/required: must be an array of strings", at)
+		}
+		for _, name := range names {
+			if _, ok := name.(string); !ok {
+				return fmt.Errorf("%s/required: must be an array of strings", at)
+			}
+		}
+	}
+	for _, keyword := range []string{"enum", "prefixItems", "anyOf", "oneOf", "allOf"} {
+		if value, ok := object[keyword]; ok {
+			if _, ok := value.([]interface{}); !ok {
+				return fmt.Errorf("%s/%s: must be an array", at, keyword)
+			}
+		}
+	}
+	for _, keyword := range []string{"properties", "$defs", "definitions"} {
+		if value, ok := object[keyword]; ok {
+			subschemas, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s/%s: must be an object", at, keyword)
+			}
+			for name, subschema := range subschemas {
+				if err := s.compile(subschema, at+"/"+keyword+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties", "not"} {
+		if subschema, ok := object[keyword]; ok {
+			if err := s.compile(subschema, at+"/"+keyword); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"prefixItems", "anyOf", "oneOf", "allOf"} {
+		subschemas, _ := object[keyword].([]interface{})
+		for i, subschema := range subschemas {
+			if err := s.compile(subschema, fmt.Sprintf("%s/%s/%d", at, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows a $ref, only references into the schema itself are
+// supported.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only local references are supported, got %q", ref)
+	}
+	target := s.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch node := target.(type) {
+		case map[string]interface{}:
+			next, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%q does not exist", ref)
+			}
+			target = next
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("%q does not exist", ref)
+			}
+			target = node[i]
+		default:
+			return nil, fmt.Errorf("%q does not exist", ref)
+		}
+	}
+	return target, nil
+}
+
+// Validate checks a value decoded by decodeJSON, the error names the path
+// of the first violation, e.g. $.items[2].name.
+func (s *jsonSchema) Validate(value interface{}) error {
+	return s.validate(s.root, value, "$", 0)
+}
+
+func (s *jsonSchema) validate(schema interface{}, value interface{}, path string, refs int) error {
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			return fmt.Errorf("%s: no value is allowed here", path)
+		}
+		return nil
+	}
+	object, _ := schema.(map[string]interface{})
+	if ref, ok := object["$ref"].(string); ok {
+		if refs >= maxRefDepth {
+			return fmt.Errorf("%s: $ref %q is nested too deep", path, ref)
+		}
+		target, err := s.resolve(ref)
+		if err != nil {
+			return err
+		}
+		if err := s.validate(target, value, path, refs+1); err != nil {
+			return err
+		}
+	}
+	if err := s.validateType(object, value, path); err != nil {
+		return err
+	}
+	if enum, ok := object["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: must be one of %s", path, compactJSON(enum))
+		}
+	}
+	if constant, ok := object["const"]; ok && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s: must be %s", path, compactJSON(constant))
+	}
+	switch value := value.(type) {
+	case string:
+		if err := s.validateString(object, value, path); err != nil {
+			return err
+		}
+	case json.Number:
+		if err := validateNumber(object, value, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		// Items and properties start counting $refs again, a recursive
+		// schema may check a value of any depth
+		if err := s.validateArray(object, value, path); err != nil {
+			return err
+		}
+	case map[string]interface{}:
+		if err := s.validateObject(object, value, path); err != nil {
+			return err
+		}
+	}
+	if allOf, ok := object["allOf"].([]interface{}); ok {
+		for _, subschema := range allOf {
+			if err := s.validate(subschema, value, path, refs); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := object["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, subschema := range anyOf {
+			err := s.validate(subschema, value, path, refs)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fmt.Errorf("%s: must match one of the anyOf schemas (%v)", path, firstErr)
+		}
+	}
+	if oneOf, ok := object["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, subschema := range oneOf {
+			if s.validate(subschema, value, path, refs) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: must match exactly one of the oneOf schemas, matches %d", path, matches)
+		}
+	}
+	if not, ok := object["not"]; ok && s.validate(not, value, path, refs) == nil {
+		return fmt.Errorf("%s: must not match the schema in not", path)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateType(object map[string]interface{}, value interface{}, path string) error {
+	var types []string
+	switch t := object["type"].(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, name := range t {
+			types = append(types, name.(string))
+		}
+	default:
+		return nil
+	}
+	actual := jsonTypeOf(value)
+	for _, name := range types {
+		if name == actual || (name == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), actual)
+}
+
+func (s *jsonSchema) validateString(object map[string]interface{}, value string, path string) error {
+	length := utf8.RuneCountInString(value)
+	if limit, ok := schemaNumber(object, "minLength"); ok && float64(length) < limit {
+		return fmt.Errorf("%s: must be at least %v characters long", path, limit)
+	}
+	if limit, ok := schemaNumber(object, "maxLength"); ok && float64(length) > limit {
+		return fmt.Errorf("%s: must be at most %v characters long", path, limit)
+	}
+	if pattern, ok := object["pattern"].(string); ok && !s.patterns[pattern].MatchString(value) {
+		return fmt.Errorf("%s: must match the pattern %q", path, pattern)
+	}
+	return nil
+}
+
+func validateNumber(object map[string]interface{}, value json.Number, path string) error {
+	n, err := value.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if limit, ok := schemaNumber(object, "minimum"); ok && n < limit {
+		return fmt.Errorf("%s: must be at least %v", path, limit)
+	}
+	if limit, ok := schemaNumber(object, "maximum"); ok && n > limit {
+		return fmt.Errorf("%s: must be at most %v", path, limit)
+	}
+	if limit, ok := schemaNumber(object, "exclusiveMinimum"); ok && n <= limit {
+		return fmt.Errorf("%s: must be greater than %v", path, limit)
+	}
+	if limit, ok := schemaNumber(object, "exclusiveMaximum"); ok && n >= limit {
+		return fmt.Errorf("%s: must be less than %v", path, limit)
+	}
+	if factor, ok := schemaNumber(object, "multipleOf"); ok && factor > 0 {
+		if q := n / factor; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Errorf("%s: must be a multiple of %v", path, factor)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(object map[string]interface{}, value []interface{}, path string) error {
+	if limit, ok := schemaNumber(object, "minItems"); ok && float64(len(value)) < limit {
+		return fmt.Errorf("%s: must have at least %v items", path, limit)
+	}
+	if limit, ok := schemaNumber(object, "maxItems"); ok && float64(len(value)) > limit {
+		return fmt.Errorf("%s: must have at most %v items", path, limit)
+	}
+	prefix, _ := object["prefixItems"].([]interface{})
+	for i, item := range value {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if i < len(prefix) {
+			if err := s.validate(prefix[i], item, itemPath, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if items, ok := object["items"]; ok {
+			if err := s.validate(items, item, itemPath, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(object map[string]interface{}, value map[string]interface{}, path string) error {
+	required, _ := object["required"].([]interface{})
+	for _, name := range required {
+		if _, ok := value[name.(string)]; !ok {
+			return fmt.Errorf("%s: missing required property %q", path, name)
+		}
+	}
+	properties, _ := object["properties"].(map[string]interface{})
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	// Report violations in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		propertyPath := path + "." + name
+		if subschema, ok := properties[name]; ok {
+			if err := s.validate(subschema, value[name], propertyPath, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		additional, ok := object["additionalProperties"]
+		if !ok {
+			continue
+		}
+		if allowed, isBool := additional.(bool); isBool && !allowed {
+			return fmt.Errorf("%s: unexpected property %q", path, name)
+		}
+		if err := s.validate(additional, value[name], propertyPath, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaNumber(object map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := object[keyword].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := value.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonEqual compares decoded values, numbers by value so 1 equals 1.0.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, value := range a {
+			other, ok := b[name]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func compactJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	for _, test := range []struct {
+		schema string
+		valid  []string
+		errors []string
+	}{
+		{`{"type":"string"}`, []string{`"a"`}, []string{`1`, `null`}},
+		{`{"type":["integer","null"]}`, []string{`1`, `1.0`, `null`}, []string{`1.5`, `"1"`}},
+		{`{"type":"number"}`, []string{`1`, `1.5`}, []string{`true`}},
+		{`{"type":"boolean"}`, []string{`false`}, []string{`0`}},
+		{`{"type":"array"}`, []string{`[]`}, []string{`{}`}},
+		{`{"type":"object"}`, []string{`{}`}, []string{`[]`}},
+		{`{"enum":["a",1,{"b":[2]}]}`, []string{`"a"`, `1.0`, `{"b":[2]}`}, []string{`"b"`, `{"b":[3]}`}},
+		{`{"const":{"a":1}}`, []string{`{"a":1}`}, []string{`{"a":1,"b":2}`}},
+		{`{"minLength":2,"maxLength":3}`, []string{`"ab"`, `"äöü"`, `1`}, []string{`"a"`, `"abcd"`}},
+		{`{"pattern":"^[a-z]+$"}`, []string{`"abc"`}, []string{`"ab1"`}},
+		{`{"minimum":1,"maximum":3}`, []string{`1`, `3`}, []string{`0.5`, `4`}},
+		{`{"exclusiveMinimum":1,"exclusiveMaximum":3}`, []string{`2`}, []string{`1`, `3`}},
+		{`{"multipleOf":0.5}`, []string{`1.5`, `2`}, []string{`1.2`}},
+		{`{"minItems":1,"maxItems":2}`, []string{`[1]`, `[1,2]`}, []string{`[]`, `[1,2,3]`}},
+		{`{"items":{"type":"integer"}}`, []string{`[1,2]`}, []string{`[1,"2"]`}},
+		{`{"prefixItems":[{"type":"string"}],"items":{"type":"integer"}}`, []string{`["a",1]`}, []string{`[1]`, `["a","b"]`}},
+		{`{"required":["a"],"properties":{"a":{"type":"string"}}}`, []string{`{"a":"x","b":1}`}, []string{`{"b":1}`, `{"a":1}`}},
+		{`{"properties":{"a":{}},"additionalProperties":false}`, []string{`{"a":1}`}, []string{`{"a":1,"b":2}`}},
+		{`{"additionalProperties":{"type":"integer"}}`, []string{`{"a":1}`}, []string{`{"a":"1"}`}},
+		{`{"anyOf":[{"type":"string"},{"minimum":5}]}`, []string{`"a"`, `6`}, []string{`4`}},
+		{`{"oneOf":[{"type":"integer"},{"minimum":5}]}`, []string{`4`, `5.5`, `"a"`}, []string{`6`, `4.5`}},
+		{`{"allOf":[{"type":"integer"},{"minimum":5}]}`, []string{`5`}, []string{`4`, `5.5`}},
+		{`{"not":{"type":"string"}}`, []string{`1`}, []string{`"a"`}},
+		{`false`, nil, []string{`1`}},
+		{`{"properties":{"a":true,"b":false}}`, []string{`{"a":1}`}, []string{`{"b":1}`}},
+		// Annotations are ignored
+		{`{"type":"string","format":"email","description":"d"}`, []string{`"not an email"`}, nil},
+		{`{"$defs":{"name":{"type":"string"}},"properties":{"a":{"$ref":"#/$defs/name"}}}`, []string{`{"a":"x"}`}, []string{`{"a":1}`}},
+		{`{"definitions":{"a~/b":{"type":"string"}},"items":{"$ref":"#/definitions/a~0~1b"}}`, []string{`["x"]`}, []string{`[1]`}},
+		{`{"prefixItems":[{"type":"integer"}],"items":{"$ref":"#/prefixItems/0"}}`, []string{`[1,2]`}, []string{`[1,"2"]`}},
+	} {
+		schema, err := compileJSONSchema(json.RawMessage(test.schema))
+		if err != nil {
+			t.Errorf("%s: %v", test.schema, err)
+			continue
+		}
+		for _, value := range test.valid {
+			decoded, _ := decodeJSON([]byte(value))
+			if err := schema.Validate(decoded); err != nil {
+				t.Errorf("%s: %s: %v", test.schema, value, err)
+			}
+		}
+		for _, value := range test.errors {
+			decoded, _ := decodeJSON([]byte(value))
+			if schema.Validate(decoded) == nil {
+				t.Errorf("%s: %s is valid", test.schema, value)
+			}
+		}
+	}
+}
+
+func TestJSONSchemaErrorPath(t *testing.T) {
+	schema, err := compileJSONSchema(json.RawMessage(`{"properties":{"items":{"items":{"required":["name"]}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := decodeJSON([]byte(`{"items":[{"name":1},{},{}]}`))
+	if err := schema.Validate(value); err == nil || !strings.HasPrefix(err.Error(), "$.items[1]: ") {
+		t.Errorf("error %v, want one at $.items[1]", err)
+	}
+}
+
+func TestJSONSchemaRefs(t *testing.T) {
+	// A recursive schema checks values of any depth
+	list, err := compileJSONSchema(json.RawMessage(`{"$defs":{"node":{"type":"object","required":["value"],"properties":{"value":{"type":"integer"},"next":{"$ref":"#/$defs/node"}}}},"$ref":"#/$defs/node"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep := `{"value":0}`
+	for i := 0; i < 2*maxRefDepth; i++ {
+		deep = `{"value":1,"next":` + deep + `}`
+	}
+	for value, valid := range map[string]bool{
+		deep:                                 true,
+		`{"value":1,"next":{"value":"two"}}`: false,
+		`{"value":1,"next":{}}`:              false,
+	} {
+		decoded, _ := decodeJSON([]byte(value))
+		if err := list.Validate(decoded); (err == nil) != valid {
+			t.Errorf("%.40s: %v", value, err)
+		}
+	}
+
+	// References that never descend into the value fail instead of looping
+	for _, cycle := range []string{
+		`{"$ref":"#"}`,
+		`{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"$ref":"#/$defs/a"}},"$ref":"#/$defs/a"}`,
+	} {
+		schema, err := compileJSONSchema(json.RawMessage(cycle))
+		if err != nil {
+			t.Fatalf("%s: %v", cycle, err)
+		}
+		if err := schema.Validate("x"); err == nil || !strings.Contains(err.Error(), "nested too deep") {
+			t.Errorf("%s: %v", cycle, err)
+		}
+	}
+}
+
+func TestCompileJSONSchemaErrors(t *testing.T) {
+	for schema, want := range map[string]string{
+		`{"type":"text"}`:                       `#/type: unknown type "text"`,
+		`{"type":["string",1]}`:                 "#/type: unknown type 1",
+		`{"properties":{"a":{"type":1}}}`:       "#/properties/a/type: must be a string",
+		`{"items":{"pattern":"(?=a)"}}`:         "#/items/pattern: unsupported regular expression",
+		`{"minLength":"1"}`:                     "#/minLength: must be a number",
+		`{"required":"a"}`:                      "#/required: must be an array of strings",
+		`{"anyOf":{}}`:                          "#/anyOf: must be an array",
+		`{"oneOf":[{"not":3}]}`:                 "#/oneOf/0/not: a schema must be an object or a boolean",
+		`{"$ref":"#/$defs/missing"}`:            `#/$ref: "#/$defs/missing" does not exist`,
+		`{"$ref":"https://example.com/s.json"}`: "#/$ref: only local references are supported",
+		`{"type":"string"} {"type":"string"}`:   "invalid JSON",
+		`["type"]`:                              "#: a schema must be an object or a boolean",
+	} {
+		_, err := compileJSONSchema(json.RawMessage(schema))
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", schema, err, want)
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	for reply, want := range map[string]string{
+		` {"a": 1} `:                             `{"a": 1}`,
+		"Here you go:\n```json\n[1, 2]\n```\n":   "[1, 2]",
+		`Sure! {"a": {"b": "}"}} Hope it helps.`: `{"a": {"b": "}"}}`,
+		`"just a string"`:                        `"just a string"`,
+	} {
+		text, _, err := extractJSON(reply)
+		if err != nil || text != want {
+			t.Errorf("%q: got %q, %v, want %q", reply, text, err, want)
+		}
+	}
+	for _, reply := range []string{"no json here", `{"a": 1`, "```json\n{'a': 1}\n```"} {
+		if _, _, err := extractJSON(reply); err == nil || !strings.HasPrefix(err.Error(), "the reply is not valid JSON") {
+			t.Errorf("%q: error %v", reply, err)
+		}
+	}
+}
+
+func TestCheckStructuredReply(t *testing.T) {
+	object := APIRequest{ResponseFormat: &responseFormat{Type: "json_object"}}
+	if _, err := object.checkStructuredReply(`[1]`); err == nil {
+		t.Error("json_object accepted an array")
+	}
+	schema, _ := compileJSONSchema(json.RawMessage(`{"type":"array","items":{"type":"integer"}}`))
+	request := APIRequest{ResponseFormat: &responseFormat{Type: "json_schema", JSONSchema: &jsonSchemaFormat{Name: "numbers"}}, schema: schema}
+	if text, err := request.checkStructuredReply("```\n[1, 2]\n```"); err != nil || text != "[1, 2]" {
+		t.Errorf("valid reply: %q, %v", text, err)
+	}
+	_, err := request.checkStructuredReply(`[1, "2"]`)
+	if err == nil || err.Error() != "$[1]: expected integer, got string" {
+		t.Fatalf("invalid reply: %v", err)
+	}
+	if prompt := repairPrompt(request, err); !strings.Contains(prompt, err.Error()) || !strings.Contains(prompt, "JSON schema numbers") {
+		t.Errorf("repair prompt %q", prompt)
+	}
+}
+
+const numbersRequest = `{"model":"gpt-4","messages":[{"role":"user","content":"count"}],"response_format":{"type":"json_schema","json_schema":{"name":"numbers","schema":{"type":"object","required":["n"],"properties":{"n":{"type":"integer"}},"additionalProperties":false}}}}`
+
+func TestChatCompletionJSONSchema(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", "```json\n{\"n\": 3}\n```", "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, numbersRequest)
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil || recorder.Code != 200 {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if content := completion.Choices[0].Message.Content; content == nil || *content != `{"n": 3}` {
+		t.Errorf("got %s", recorder.Body)
+	}
+	requests := upstream.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("upstream got %d requests", len(requests))
+	}
+	if prompt, _ := requests[0].Messages[0].Content.Parts[0].(string); !strings.Contains(prompt, "JSON schema numbers") || !strings.Contains(prompt, `"additionalProperties":false`) {
+		t.Errorf("schema not sent in %q", prompt)
+	}
+}
+
+func TestChatCompletionJSONSchemaRepair(t *testing.T) {
+	upstream := NewFakeUpstream(
+		FakeReply{Body: SSEBody(snapshot("m1", `{"n": "three"}`, "stop"), "[DONE]")},
+		FakeReply{Body: SSEBody(snapshot("m2", `{"n": 3}`, "stop"), "[DONE]")},
+	)
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, numbersRequest)
+	var completion ChatCompletion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &completion); err != nil || recorder.Code != 200 {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if content := completion.Choices[0].Message.Content; content == nil || *content != `{"n": 3}` {
+		t.Errorf("got %s", recorder.Body)
+	}
+	requests := upstream.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("upstream got %d requests", len(requests))
+	}
+	if prompt, _ := requests[1].Messages[0].Content.Parts[0].(string); !strings.Contains(prompt, "$.n: expected integer, got string") {
+		t.Errorf("repair prompt %q", prompt)
+	}
+}
+
+func TestChatCompletionJSONSchemaRepairFails(t *testing.T) {
+	upstream := NewFakeUpstream(FakeReply{Body: SSEBody(snapshot("m1", `{"n": "three"}`, "stop"), "[DONE]")})
+	router, key := testGateway(t, upstream)
+
+	recorder := postChat(t, router, key, numbersRequest)
+	var response struct {
+		Error struct {
+			Param string `json:"param"`
+			Code  string `json:"code"`
+		} `json:"error"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if recorder.Code != 502 || response.Error.Code != "response_format_mismatch" || response.Error.Param != "response_format" {
+		t.Errorf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	if requests := upstream.Requests(); len(requests) != 1+config.ResponseFormat.RepairAttempts {
+		t.Errorf("upstream got %d requests, want %d", len(requests), 1+config.ResponseFormat.RepairAttempts)
+	}
+}
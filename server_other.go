@@ -9,10 +9,11 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func initServer(address string, router *gin.Engine) server {
+func initServer(address string, cfg ServerConfig, router *gin.Engine) server {
 	s := endless.NewServer(address, router)
-	s.ReadHeaderTimeout = 1800 * time.Second
-	s.WriteTimeout = 1800 * time.Second
-	s.MaxHeaderBytes = 1 << 20
+	s.ReadTimeout = time.Duration(cfg.ReadTimeout)
+	s.ReadHeaderTimeout = time.Duration(cfg.ReadHeaderTimeout)
+	s.WriteTimeout = time.Duration(cfg.WriteTimeout)
+	s.MaxHeaderBytes = cfg.MaxHeaderBytes
 	return s
 }
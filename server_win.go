@@ -10,12 +10,13 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func initServer(address string, router *gin.Engine) server {
+func initServer(address string, cfg ServerConfig, router *gin.Engine) server {
 	return &http.Server{
-		Addr:           address,
-		Handler:        router,
-		ReadTimeout:    1800 * time.Second,
-		WriteTimeout:   1800 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              address,
+		Handler:           router,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
 	}
 }
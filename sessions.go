@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	tlsclient "github.com/bogdanfinn/tls-client"
+)
+
+// session is the upstream client of one credential. Each session has its own
+// cookie jar and is bound to the proxy the credential is pinned to, so
+// nothing set by the backend for one account is ever sent on behalf of
+// another.
+type session struct {
+	client   tlsclient.HttpClient
+	proxy    string
+	lastUsed time.Time
+}
+
+// sessionManager creates sessions lazily, one per credential, and drops
+// them after sessions.idle_timeout without use.
+type sessionManager struct {
+	cfg      ClientConfig
+	proxies  *proxyPool
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionManager(cfg ClientConfig, proxies *proxyPool) *sessionManager {
+	return &sessionManager{cfg: cfg, proxies: proxies, sessions: map[string]*session{}}
+}
+
+// sessionKey identifies the account a credential belongs to without keeping
+// the access token itself as a map key.
+func (c Credential) sessionKey() string {
+	return hashAPIKey(c.PUID + "\x00" + c.AccessToken + "\x00" + c.BaseURL)
+}
+
+// Client returns the client of cred's session and the proxy it goes
+// through, creating the session on first use. If the pinned proxy changed,
+// because it failed or is in avoid, the session moves to the new proxy and
+// keeps its cookies.
+func (m *sessionManager) Client(cred Credential, avoid map[string]bool) (tlsclient.HttpClient, string, error) {
+	key := cred.sessionKey()
+	proxy := m.proxies.Pick(key, avoid)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[key]
+	if !ok || s.proxy != proxy {
+		client, err := newClient(m.cfg, proxy)
+		if err != nil {
+			return nil, "", err
+		}
+		if ok {
+			client.SetCookieJar(s.client.GetCookieJar())
+			s.client.CloseIdleConnections()
+		}
+		s = &session{client: client, proxy: proxy}
+		m.sessions[key] = s
+	}
+	s.lastUsed = time.Now()
+	return s.client, proxy, nil
+}
+
+// evictIdle closes the sessions unused for longer than idle. Responses
+// still being read keep working, only idle connections are closed.
+func (m *sessionManager) evictIdle(idle time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, s := range m.sessions {
+		if time.Since(s.lastUsed) > idle {
+			s.client.CloseIdleConnections()
+			delete(m.sessions, key)
+			m.proxies.Unpin(key)
+		}
+	}
+}
+
+// run evicts idle sessions until the process exits.
+func (m *sessionManager) run(idle time.Duration) {
+	interval := idle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		time.Sleep(interval)
+		m.evictIdle(idle)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tlsclient "github.com/bogdanfinn/tls-client"
+)
+
+func TestSessionsPerCredential(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Proxies.List = []string{"http://127.0.0.1:1", "http://127.0.0.1:2", "http://127.0.0.1:3"}
+	pool := newProxyPool(cfg)
+	sessions := newSessionManager(cfg.Client, pool)
+
+	const users, calls = 40, 25
+	creds := make([]Credential, users)
+	for i := range creds {
+		creds[i] = Credential{AccessToken: fmt.Sprintf("token-%d", i), PUID: fmt.Sprintf("user-%d", i)}
+	}
+	clients := make([]tlsclient.HttpClient, users)
+	proxies := make([]string, users)
+
+	stop := make(chan struct{})
+	evicted := make(chan struct{})
+	go func() {
+		defer close(evicted)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				sessions.evictIdle(time.Hour)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := range creds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < calls; n++ {
+				client, proxy, err := sessions.Client(creds[i], nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n == 0 {
+					clients[i], proxies[i] = client, proxy
+					continue
+				}
+				if client != clients[i] {
+					t.Errorf("user %d got a new client on call %d", i, n)
+					return
+				}
+				if proxy != proxies[i] {
+					t.Errorf("user %d moved from proxy %s to %s", i, proxies[i], proxy)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-evicted
+	if t.Failed() {
+		return
+	}
+
+	// Every credential has a jar of its own
+	backend, _ := url.Parse("https://chat.openai.com/")
+	clients[0].GetCookieJar().SetCookies(backend, []*http.Cookie{{Name: "session", Value: "user-0"}})
+	for i := 1; i < users; i++ {
+		if clients[i] == clients[0] || clients[i].GetCookieJar() == clients[0].GetCookieJar() {
+			t.Fatalf("user %d shares the session of user 0", i)
+		}
+		if cookies := clients[i].GetCookieJar().Cookies(backend); len(cookies) != 0 {
+			t.Fatalf("user %d sees cookies %v of user 0", i, cookies)
+		}
+	}
+
+	// An idle session is closed and rebuilt on the next request
+	time.Sleep(time.Millisecond)
+	sessions.evictIdle(0)
+	client, _, err := sessions.Client(creds[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == clients[0] {
+		t.Error("evicted session was reused")
+	}
+	if cookies := client.GetCookieJar().Cookies(backend); len(cookies) != 0 {
+		t.Errorf("rebuilt session kept cookies %v", cookies)
+	}
+}
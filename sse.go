@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrStreamTruncated means the upstream closed the stream before it was complete.
+	ErrStreamTruncated = errors.New("upstream stream truncated")
+	// ErrStreamMalformed means an upstream event could not be decoded.
+	ErrStreamMalformed = errors.New("upstream stream malformed")
+	// ErrStreamRewritten means the upstream changed text that was already streamed.
+	ErrStreamRewritten = errors.New("upstream rewrote streamed text")
+)
+
+// StreamError is returned when the upstream conversation stream is truncated,
+// malformed or rewritten. Use errors.Is with ErrStreamTruncated,
+// ErrStreamMalformed or ErrStreamRewritten to tell them apart.
+type StreamError struct {
+	Kind error
+	// Data is the offending event payload, if any.
+	Data string
+	Err  error
+}
+
+func (e *StreamError) Error() string {
+	msg := e.Kind.Error()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.Data != "" {
+		data := e.Data
+		if len(data) > 200 {
+			data = data[:200] + "..."
+		}
+		msg += fmt.Sprintf(" (data: %q)", data)
+	}
+	return msg
+}
+
+func (e *StreamError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// SSEEvent is one dispatched server-sent event.
+type SSEEvent struct {
+	// Event is the event type, empty for the default "message" type.
+	Event string
+	// ID is the last event id seen on the stream.
+	ID string
+	// Data is the event payload, multiple data lines joined with "\n".
+	Data string
+	// Retry is the reconnection time requested by the server, zero if unset.
+	Retry time.Duration
+}
+
+// SSEDecoder reads events from a text/event-stream body following the
+// WHATWG server-sent events parsing rules: CR, LF and CRLF line endings,
+// comments, multi-line data and the event, id and retry fields.
+type SSEDecoder struct {
+	reader *bufio.Reader
+	lastID string
+	line   bytes.Buffer
+}
+
+func NewSSEDecoder(r io.Reader) *SSEDecoder {
+	return &SSEDecoder{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next event. It returns io.EOF when the stream ends on an
+// event boundary and a *StreamError when it ends in the middle of an event.
+func (d *SSEDecoder) Next() (*SSEEvent, error) {
+	var (
+		event   SSEEvent
+		data    strings.Builder
+		hasData bool
+		pending bool
+	)
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			if err == io.EOF && !pending && len(line) == 0 {
+				return nil, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, &StreamError{Kind: ErrStreamTruncated, Data: data.String(), Err: err}
+		}
+		if len(line) == 0 {
+			// Blank line dispatches the event, events without data are dropped
+			if !hasData {
+				event = SSEEvent{}
+				pending = false
+				continue
+			}
+			event.ID = d.lastID
+			event.Data = data.String()
+			return &event, nil
+		}
+		pending = true
+		if line[0] == ':' {
+			// Comment
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				event.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// readLine returns the next line without its terminator. A final line that
+// is not terminated is returned together with io.EOF.
+func (d *SSEDecoder) readLine() (string, error) {
+	d.line.Reset()
+	for {
+		b, err := d.reader.ReadByte()
+		if err != nil {
+			return d.line.String(), err
+		}
+		switch b {
+		case '\n':
+			return d.line.String(), nil
+		case '\r':
+			if next, err := d.reader.Peek(1); err == nil && next[0] == '\n' {
+				_, _ = d.reader.ReadByte()
+			}
+			return d.line.String(), nil
+		}
+		d.line.WriteByte(b)
+	}
+}
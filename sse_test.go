@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEDecoder(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		stream string
+		want   []SSEEvent
+		// truncated is set when the stream must end in ErrStreamTruncated
+		truncated bool
+	}{
+		{
+			name:   "lf",
+			stream: "event: delta\ndata: one\n\ndata: two\n\n",
+			want:   []SSEEvent{{Event: "delta", Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:   "crlf",
+			stream: "event: delta\r\ndata: one\r\n\r\ndata: two\r\n\r\n",
+			want:   []SSEEvent{{Event: "delta", Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:   "bare cr",
+			stream: "event: delta\rdata: one\r\rdata: two\r\r",
+			want:   []SSEEvent{{Event: "delta", Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:   "mixed line endings",
+			stream: "data: one\r\n\rdata: two\n\r\n",
+			want:   []SSEEvent{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:   "comments",
+			stream: ": ping\n\ndata: one\n: keep-alive\ndata: two\n\n:\n\n",
+			want:   []SSEEvent{{Data: "one\ntwo"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: {\"a\":\ndata:1}\ndata\n\n",
+			want:   []SSEEvent{{Data: "{\"a\":\n1}\n"}},
+		},
+		{
+			name:   "only the first space is stripped",
+			stream: "data:  two spaces\n\n",
+			want:   []SSEEvent{{Data: " two spaces"}},
+		},
+		{
+			name:   "id and retry",
+			stream: "id: 1\nretry: 1500\ndata: one\n\ndata: two\n\nid\nretry: soon\ndata: three\n\n",
+			want: []SSEEvent{
+				{ID: "1", Retry: 1500 * time.Millisecond, Data: "one"},
+				{ID: "1", Data: "two"},
+				{Data: "three"},
+			},
+		},
+		{
+			name:   "id with nul is ignored",
+			stream: "id: 1\ndata: one\n\nid: 2\x00\ndata: two\n\n",
+			want:   []SSEEvent{{ID: "1", Data: "one"}, {ID: "1", Data: "two"}},
+		},
+		{
+			name:   "events without data are dropped",
+			stream: "event: ping\n\ndata: one\n\n",
+			want:   []SSEEvent{{Data: "one"}},
+		},
+		{
+			name:      "truncated in an event",
+			stream:    "data: one\n\ndata: tw",
+			want:      []SSEEvent{{Data: "one"}},
+			truncated: true,
+		},
+		{
+			name:      "truncated before the blank line",
+			stream:    "data: one\n",
+			truncated: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewSSEDecoder(strings.NewReader(test.stream))
+			var got []SSEEvent
+			var err error
+			for {
+				var event *SSEEvent
+				if event, err = decoder.Next(); err != nil {
+					break
+				}
+				got = append(got, *event)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("events %+v, want %+v", got, test.want)
+			}
+			if !test.truncated {
+				if err != io.EOF {
+					t.Errorf("stream ended with %v, want io.EOF", err)
+				}
+				return
+			}
+			var streamErr *StreamError
+			if !errors.As(err, &streamErr) || !errors.Is(err, ErrStreamTruncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("stream ended with %v, want a truncated StreamError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// responseStream decodes the upstream conversation stream into message
+// snapshots, for both the snapshot and the delta_encoding protocol.
+type responseStream struct {
+	decoder  *SSEDecoder
+	response ChatGPTResponse
+	// state is only used when the upstream streams delta_encoding frames
+	state *messageState
+}
+
+func newResponseStream(body io.Reader) *responseStream {
+	return &responseStream{decoder: NewSSEDecoder(body)}
+}
+
+// Next returns the current snapshot after the next upstream update. It
+// returns io.EOF once [DONE] is received, a *StreamError if the stream
+// breaks and an *UpstreamError if the upstream reports one.
+func (s *responseStream) Next() (*ChatGPTResponse, error) {
+	for {
+		event, err := s.decoder.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, &StreamError{Kind: ErrStreamTruncated, Err: errors.New("missing [DONE]")}
+			}
+			return nil, err
+		}
+		switch {
+		case event.Data == "[DONE]":
+			return nil, io.EOF
+		case event.Event == "delta_encoding":
+			// Announces the protocol version, e.g. "v1"
+			s.state = newMessageState()
+			continue
+		case event.Event == "delta" || s.state != nil && isDeltaFrame(event.Data):
+			if s.state == nil {
+				s.state = newMessageState()
+			}
+			if err = s.state.Apply([]byte(event.Data)); err != nil {
+				return nil, &StreamError{Kind: ErrStreamMalformed, Data: event.Data, Err: err}
+			}
+			s.response, err = s.state.Response()
+			if err != nil {
+				return nil, &StreamError{Kind: ErrStreamMalformed, Data: event.Data, Err: err}
+			}
+		case event.Event == "" || event.Event == "message":
+			// Parse the event as a full snapshot. Events such as moderation
+			// or title updates carry no message, none of the previous one
+			// may be left over
+			var response ChatGPTResponse
+			if err = json.Unmarshal([]byte(event.Data), &response); err != nil {
+				return nil, &StreamError{Kind: ErrStreamMalformed, Data: event.Data, Err: err}
+			}
+			s.response = response
+		default:
+			continue
+		}
+		if s.response.Error != nil {
+			return nil, &UpstreamError{Detail: s.response.Error}
+		}
+		return &s.response, nil
+	}
+}
+
+// isDeltaFrame reports whether an event without a name carries a delta
+// operation rather than a full snapshot or a status object.
+func isDeltaFrame(data string) bool {
+	var frame map[string]json.RawMessage
+	if json.Unmarshal([]byte(data), &frame) != nil {
+		return false
+	}
+	_, hasValue := frame["v"]
+	_, hasMessage := frame["message"]
+	return hasValue && !hasMessage
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestResponseStreamDropsStaleMessages(t *testing.T) {
+	body := SSEBody(
+		snapshot("m1", "Hello", "stop"),
+		`{"type":"moderation","conversation_id":"conv-1","moderation_response":{"flagged":false}}`,
+		`{"type":"title_generation","title":"Greeting","conversation_id":"conv-1"}`,
+		"[DONE]",
+	)
+	responses := newResponseStream(strings.NewReader(body))
+	var ids []string
+	for {
+		next, err := responses.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, next.Message.ID+":"+next.Message.Content.Text())
+	}
+	if len(ids) != 3 || ids[0] != "m1:Hello" || ids[1] != ":" || ids[2] != ":" {
+		t.Errorf("messages %q, want the snapshot then two without a message", ids)
+	}
+}
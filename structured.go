@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// usesResponseFormat reports whether the reply must be JSON.
+func (r *APIRequest) usesResponseFormat() bool {
+	return r.ResponseFormat != nil && r.ResponseFormat.Type != "text"
+}
+
+// mentionsJSON reports whether any message asks for JSON, which OpenAI
+// requires for json_object so the model is not left guessing.
+func (r *APIRequest) mentionsJSON() bool {
+	for _, message := range r.Messages {
+		if strings.Contains(strings.ToLower(message.Content.Text()), "json") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseFormatPrompt tells the model the format its reply must have, ""
+// for plain text.
+func responseFormatPrompt(r APIRequest) string {
+	if !r.usesResponseFormat() {
+		return ""
+	}
+	const bare = "Do not wrap it in a code block and do not write anything before or after it."
+	format := r.ResponseFormat.JSONSchema
+	if r.ResponseFormat.Type == "json_object" || format == nil || len(format.Schema) == 0 {
+		return "Reply only with a single valid JSON object. " + bare
+	}
+	prompt := "Reply only with a single valid JSON value conforming to the JSON schema " + format.Name
+	if format.Description != "" {
+		prompt += " (" + format.Description + ")"
+	}
+	return prompt + " below. " + bare + "\n" + string(format.Schema)
+}
+
+// repairPrompt asks the model to correct a reply that failed
+// checkStructuredReply.
+func repairPrompt(r APIRequest, err error) string {
+	prompt := "Your previous reply is not valid: " + err.Error() + ". Reply again with only the corrected JSON"
+	if r.schema != nil {
+		prompt += ", conforming to the JSON schema " + r.ResponseFormat.JSONSchema.Name
+	}
+	return prompt + ", nothing else."
+}
+
+// extractJSON finds the JSON value of a reply, tolerating code fences and
+// text around it.
+func extractJSON(reply string) (string, interface{}, error) {
+	candidates := []string{strings.TrimSpace(reply)}
+	for _, match := range fencedBlock.FindAllStringSubmatch(reply, -1) {
+		candidates = append(candidates, strings.TrimSpace(match[1]))
+	}
+	candidates = append(candidates, jsonObjects(reply)...)
+	var firstErr error
+	for _, candidate := range candidates {
+		value, err := decodeJSON([]byte(candidate))
+		if err == nil {
+			return candidate, value, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", nil, fmt.Errorf("the reply is not valid JSON (%v)", firstErr)
+}
+
+// checkStructuredReply returns the JSON of a reply, or why it does not
+// satisfy response_format.
+func (r *APIRequest) checkStructuredReply(reply string) (string, error) {
+	text, value, err := extractJSON(reply)
+	if err != nil {
+		return "", err
+	}
+	if r.ResponseFormat.Type == "json_object" {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "", errors.New("the reply must be a JSON object")
+		}
+	}
+	if r.schema != nil {
+		if err := r.schema.Validate(value); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+// holdAll holds back the whole reply, it can only be sent once checked.
+func holdAll(string) int {
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// The chat models count tokens with cl100k_base. Its ranks are embedded in
+// the binary so counting never downloads anything.
+const tokenEncoding = "cl100k_base"
+
+// Per the OpenAI cookbook every message is wrapped in
+// <|start|>{role}\n{content}<|end|>\n, a name costs one more token and the
+// reply is primed with <|start|>assistant<|message|>.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+var (
+	encodingOnce sync.Once
+	encoding     *tiktoken.Tiktoken
+)
+
+func tokenizer() *tiktoken.Tiktoken {
+	encodingOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+		var err error
+		encoding, err = tiktoken.GetEncoding(tokenEncoding)
+		if err != nil {
+			fmt.Println("Error loading tokenizer: ", err)
+		}
+	})
+	return encoding
+}
+
+// countTokens returns the number of cl100k_base tokens in text. Special
+// tokens are counted as plain text, as the upstream would see them.
+func countTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	enc := tokenizer()
+	if enc == nil {
+		return 0
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// countPromptTokens counts messages the way the API bills a chat prompt.
+func countPromptTokens(messages []apiMessage) int {
+	tokens := tokensPerReply
+	for _, message := range messages {
+		tokens += tokensPerMessage + countTokens(message.Role) + countTokens(message.Content.Text())
+		if len(message.ToolCalls) > 0 {
+			tokens += countTokens(toolCallsText(message.ToolCalls))
+		}
+		if message.Name != "" {
+			tokens += tokensPerName + countTokens(message.Name)
+		}
+	}
+	return tokens
+}
+
+func newUsage(promptTokens, completionTokens int) usage {
+	return usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCountTokens(t *testing.T) {
+	// Known cl100k_base encodings, a wrong or empty embedded table breaks
+	// them
+	for text, want := range map[string][]int{
+		"Hello":                        {9906},
+		"hello world":                  {15339, 1917},
+		"tiktoken is great!":           {83, 1609, 5963, 374, 2294, 0},
+		"You are a helpful assistant.": {2675, 527, 264, 11190, 18328, 13},
+		"你好":                           {57668, 53901},
+	} {
+		if got := tokenizer().EncodeOrdinary(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q encodes to %v, want %v", text, got, want)
+		}
+		if got := countTokens(text); got != len(want) {
+			t.Errorf("%q counts %d tokens, want %d", text, got, len(want))
+		}
+	}
+	if got := countTokens(""); got != 0 {
+		t.Errorf("empty text counts %d tokens", got)
+	}
+}
+
+func TestCountPromptTokens(t *testing.T) {
+	text := func(s string) messageContent { return messageContent{{Type: "text", Text: s}} }
+	messages := []apiMessage{
+		{Role: "system", Content: text("You are a helpful assistant.")},
+		{Role: "user", Name: "example_user", Content: text("Hello")},
+	}
+	// 3 to prime the reply, 3 per message, then role and content: system
+	// (1) + 6 and user (1) + 1, and 1 + 2 for the name
+	if got := countPromptTokens(messages); got != 21 {
+		t.Errorf("prompt counts %d tokens, want 21", got)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenClaims is what the gateway reads from an upstream access token. The
+// signature is not verified, the upstream does that; the claims are only
+// used to fail fast and to report expiry.
+type tokenClaims struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	IssuedAt  time.Time `json:"issued_at"`
+	UserID    string    `json:"user_id,omitempty"`
+	AccountID string    `json:"account_id,omitempty"`
+	Plan      string    `json:"plan,omitempty"`
+	Email     string    `json:"email,omitempty"`
+}
+
+// jwtPayload covers the claims of the web backend's access tokens.
+type jwtPayload struct {
+	Exp  int64 `json:"exp"`
+	Iat  int64 `json:"iat"`
+	Auth struct {
+		UserID         string `json:"user_id"`
+		AccountID      string `json:"chatgpt_account_id"`
+		PlanType       string `json:"chatgpt_plan_type"`
+		OrganizationID string `json:"poid"`
+	} `json:"https://api.openai.com/auth"`
+	Profile struct {
+		Email string `json:"email"`
+	} `json:"https://api.openai.com/profile"`
+}
+
+var errTokenMalformed = errors.New("access token is not a valid JWT")
+
+// Token metrics, served with the other expvars on /admin/metrics.
+var (
+	tokensRejected  = expvar.NewInt("tokens_rejected_expired")
+	tokensExpiresIn = expvar.NewMap("tokens_expires_in_seconds")
+)
+
+func parseAccessToken(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errTokenMalformed
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return tokenClaims{}, errTokenMalformed
+	}
+	var payload jwtPayload
+	if err = json.Unmarshal(data, &payload); err != nil {
+		return tokenClaims{}, errTokenMalformed
+	}
+	if payload.Exp == 0 {
+		return tokenClaims{}, fmt.Errorf("%w: missing exp claim", errTokenMalformed)
+	}
+	claims := tokenClaims{
+		ExpiresAt: time.Unix(payload.Exp, 0),
+		UserID:    payload.Auth.UserID,
+		AccountID: payload.Auth.AccountID,
+		Plan:      payload.Auth.PlanType,
+		Email:     payload.Profile.Email,
+	}
+	if payload.Iat != 0 {
+		claims.IssuedAt = time.Unix(payload.Iat, 0)
+	}
+	if claims.AccountID == "" {
+		claims.AccountID = payload.Auth.OrganizationID
+	}
+	return claims, nil
+}
+
+// ExpiresIn is the time left before the token expires, negative once expired.
+func (t tokenClaims) ExpiresIn() time.Duration {
+	return time.Until(t.ExpiresAt)
+}
+
+// Status is "expired", "expiring" within tokens.warn_before, or "valid".
+func (t tokenClaims) Status() string {
+	switch left := t.ExpiresIn(); {
+	case left <= 0:
+		return "expired"
+	case left <= time.Duration(config.Tokens.WarnBefore):
+		return "expiring"
+	default:
+		return "valid"
+	}
+}
+
+// checkAccessToken rejects tokens that are malformed or already expired
+// before anything is sent upstream.
+func checkAccessToken(c *gin.Context, token string) bool {
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		invalidAPIKey(c, "Incorrect upstream access token: "+err.Error())
+		return false
+	}
+	if claims.Status() == "expired" {
+		tokensRejected.Add(1)
+		invalidAPIKey(c, fmt.Sprintf("The upstream access token expired at %s, please refresh it", claims.ExpiresAt.UTC().Format(time.RFC3339)))
+		return false
+	}
+	return true
+}
+
+type tokenView struct {
+	KeyID string `json:"key_id,omitempty"`
+	// Account is set instead of KeyID for the tokens of the account pool.
+	Account   string      `json:"account,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	PUID      string      `json:"puid"`
+	Claims    tokenClaims `json:"claims"`
+	ExpiresIn int64       `json:"expires_in"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// inspect fills in the claims and status of token.
+func (t *tokenView) inspect(token string) {
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		t.Status = "invalid"
+		t.Error = err.Error()
+		return
+	}
+	t.Claims = claims
+	t.ExpiresIn = int64(claims.ExpiresIn() / time.Second)
+	t.Status = claims.Status()
+}
+
+// id names the token in tokens_expires_in_seconds.
+func (t tokenView) id() string {
+	if t.Account != "" {
+		return "account:" + t.Account
+	}
+	return t.KeyID
+}
+
+func (t tokenView) owner() string {
+	if t.Account != "" {
+		return "account " + t.Account
+	}
+	return "key " + t.KeyID + " (" + t.Name + ")"
+}
+
+// storedTokens inspects the access token of every stored key. Pool keys
+// have none, they are served with the tokens of the account pool.
+func (g *gateway) storedTokens() []tokenView {
+	var views []tokenView
+	for _, key := range g.keys.List() {
+		if key.Pool {
+			continue
+		}
+		view := tokenView{KeyID: key.ID, Name: key.Name, PUID: key.PUID}
+		view.inspect(key.AccessToken)
+		views = append(views, view)
+	}
+	return views
+}
+
+// accountTokens inspects the access token of every account of the pool.
+func (g *gateway) accountTokens() []tokenView {
+	var views []tokenView
+	for _, a := range g.accounts.List() {
+		view := tokenView{Account: a.Name, PUID: a.PUID}
+		view.inspect(a.AccessToken)
+		views = append(views, view)
+	}
+	return views
+}
+
+// listTokens serves /admin/tokens, the tokens of stored keys followed by
+// those of the account pool.
+func (g *gateway) listTokens(c *gin.Context) {
+	tokens := append(g.storedTokens(), g.accountTokens()...)
+	if tokens == nil {
+		tokens = []tokenView{}
+	}
+	c.JSON(200, gin.H{"object": "list", "data": tokens})
+}
+
+// watchTokens checks the tokens every tokens.check_interval.
+func (g *gateway) watchTokens() {
+	warned := map[string]string{}
+	for {
+		g.checkTokens(warned)
+		time.Sleep(time.Duration(config.Tokens.CheckInterval))
+	}
+}
+
+// checkTokens logs the tokens of stored keys and of the account pool that
+// are about to expire or have expired, once per state change recorded in
+// warned, and keeps tokens_expires_in_seconds up to date.
+func (g *gateway) checkTokens(warned map[string]string) {
+	seen := map[string]bool{}
+	for _, token := range append(g.storedTokens(), g.accountTokens()...) {
+		id := token.id()
+		seen[id] = true
+		if token.Status != "invalid" {
+			expiresIn := new(expvar.Int)
+			expiresIn.Set(token.ExpiresIn)
+			tokensExpiresIn.Set(id, expiresIn)
+		}
+		if warned[id] == token.Status {
+			continue
+		}
+		warned[id] = token.Status
+		switch token.Status {
+		case "expiring":
+			fmt.Printf("Warning: upstream token of %s expires in %s\n", token.owner(), time.Duration(token.ExpiresIn)*time.Second)
+		case "expired":
+			fmt.Printf("Warning: upstream token of %s expired at %s\n", token.owner(), token.Claims.ExpiresAt.UTC().Format(time.RFC3339))
+		case "invalid":
+			fmt.Printf("Warning: upstream token of %s is invalid: %s\n", token.owner(), token.Error)
+		}
+	}
+	// Forget deleted keys
+	for id := range warned {
+		if !seen[id] {
+			delete(warned, id)
+			tokensExpiresIn.Delete(id)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCheckTokensCoversAccounts(t *testing.T) {
+	testConfig()
+	config.Tokens.WarnBefore = Duration(time.Hour)
+	config.Accounts.List = []AccountConfig{
+		{Name: "first", AccessToken: testAccessToken()},
+		{Name: "broken", AccessToken: "not-a-jwt"},
+	}
+	keys, _ := loadKeyStore("")
+	keyLimiter, _ := loadKeyLimiter("")
+	ledger, _ := openLedger("")
+	g := newGateway(NewFakeUpstream(), keys, keyLimiter, ledger, newProxyPool(config), newAccountPool(config.Accounts))
+	_, key, err := keys.Create("direct", Credential{AccessToken: testAccessToken()}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warned := map[string]string{}
+	g.checkTokens(warned)
+	want := map[string]string{key.ID: "valid", "account:first": "valid", "account:broken": "invalid"}
+	for id, status := range want {
+		if warned[id] != status {
+			t.Errorf("token %s: status %q, want %q", id, warned[id], status)
+		}
+	}
+	if tokensExpiresIn.Get("account:first") == nil {
+		t.Error("tokens_expires_in_seconds misses account:first")
+	}
+	if tokensExpiresIn.Get("account:broken") != nil {
+		t.Error("tokens_expires_in_seconds has the invalid token of account:broken")
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	testConfig()
+	config.Admin.Token = "admin-token"
+	config.Tokens.WarnBefore = Duration(time.Hour)
+	config.Accounts.List = []AccountConfig{{Name: "first", PUID: "user-first", AccessToken: testAccessToken()}}
+	router, _ := testRouter(t, NewFakeUpstream(), false)
+
+	recorder := getAdmin(router, "/admin/tokens")
+	var list struct {
+		Data []tokenView `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil || recorder.Code != 200 {
+		t.Fatalf("status %d, body %s", recorder.Code, recorder.Body)
+	}
+	if len(list.Data) != 2 {
+		t.Fatalf("tokens %+v, want the key's and the account's", list.Data)
+	}
+	key, account := list.Data[0], list.Data[1]
+	if key.KeyID == "" || key.Name != "test" || key.Account != "" || key.Status != "valid" {
+		t.Errorf("key token %+v", key)
+	}
+	if account.Account != "first" || account.PUID != "user-first" || account.KeyID != "" || account.Status != "valid" {
+		t.Errorf("account token %+v", account)
+	}
+	for _, token := range list.Data {
+		if token.ExpiresIn <= 0 || token.Claims.Plan != "plus" {
+			t.Errorf("token %+v: expires in %d, plan %q", token.id(), token.ExpiresIn, token.Claims.Plan)
+		}
+	}
+}
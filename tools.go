@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+)
+
+const fence = "```"
+
+// defaultToolPrompt tells the model which tools it has and how to call
+// them. It is sent as the first system message when tools are given.
+const defaultToolPrompt = `You can call the following tools. Each one is described by a JSON schema of its arguments:
+{{.Tools}}
+
+To call tools, reply with a single fenced JSON block of this form and nothing after it:
+` + fence + `json
+{"tool_calls": [{"name": "<tool name>", "arguments": {<arguments as JSON>}}]}
+` + fence + `
+{{if .Function}}You must call the tool {{.Function}}.{{else if .Required}}You must call at least one tool.{{else}}Call tools only when they are needed to answer, otherwise reply normally.{{end}}{{if not .Parallel}} Call at most one tool per reply.{{end}}
+The results of your calls will be sent back to you in the following messages.`
+
+// defaultToolResult renders a tool role message as the text sent upstream.
+const defaultToolResult = `Result of tool call {{.ID}} ({{.Name}}):
+{{.Content}}`
+
+// toolPromptData is what tools.prompt_template is executed with.
+type toolPromptData struct {
+	// Tools is the JSON array of the function definitions.
+	Tools string
+	// Function is set when tool_choice names a function.
+	Function string
+	// Required is set for tool_choice "required".
+	Required bool
+	// Parallel is false when parallel_tool_calls is false.
+	Parallel bool
+}
+
+// toolResultData is what tools.result_template is executed with.
+type toolResultData struct {
+	ID      string
+	Name    string
+	Content string
+}
+
+var (
+	toolTemplatesOnce sync.Once
+	toolPromptTmpl    *template.Template
+	toolResultTmpl    *template.Template
+)
+
+// parseToolTemplates parses the configured templates, falling back to the
+// defaults when they are empty.
+func parseToolTemplates(cfg ToolsConfig) (*template.Template, *template.Template, error) {
+	prompt, result := cfg.PromptTemplate, cfg.ResultTemplate
+	if prompt == "" {
+		prompt = defaultToolPrompt
+	}
+	if result == "" {
+		result = defaultToolResult
+	}
+	promptTmpl, err := template.New("prompt_template").Parse(prompt)
+	if err != nil {
+		return nil, nil, err
+	}
+	resultTmpl, err := template.New("result_template").Parse(result)
+	if err != nil {
+		return nil, nil, err
+	}
+	return promptTmpl, resultTmpl, nil
+}
+
+func toolTemplates() (*template.Template, *template.Template) {
+	toolTemplatesOnce.Do(func() {
+		var err error
+		toolPromptTmpl, toolResultTmpl, err = parseToolTemplates(config.Tools)
+		if err != nil {
+			// Validate rejects invalid templates, this only happens for a
+			// config that was not validated
+			fmt.Println("Error parsing tool templates: ", err)
+			toolPromptTmpl, toolResultTmpl, _ = parseToolTemplates(ToolsConfig{})
+		}
+	})
+	return toolPromptTmpl, toolResultTmpl
+}
+
+func executeTemplate(tmpl *template.Template, data interface{}) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		fmt.Println("Error executing "+tmpl.Name()+": ", err)
+	}
+	return buf.String()
+}
+
+// usesTools reports whether the model may call tools in its reply.
+func (r *APIRequest) usesTools() bool {
+	return len(r.Tools) > 0 && (r.ToolChoice == nil || r.ToolChoice.Mode != "none")
+}
+
+// parallelToolCalls reports whether the reply may call several tools.
+func (r *APIRequest) parallelToolCalls() bool {
+	return r.ParallelToolCalls == nil || *r.ParallelToolCalls
+}
+
+func (r *APIRequest) hasTool(name string) bool {
+	for _, t := range r.Tools {
+		if t.Function.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// toolsPrompt renders the tool instructions for r, "" without tools.
+func toolsPrompt(r APIRequest) string {
+	if !r.usesTools() {
+		return ""
+	}
+	functions := make([]functionDef, 0, len(r.Tools))
+	for _, t := range r.Tools {
+		functions = append(functions, t.Function)
+	}
+	schema, _ := json.MarshalIndent(functions, "", "  ")
+	data := toolPromptData{
+		Tools:    string(schema),
+		Parallel: r.parallelToolCalls(),
+	}
+	if r.ToolChoice != nil {
+		data.Required = r.ToolChoice.Mode == "required"
+		data.Function = r.ToolChoice.Function
+	}
+	prompt, _ := toolTemplates()
+	return executeTemplate(prompt, data)
+}
+
+// renderedToolCall is how a call is written in the conversation, the same
+// shape the prompt asks the model to reply with.
+type renderedToolCall struct {
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolCallsText renders the tool calls of an assistant message as text.
+func toolCallsText(calls []toolCall) string {
+	rendered := make([]renderedToolCall, 0, len(calls))
+	for _, call := range calls {
+		arguments := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(arguments) {
+			arguments, _ = json.Marshal(call.Function.Arguments)
+		}
+		rendered = append(rendered, renderedToolCall{ID: call.ID, Name: call.Function.Name, Arguments: arguments})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"tool_calls": rendered})
+	return fence + "json\n" + string(data) + "\n" + fence
+}
+
+// toolMessageText turns the messages the web backend cannot take, tool
+// results and assistant tool calls, into text. names maps tool call ids to
+// the function they called.
+func toolMessageText(message apiMessage, names map[string]string) (string, string) {
+	switch message.Role {
+	case "tool", "function":
+		name := message.Name
+		if name == "" {
+			name = names[message.ToolCallID]
+		}
+		_, result := toolTemplates()
+		return "user", executeTemplate(result, toolResultData{ID: message.ToolCallID, Name: name, Content: message.Content.Text()})
+	case "assistant":
+		calls := message.ToolCalls
+		if message.FunctionCall != nil {
+			calls = append(calls, toolCall{Type: "function", Function: *message.FunctionCall})
+		}
+		text := message.Content.Text()
+		if len(calls) > 0 {
+			if text != "" {
+				text += "\n"
+			}
+			text += toolCallsText(calls)
+		}
+		return "assistant", text
+	}
+	return message.Role, message.Content.Text()
+}
+
+// holdToolCall keeps back everything from where a tool call may start, so
+// a call is never streamed as text. Code and JSON that are clearly no call
+// are released as soon as that shows. Trailing whitespace is held too, it
+// may precede a call and extractToolCalls drops it with the call.
+func holdToolCall(text string) int {
+	for i := 0; i < len(text); i++ {
+		if strings.IndexByte("`{[", text[i]) >= 0 && mayStartToolCall(text[i:]) {
+			text = text[:i]
+			break
+		}
+	}
+	return len(strings.TrimRightFunc(text, unicode.IsSpace))
+}
+
+// toolCallKeys are the keys the JSON of a call may begin with.
+var toolCallKeys = []string{`"name"`, `"tool`, `"function"`, `"arguments"`}
+
+// mayStartToolCall reports whether text starts like a call, or is too
+// short to tell yet: a fence or a bracket followed by an object beginning
+// with one of toolCallKeys.
+func mayStartToolCall(text string) bool {
+	switch {
+	case strings.HasPrefix(text, "`"):
+		if !strings.HasPrefix(text, fence) {
+			return strings.HasPrefix(fence, text)
+		}
+		text = strings.TrimLeftFunc(text[len(fence):], unicode.IsLetter)
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		return text == "" || text[0] != '`' && mayStartToolCall(text)
+	case strings.HasPrefix(text, "["):
+		text = strings.TrimLeftFunc(text[1:], unicode.IsSpace)
+		return text == "" || text[0] == '{' && mayStartToolCall(text)
+	case strings.HasPrefix(text, "{"):
+		text = strings.TrimLeftFunc(text[1:], unicode.IsSpace)
+		for _, key := range toolCallKeys {
+			if strings.HasPrefix(text, key) || strings.HasPrefix(key, text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var fencedBlock = regexp.MustCompile("(?s)```[a-zA-Z]*\\s*\\n?(.*?)```")
+
+// trailingComma matches the commas models like to leave before a closing
+// bracket.
+var trailingComma = regexp.MustCompile(`,(\s*[}\]])`)
+
+// jsonObjects returns the balanced {...} and [...] spans of text, outermost
+// first, skipping over brackets inside strings. It makes a single pass, an
+// unclosed bracket does not hide the spans after it.
+func jsonObjects(text string) []string {
+	type span struct{ start, end int }
+	var spans []span
+	var open []int
+	inString, escaped := false, false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if ch == '\\' {
+				escaped = true
+			} else if ch == '"' {
+				inString = false
+			}
+		case ch == '"':
+			// Quotes only count within brackets, prose may have stray ones
+			inString = len(open) > 0
+		case ch == '{' || ch == '[':
+			open = append(open, i)
+		case (ch == '}' || ch == ']') && len(open) > 0:
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			// The spans found inside this one are dropped
+			for len(spans) > 0 && spans[len(spans)-1].start > start {
+				spans = spans[:len(spans)-1]
+			}
+			spans = append(spans, span{start, i + 1})
+		}
+	}
+	var objects []string
+	for _, s := range spans {
+		objects = append(objects, text[s.start:s.end])
+	}
+	return objects
+}
+
+// parsedToolCall accepts the shapes models produce for a call.
+type parsedToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+	Function  *struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// decodeToolCalls reads {"tool_calls": [...]}, a bare array of calls or a
+// single call.
+func decodeToolCalls(candidate string) []parsedToolCall {
+	candidate = trailingComma.ReplaceAllString(candidate, "$1")
+	var wrapped struct {
+		ToolCalls []parsedToolCall `json:"tool_calls"`
+	}
+	if json.Unmarshal([]byte(candidate), &wrapped) == nil && len(wrapped.ToolCalls) > 0 {
+		return wrapped.ToolCalls
+	}
+	var list []parsedToolCall
+	if json.Unmarshal([]byte(candidate), &list) == nil && len(list) > 0 {
+		return list
+	}
+	var single parsedToolCall
+	if json.Unmarshal([]byte(candidate), &single) == nil && (single.Name != "" || single.Function != nil) {
+		return []parsedToolCall{single}
+	}
+	return nil
+}
+
+// extractToolCalls finds the tool calls in a reply: a fenced JSON block or
+// else the first JSON value naming known tools. content is the reply
+// without the calls. Calls of unknown tools are dropped, and all but the
+// first unless parallel.
+func extractToolCalls(reply string, tools []tool, parallel bool) (content string, calls []toolCall) {
+	known := map[string]bool{}
+	for _, t := range tools {
+		known[t.Function.Name] = true
+	}
+	var candidates []string
+	for _, match := range fencedBlock.FindAllStringSubmatch(reply, -1) {
+		candidates = append(candidates, match[0], match[1])
+	}
+	candidates = append(candidates, jsonObjects(reply)...)
+	for i := 0; i < len(candidates); i++ {
+		source := candidates[i]
+		if strings.HasPrefix(source, fence) {
+			// The whole fenced block is removed from the content, its body
+			// is what gets decoded
+			i++
+			calls = toToolCalls(decodeToolCalls(candidates[i]), known)
+		} else {
+			calls = toToolCalls(decodeToolCalls(source), known)
+		}
+		if len(calls) > 0 {
+			// The text before the call may have been streamed already, so
+			// it is kept as is up to the whitespace holdToolCall held
+			i := strings.Index(reply, source)
+			content = strings.TrimRightFunc(reply[:i], unicode.IsSpace)
+			if after := strings.TrimSpace(reply[i+len(source):]); after != "" {
+				if content != "" {
+					content += "\n"
+				}
+				content += after
+			}
+			if !parallel {
+				calls = calls[:1]
+			}
+			return content, calls
+		}
+	}
+	return reply, nil
+}
+
+func toToolCalls(parsed []parsedToolCall, known map[string]bool) []toolCall {
+	var calls []toolCall
+	for _, p := range parsed {
+		name, arguments := p.Name, p.Arguments
+		if p.Function != nil {
+			name, arguments = p.Function.Name, p.Function.Arguments
+		}
+		if !known[name] {
+			continue
+		}
+		// Arguments may come as an object or as a string holding one
+		var text string
+		if json.Unmarshal(arguments, &text) != nil {
+			text = string(arguments)
+		}
+		if strings.TrimSpace(text) == "" {
+			text = "{}"
+		}
+		calls = append(calls, toolCall{
+			ID:       "call_" + randomID(24),
+			Type:     "function",
+			Function: functionCall{Name: name, Arguments: text},
+		})
+	}
+	return calls
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHoldToolCall(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want string
+	}{
+		{"Let me check.", "Let me check."},
+		{"Let me check.\n", "Let me check."},
+		{"Let me check.\n`", "Let me check."},
+		{"Let me check.\n```", "Let me check."},
+		{"Let me check.\n```json\n", "Let me check."},
+		{"Let me check.\n```json\n{\"too", "Let me check."},
+		{"Let me check.\n```json\n{\"tool_calls\": [{\"name\"", "Let me check."},
+		{"Let me check. {", "Let me check."},
+		{"Let me check. { \"name\": \"get_weather\"", "Let me check."},
+		{"Let me check. [{\"function\": {", "Let me check."},
+		{"Calling {\"arguments\": {}, \"name\"", "Calling"},
+		// Code and JSON that are no call stream on
+		{"Here:\n```go\nfunc main() {\n\tfmt.Println(1)", "Here:\n```go\nfunc main() {\n\tfmt.Println(1)"},
+		{"Here:\n```python\nprint(1)\n```\nDone.", "Here:\n```python\nprint(1)\n```\nDone."},
+		{"Config: {\"port\": 8080} and [1, 2]", "Config: {\"port\": 8080} and [1, 2]"},
+		{"Use `go test` to run.", "Use `go test` to run."},
+		// A closing fence may still open a new block
+		{"Here:\n```python\nprint(1)\n```", "Here:\n```python\nprint(1)"},
+	} {
+		if got := test.text[:holdToolCall(test.text)]; got != test.want {
+			t.Errorf("%q: streams %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestJSONObjects(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want []string
+	}{
+		{"none", nil},
+		{`a {"x": [1, {"y": 2}]} b [3]`, []string{`{"x": [1, {"y": 2}]}`, "[3]"}},
+		{`{"s": "} ] {"}`, []string{`{"s": "} ] {"}`}},
+		{`He said "hi". {"a": 1}`, []string{`{"a": 1}`}},
+		// Unclosed brackets keep the spans inside and after them
+		{`[see {"a": 1} and {"b": 2}`, []string{`{"a": 1}`, `{"b": 2}`}},
+		{`} ] {"a": 1} {`, []string{`{"a": 1}`}},
+		{strings.Repeat("{", 100000) + `{"a": 1}`, []string{`{"a": 1}`}},
+	} {
+		if got := jsonObjects(test.text); !reflect.DeepEqual(got, test.want) {
+			text := test.text
+			if len(text) > 40 {
+				text = text[len(text)-40:]
+			}
+			t.Errorf("%q: %q, want %q", text, got, test.want)
+		}
+	}
+}
+
+func TestExtractToolCallsParallel(t *testing.T) {
+	tools := []tool{{Type: "function", Function: functionDef{Name: "get_weather"}}}
+	reply := "Checking.\n" + `{"tool_calls": [{"name": "get_weather", "arguments": {"city": "Paris"}}, {"name": "get_weather", "arguments": {"city": "Rome"}}]}`
+	content, calls := extractToolCalls(reply, tools, true)
+	if content != "Checking." || len(calls) != 2 {
+		t.Fatalf("parallel: content %q, calls %+v", content, calls)
+	}
+	content, calls = extractToolCalls(reply, tools, false)
+	if content != "Checking." || len(calls) != 1 || calls[0].Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("not parallel: content %q, calls %+v", content, calls)
+	}
+}
@@ -1,31 +1,83 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/google/uuid"
+	"strings"
+	"time"
 )
 
+// APIRequest is the OpenAI chat completion request. Parameters the
+// gateway cannot honor are handled according to compat.mode, see
+// unsupportedParams.
 type APIRequest struct {
-	Messages  []apiMessage `json:"messages"`
-	Stream    bool         `json:"stream"`
-	Model     string       `json:"model"`
-	PluginIDs []string     `json:"plugin_ids"`
+	Model               string             `json:"model"`
+	Messages            []apiMessage       `json:"messages"`
+	Stream              bool               `json:"stream"`
+	StreamOptions       *streamOptions     `json:"stream_options"`
+	MaxTokens           *int               `json:"max_tokens"`
+	MaxCompletionTokens *int               `json:"max_completion_tokens"`
+	N                   *int               `json:"n"`
+	Stop                stopSequences      `json:"stop"`
+	Temperature         *float64           `json:"temperature"`
+	TopP                *float64           `json:"top_p"`
+	PresencePenalty     *float64           `json:"presence_penalty"`
+	FrequencyPenalty    *float64           `json:"frequency_penalty"`
+	LogitBias           map[string]float64 `json:"logit_bias"`
+	Logprobs            bool               `json:"logprobs"`
+	TopLogprobs         *int               `json:"top_logprobs"`
+	Seed                *int64             `json:"seed"`
+	Tools               []tool             `json:"tools"`
+	ToolChoice          *toolChoice        `json:"tool_choice"`
+	ParallelToolCalls   *bool              `json:"parallel_tool_calls"`
+	Functions           []functionDef      `json:"functions"`
+	FunctionCall        *toolChoice        `json:"function_call"`
+	ResponseFormat      *responseFormat    `json:"response_format"`
+	User                string             `json:"user"`
+	ServiceTier         string             `json:"service_tier"`
+	Store               *bool              `json:"store"`
+	Metadata            map[string]string  `json:"metadata"`
+	PluginIDs           []string           `json:"plugin_ids"`
+
+	// schema is response_format.json_schema.schema, compiled by validate.
+	schema *jsonSchema
+	// functions is set when the tools come from the deprecated functions.
+	functions bool
+}
+
+type streamOptions struct {
+	// IncludeUsage sends a final chunk with empty choices and the usage of
+	// the whole request before [DONE].
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type apiMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string         `json:"role"`
+	Content      messageContent `json:"content"`
+	Name         string         `json:"name,omitempty"`
+	ToolCalls    []toolCall     `json:"tool_calls,omitempty"`
+	ToolCallID   string         `json:"tool_call_id,omitempty"`
+	FunctionCall *functionCall  `json:"function_call,omitempty"`
 }
 
 type chatgptMessage struct {
-	ID      uuid.UUID      `json:"id"`
-	Author  chatgptAuthor  `json:"author"`
-	Content chatgptContent `json:"content"`
+	ID       uuid.UUID               `json:"id"`
+	Author   chatgptAuthor           `json:"author"`
+	Content  chatgptContent          `json:"content"`
+	Metadata *chatgptMessageMetadata `json:"metadata,omitempty"`
 }
 
 type chatgptContent struct {
-	ContentType string   `json:"content_type"`
-	Parts       []string `json:"parts"`
+	ContentType string `json:"content_type"`
+	// Parts holds strings, and *imageInput asset pointers for multimodal_text.
+	Parts []interface{} `json:"parts"`
+}
+
+type chatgptMessageMetadata struct {
+	Attachments []imageAttachment `json:"attachments,omitempty"`
 }
 
 type chatgptAuthor struct {
@@ -45,6 +97,9 @@ type ChatGPTRequest struct {
 	Suggestions                []string               `json:"suggestions,omitempty"`
 	ForceParagen               bool                   `json:"force_paragen,omitempty"`
 	ForceRateLimit             bool                   `json:"force_rate_limit,omitempty"`
+
+	// images are the image inputs of Messages, uploaded before sending.
+	images []*imageInput
 }
 
 func NewChatGPTRequest() ChatGPTRequest {
@@ -53,7 +108,7 @@ func NewChatGPTRequest() ChatGPTRequest {
 		//ArkoseToken:                GetArkoseToken(),
 		ParentMessageID:            uuid.NewString(),
 		Model:                      "text-davinci-002-render-sha",
-		HistoryAndTrainingDisabled: DisableHistory,
+		HistoryAndTrainingDisabled: config.DisableHistory,
 		ForceParagen:               false,
 		ForceRateLimit:             false,
 	}
@@ -62,21 +117,52 @@ func (c *ChatGPTRequest) AddMessage(role string, content string) {
 	c.Messages = append(c.Messages, chatgptMessage{
 		ID:      uuid.New(),
 		Author:  chatgptAuthor{Role: role},
-		Content: chatgptContent{ContentType: "text", Parts: []string{content}},
+		Content: chatgptContent{ContentType: "text", Parts: []interface{}{content}},
 	})
 }
 
+// AddMultimodalMessage adds a message showing images before its text.
+func (c *ChatGPTRequest) AddMultimodalMessage(role string, content string, images []*imageInput) {
+	message := chatgptMessage{
+		ID:       uuid.New(),
+		Author:   chatgptAuthor{Role: role},
+		Content:  chatgptContent{ContentType: "multimodal_text"},
+		Metadata: &chatgptMessageMetadata{},
+	}
+	for _, image := range images {
+		message.Content.Parts = append(message.Content.Parts, image)
+		message.Metadata.Attachments = append(message.Metadata.Attachments, imageAttachment{image})
+	}
+	message.Content.Parts = append(message.Content.Parts, content)
+	c.Messages = append(c.Messages, message)
+	c.images = append(c.images, images...)
+}
+
 type ChatCompletion struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Usage   usage    `json:"usage"`
-	Choices []Choice `json:"choices"`
+	ID                string   `json:"id"`
+	Object            string   `json:"object"`
+	Created           int64    `json:"created"`
+	Model             string   `json:"model"`
+	SystemFingerprint string   `json:"system_fingerprint"`
+	Usage             usage    `json:"usage"`
+	Choices           []Choice `json:"choices"`
 }
 type Msg struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role string `json:"role"`
+	// Content is null when the reply only calls tools.
+	Content   *string    `json:"content"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	// FunctionCall replaces ToolCalls for the deprecated functions.
+	FunctionCall *functionCall `json:"function_call,omitempty"`
+}
+
+// completionReply is the assistant reply of a completion once the upstream
+// is done.
+type completionReply struct {
+	Content      string
+	ToolCalls    []toolCall
+	FunctionCall *functionCall
+	FinishReason string
 }
 type Choice struct {
 	Index        int         `json:"index"`
@@ -89,12 +175,64 @@ type usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
-func NewChatCompletion(fullTest string) ChatCompletion {
+// completionMeta identifies one completion. Every chunk of a stream
+// carries the same values.
+type completionMeta struct {
+	ID                string
+	Created           int64
+	Model             string
+	SystemFingerprint string
+}
+
+func newCompletionMeta(route ResolvedRoute) completionMeta {
+	return completionMeta{
+		ID:                "chatcmpl-" + randomID(29),
+		Created:           time.Now().Unix(),
+		Model:             route.Model,
+		SystemFingerprint: systemFingerprint(route.Slug),
+	}
+}
+
+// systemFingerprint stands in for the backend configuration OpenAI reports,
+// it changes whenever requests go to another upstream model.
+func systemFingerprint(slug string) string {
+	sum := sha256.Sum256([]byte(slug))
+	return "fp_" + hex.EncodeToString(sum[:])[:10]
+}
+
+const idAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// randomID returns n random characters of the alphabet of OpenAI IDs.
+// Bytes beyond the last whole multiple of the alphabet are drawn again, so
+// every character is equally likely.
+func randomID(n int) string {
+	const limit = 256 - 256%len(idAlphabet)
+	id := make([]byte, 0, n)
+	b := make([]byte, n)
+	for len(id) < n {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		for _, c := range b {
+			if int(c) < limit && len(id) < n {
+				id = append(id, idAlphabet[int(c)%len(idAlphabet)])
+			}
+		}
+	}
+	return string(id)
+}
+
+func NewChatCompletion(meta completionMeta, reply completionReply) ChatCompletion {
+	message := Msg{Role: "assistant", ToolCalls: reply.ToolCalls, FunctionCall: reply.FunctionCall}
+	if reply.Content != "" || (len(reply.ToolCalls) == 0 && reply.FunctionCall == nil) {
+		message.Content = &reply.Content
+	}
 	return ChatCompletion{
-		ID:      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-		Object:  "chat.completion",
-		Created: int64(0),
-		Model:   "gpt-3.5-turbo-0301",
+		ID:                meta.ID,
+		Object:            "chat.completion",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
 		Usage: usage{
 			PromptTokens:     0,
 			CompletionTokens: 0,
@@ -102,20 +240,14 @@ func NewChatCompletion(fullTest string) ChatCompletion {
 		},
 		Choices: []Choice{
 			{
-				Message: Msg{
-					Content: fullTest,
-					Role:    "assistant",
-				},
-				Index: 0,
+				Message:      message,
+				Index:        0,
+				FinishReason: reply.FinishReason,
 			},
 		},
 	}
 }
 
-type StringStruct struct {
-	Text string `json:"text"`
-}
-
 type ChatGPTResponse struct {
 	Message        Message     `json:"message"`
 	ConversationID string      `json:"conversation_id"`
@@ -135,8 +267,47 @@ type Message struct {
 }
 
 type Content struct {
-	ContentType string   `json:"content_type"`
-	Parts       []string `json:"parts"`
+	ContentType string `json:"content_type"`
+	// Parts holds strings for text content and objects such as
+	// image_asset_pointer for multimodal_text content.
+	Parts []interface{} `json:"parts"`
+}
+
+// Text returns the text of the first part, "" if it is not text.
+func (c Content) Text() string {
+	if len(c.Parts) == 0 {
+		return ""
+	}
+	text, _ := c.Parts[0].(string)
+	return text
+}
+
+// ImageAssets returns the image_asset_pointer parts of multimodal content,
+// such as the images generated by DALL·E.
+func (c Content) ImageAssets() []imageAsset {
+	var assets []imageAsset
+	for _, part := range c.Parts {
+		pointer, ok := part.(map[string]interface{})
+		if !ok || pointer["content_type"] != "image_asset_pointer" {
+			continue
+		}
+		assetPointer, _ := pointer["asset_pointer"].(string)
+		fileID := assetPointer
+		if i := strings.Index(assetPointer, "://"); i >= 0 {
+			fileID = assetPointer[i+3:]
+		}
+		if fileID == "" {
+			continue
+		}
+		asset := imageAsset{FileID: fileID}
+		if metadata, ok := pointer["metadata"].(map[string]interface{}); ok {
+			if dalle, ok := metadata["dalle"].(map[string]interface{}); ok {
+				asset.RevisedPrompt, _ = dalle["prompt"].(string)
+			}
+		}
+		assets = append(assets, asset)
+	}
+	return assets
 }
 
 type Author struct {
@@ -159,11 +330,13 @@ type FinishDetails struct {
 }
 
 type ChatCompletionChunk struct {
-	ID      string    `json:"id"`
-	Object  string    `json:"object"`
-	Created int64     `json:"created"`
-	Model   string    `json:"model"`
-	Choices []Choices `json:"choices"`
+	ID                string    `json:"id"`
+	Object            string    `json:"object"`
+	Created           int64     `json:"created"`
+	Model             string    `json:"model"`
+	SystemFingerprint string    `json:"system_fingerprint"`
+	Choices           []Choices `json:"choices"`
+	Usage             *usage    `json:"usage,omitempty"`
 }
 
 func (chunk *ChatCompletionChunk) String() string {
@@ -178,16 +351,26 @@ type Choices struct {
 }
 
 type Delta struct {
-	Content string `json:"content,omitempty"`
-	Role    string `json:"role,omitempty"`
+	Content      string          `json:"content,omitempty"`
+	Role         string          `json:"role,omitempty"`
+	ToolCalls    []toolCallDelta `json:"tool_calls,omitempty"`
+	FunctionCall *functionCall   `json:"function_call,omitempty"`
 }
 
-func NewChatCompletionChunk(text string) ChatCompletionChunk {
+// toolCallDelta is a tool call in a streamed chunk. The gateway sends each
+// call whole, in a single chunk.
+type toolCallDelta struct {
+	Index int `json:"index"`
+	toolCall
+}
+
+func NewChatCompletionChunk(meta completionMeta, text string) ChatCompletionChunk {
 	return ChatCompletionChunk{
-		ID:      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-		Object:  "chat.completion.chunk",
-		Created: 0,
-		Model:   "gpt-3.5-turbo-0301",
+		ID:                meta.ID,
+		Object:            "chat.completion.chunk",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
 		Choices: []Choices{
 			{
 				Index: 0,
@@ -199,12 +382,13 @@ func NewChatCompletionChunk(text string) ChatCompletionChunk {
 		},
 	}
 }
-func StopChunk(reason string) ChatCompletionChunk {
+func StopChunk(meta completionMeta, reason string) ChatCompletionChunk {
 	return ChatCompletionChunk{
-		ID:      "chatcmpl-QXlha2FBbmROaXhpZUFyZUF3ZXNvbWUK",
-		Object:  "chat.completion.chunk",
-		Created: 0,
-		Model:   "gpt-3.5-turbo-0301",
+		ID:                meta.ID,
+		Object:            "chat.completion.chunk",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
 		Choices: []Choices{
 			{
 				Index:        0,
@@ -213,3 +397,34 @@ func StopChunk(reason string) ChatCompletionChunk {
 		},
 	}
 }
+
+// ToolCallsChunk streams the tool calls of a reply, each whole.
+func ToolCallsChunk(meta completionMeta, calls []toolCall) ChatCompletionChunk {
+	chunk := NewChatCompletionChunk(meta, "")
+	for i, call := range calls {
+		chunk.Choices[0].Delta.ToolCalls = append(chunk.Choices[0].Delta.ToolCalls, toolCallDelta{Index: i, toolCall: call})
+	}
+	return chunk
+}
+
+// FunctionCallChunk streams the function call of a reply to the deprecated
+// functions.
+func FunctionCallChunk(meta completionMeta, call functionCall) ChatCompletionChunk {
+	chunk := NewChatCompletionChunk(meta, "")
+	chunk.Choices[0].Delta.FunctionCall = &call
+	return chunk
+}
+
+// UsageChunk is the last chunk of a stream requested with
+// stream_options.include_usage.
+func UsageChunk(meta completionMeta, u usage) ChatCompletionChunk {
+	return ChatCompletionChunk{
+		ID:                meta.ID,
+		Object:            "chat.completion.chunk",
+		Created:           meta.Created,
+		Model:             meta.Model,
+		SystemFingerprint: meta.SystemFingerprint,
+		Choices:           []Choices{},
+		Usage:             &u,
+	}
+}
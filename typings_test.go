@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRandomID(t *testing.T) {
+	seen := map[string]bool{}
+	counts := map[rune]int{}
+	for i := 0; i < 4000; i++ {
+		id := randomID(31)
+		if len(id) != 31 || strings.Trim(id, idAlphabet) != "" {
+			t.Fatalf("id %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("id %q drawn twice", id)
+		}
+		seen[id] = true
+		for _, c := range id {
+			counts[c]++
+		}
+	}
+	// 2000 draws of each character expected, a byte taken modulo the
+	// alphabet draws the first 8 about 2400 times
+	for _, c := range idAlphabet {
+		if n := counts[c]; n < 1700 || n > 2300 {
+			t.Errorf("%q drawn %d times, want about 2000", c, n)
+		}
+	}
+}
+
+func TestCompletionMeta(t *testing.T) {
+	fingerprint := regexp.MustCompile(`^fp_[0-9a-f]{10}$`)
+	first := newCompletionMeta(ResolvedRoute{Model: "gpt-4", Slug: "gpt-4"})
+	second := newCompletionMeta(ResolvedRoute{Model: "gpt-4-0613", Slug: "gpt-4"})
+	other := newCompletionMeta(ResolvedRoute{Model: "gpt-3.5-turbo", Slug: "text-davinci-002-render-sha"})
+
+	if !strings.HasPrefix(first.ID, "chatcmpl-") || first.ID == second.ID {
+		t.Errorf("ids %q and %q", first.ID, second.ID)
+	}
+	if !fingerprint.MatchString(first.SystemFingerprint) {
+		t.Errorf("fingerprint %q", first.SystemFingerprint)
+	}
+	// The fingerprint follows the upstream model, not the requested name
+	if first.SystemFingerprint != second.SystemFingerprint || first.SystemFingerprint != systemFingerprint("gpt-4") {
+		t.Errorf("fingerprints %q and %q for the same upstream model", first.SystemFingerprint, second.SystemFingerprint)
+	}
+	if other.SystemFingerprint == first.SystemFingerprint {
+		t.Errorf("fingerprint %q for both upstream models", other.SystemFingerprint)
+	}
+}
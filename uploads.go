@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/gin-gonic/gin"
+)
+
+// maxImageBytes is the largest image input OpenAI accepts.
+const maxImageBytes = 20 << 20
+
+// imageFormats are the image types vision models accept, by MIME type.
+var imageFormats = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageInput is an image_url content part fetched for upload. It is
+// uploaded once for every account the conversation is sent as; FileID is
+// the upload of the current one.
+type imageInput struct {
+	Name   string
+	MIME   string
+	Data   []byte
+	Width  int
+	Height int
+	FileID string
+}
+
+// MarshalJSON renders the image as the asset pointer part of a
+// multimodal_text message.
+func (i *imageInput) MarshalJSON() ([]byte, error) {
+	pointer := map[string]interface{}{
+		"content_type":  "image_asset_pointer",
+		"asset_pointer": "file-service://" + i.FileID,
+		"size_bytes":    len(i.Data),
+	}
+	if i.Width > 0 && i.Height > 0 {
+		pointer["width"] = i.Width
+		pointer["height"] = i.Height
+	}
+	return json.Marshal(pointer)
+}
+
+// imageAttachment lists an imageInput in the message metadata, the way
+// the web client announces uploaded files.
+type imageAttachment struct {
+	*imageInput
+}
+
+func (a imageAttachment) MarshalJSON() ([]byte, error) {
+	attachment := map[string]interface{}{
+		"id":       a.FileID,
+		"name":     a.Name,
+		"size":     len(a.Data),
+		"mimeType": a.MIME,
+	}
+	if a.Width > 0 && a.Height > 0 {
+		attachment["width"] = a.Width
+		attachment["height"] = a.Height
+	}
+	return json.Marshal(attachment)
+}
+
+// decodeDataURL reads a base64 data: url.
+func decodeDataURL(raw string) ([]byte, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(raw, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return nil, errors.New("data urls must be base64 encoded")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 image data: %w", err)
+	}
+	return decoded, nil
+}
+
+// checkImageURL rejects image urls that are not http(s) before anything is
+// sent. Whether the host is public is only known once it is resolved, the
+// imageFetcher checks that when connecting.
+func checkImageURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("image urls must be http, https or base64 data urls")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicAddress(ip) {
+		return errPrivateImageURL
+	}
+	return nil
+}
+
+// loadImage fetches an image_url through the proxies, or decodes
+// it when it is a data url.
+func (g *gateway) loadImage(raw string, name string) (*imageInput, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(raw, "data:") {
+		data, err = decodeDataURL(raw)
+	} else {
+		if err = checkImageURL(raw); err != nil {
+			return nil, err
+		}
+		data, err = g.images.Fetch(raw)
+		if u, _ := url.Parse(raw); u != nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+			name = path.Base(u.Path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("images must be at most %d MB", maxImageBytes>>20)
+	}
+	mime := strings.TrimSpace(strings.Split(http.DetectContentType(data), ";")[0])
+	ext, ok := imageFormats[mime]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type %s, use png, jpeg, gif or webp", mime)
+	}
+	if path.Ext(name) == "" {
+		name += ext
+	}
+	input := &imageInput{Name: name, MIME: mime, Data: data}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		input.Width, input.Height = cfg.Width, cfg.Height
+	}
+	return input, nil
+}
+
+// loadImages loads the image_url parts of every message, indexed like
+// apiRequest.Messages. It writes the error and returns false when an image
+// cannot be used.
+func (g *gateway) loadImages(c *gin.Context, apiRequest APIRequest) ([][]*imageInput, bool) {
+	var images [][]*imageInput
+	for i, message := range apiRequest.Messages {
+		var inputs []*imageInput
+		for j, part := range message.Content {
+			if part.Type != "image_url" {
+				continue
+			}
+			input, err := g.loadImage(part.ImageURL.URL, fmt.Sprintf("image-%d-%d", i, j))
+			if err != nil {
+				invalidRequest(c, &requestError{
+					Param:   fmt.Sprintf("messages[%d].content[%d].image_url", i, j),
+					Code:    "invalid_image_url",
+					Message: "Invalid image: " + err.Error(),
+				})
+				return nil, false
+			}
+			inputs = append(inputs, input)
+		}
+		if images == nil && inputs != nil {
+			images = make([][]*imageInput, len(apiRequest.Messages))
+		}
+		if inputs != nil {
+			images[i] = inputs
+		}
+	}
+	return images, true
+}
+
+// uploadImages uploads the images of request to the files endpoint as
+// cred, setting the file ids the asset pointers refer to.
+func (g *gateway) uploadImages(request *ChatGPTRequest, cred Credential) error {
+	for _, input := range request.images {
+		fileID, err := g.upstream.UploadFile(input.Name, input.MIME, input.Data, cred)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", input.Name, err)
+		}
+		input.FileID = fileID
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+	tlsclient "github.com/bogdanfinn/tls-client"
+	"github.com/bogdanfinn/tls-client/profiles"
+	arkose "github.com/xqdoo00o/funcaptcha"
+)
+
+// Upstream sends conversation requests to a ChatGPT web backend. The returned
+// response body is the backend's SSE stream and must be closed by the caller.
+type Upstream interface {
+	// ArkoseToken fetches the arkose token required by some models.
+	ArkoseToken(cred Credential) (string, error)
+	// Conversation posts a conversation request. Closing the response body
+	// cancels the request, which stops the generation.
+	Conversation(ctx context.Context, request ChatGPTRequest, cred Credential) (*http.Response, error)
+	// Models lists the models available to the account.
+	Models(cred Credential) ([]UpstreamModel, error)
+	// FileDownloadURL resolves an uploaded or generated file to a signed url.
+	FileDownloadURL(fileID string, cred Credential) (string, error)
+	// Download fetches a signed file url through the proxies.
+	Download(url string) ([]byte, error)
+	// UploadFile uploads a file for use in a multimodal message and returns
+	// its file id.
+	UploadFile(name string, mimeType string, data []byte, cred Credential) (string, error)
+	// Gizmo fetches the definition of a gizmo (custom GPT).
+	Gizmo(id string, cred Credential) (json.RawMessage, error)
+}
+
+// newClient builds an upstream tls-client from the configured options, with
+// a cookie jar of its own.
+func newClient(cfg ClientConfig, proxy string) (tlsclient.HttpClient, error) {
+	options := []tlsclient.HttpClientOption{
+		tlsclient.WithTimeoutSeconds(int(time.Duration(cfg.Timeout) / time.Second)),
+		tlsclient.WithClientProfile(profiles.MappedTLSClients[cfg.Profile]),
+		tlsclient.WithCookieJar(tlsclient.NewCookieJar()), // create cookieJar instance and pass it as argument
+	}
+	if proxy != "" {
+		options = append(options, tlsclient.WithProxyUrl(proxy))
+	}
+	if !cfg.FollowRedirects {
+		options = append(options, tlsclient.WithNotFollowRedirects())
+	}
+	if cfg.InsecureSkipVerify {
+		// Disable SSL verification
+		options = append(options, tlsclient.WithInsecureSkipVerify())
+	}
+	return tlsclient.NewHttpClient(tlsclient.NewNoopLogger(), options...)
+}
+
+// newUpstream picks the upstream for cfg: the scripted fake when
+// fake_upstream is set, the real web backend otherwise.
+func newUpstream(cfg Config, proxies *proxyPool) (Upstream, error) {
+	if cfg.FakeUpstream != "" {
+		transcript, err := os.ReadFile(cfg.FakeUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("fake upstream: %w", err)
+		}
+		return NewFakeUpstream(FakeReply{Body: string(transcript)}), nil
+	}
+	return newWebUpstream(cfg, proxies)
+}
+
+// webUpstream talks to the real web backend. Every request goes through
+// the session of its credential; arkose tokens are fetched with clients of
+// their own.
+type webUpstream struct {
+	arkose   *arkoseSolver
+	sessions *sessionManager
+	proxies  *proxyPool
+}
+
+func newWebUpstream(cfg Config, proxies *proxyPool) (*webUpstream, error) {
+	sessions := newSessionManager(cfg.Client, proxies)
+	go sessions.run(time.Duration(cfg.Sessions.IdleTimeout))
+	go proxies.run(cfg.Client)
+	return &webUpstream{arkose: newArkoseSolver(cfg.Client), sessions: sessions, proxies: proxies}, nil
+}
+
+// arkoseSolver fetches arkose tokens with one client per proxy. The
+// funcaptcha package works on a package-level client and rotates shared
+// HAR state, so tokens are fetched one at a time, each with the client of
+// its proxy set explicitly.
+type arkoseSolver struct {
+	mu      sync.Mutex
+	cfg     ClientConfig
+	clients map[string]*tlsclient.HttpClient
+	// solve fetches a token with client.
+	solve func(client *tlsclient.HttpClient, puid string) (string, error)
+}
+
+func newArkoseSolver(cfg ClientConfig) *arkoseSolver {
+	return &arkoseSolver{cfg: cfg, clients: map[string]*tlsclient.HttpClient{}, solve: funcaptchaToken}
+}
+
+// Token fetches a token for puid through proxy, directProxy for none.
+func (s *arkoseSolver) Token(puid string, proxy string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[proxy]
+	if !ok {
+		c, err := newClient(s.cfg, proxy)
+		if err != nil {
+			return "", err
+		}
+		client = &c
+		s.clients[proxy] = client
+	}
+	return s.solve(client, puid)
+}
+
+func funcaptchaToken(client *tlsclient.HttpClient, puid string) (string, error) {
+	arkose.SetTLSClient(client)
+	// The client already has its proxy, funcaptcha only sets a non-empty one
+	return arkose.GetOpenAIAuthToken(puid, "")
+}
+
+// do sends request through cred's session. When the proxy fails to
+// deliver it, the request is retried once on every other proxy of the pool;
+// a POST only while nothing of it was sent yet, since the backend may
+// already act on it. Cancelled requests count against no proxy.
+func (u *webUpstream) do(request *http.Request, cred Credential) (*http.Response, error) {
+	avoid := map[string]bool{}
+	for {
+		client, proxy, err := u.sessions.Client(cred, avoid)
+		if err != nil {
+			return nil, err
+		}
+		var sent int32
+		trace := &httptrace.ClientTrace{WroteHeaders: func() { atomic.StoreInt32(&sent, 1) }}
+		start := time.Now()
+		response, err := client.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+		if err != nil && request.Context().Err() != nil {
+			return nil, err
+		}
+		u.proxies.Report(proxy, time.Since(start), err, false)
+		if err == nil {
+			return response, nil
+		}
+		avoid[proxy] = true
+		if len(avoid) >= u.proxies.Len() || (request.Body != nil && request.GetBody == nil) {
+			return nil, err
+		}
+		if request.Method == http.MethodPost && atomic.LoadInt32(&sent) != 0 {
+			return nil, err
+		}
+		fmt.Println("Retrying through another proxy, "+redactProxy(proxy)+" failed: ", err)
+		if request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (u *webUpstream) ArkoseToken(cred Credential) (string, error) {
+	return u.arkose.Token(cred.PUID, u.proxies.Pick(cred.sessionKey(), nil))
+}
+
+func (u *webUpstream) Conversation(ctx context.Context, message ChatGPTRequest, cred Credential) (*http.Response, error) {
+	// JSONify the body and add it to the request
+	bodyJson, err := json.Marshal(message)
+	if err != nil {
+		return &http.Response{}, err
+	}
+
+	request, err := newUpstreamRequest(http.MethodPost, cred.Endpoints().Conversation(), bytes.NewBuffer(bodyJson), cred)
+	if err != nil {
+		return &http.Response{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	// The web client stops a generation by aborting its request, the
+	// backend then stops generating for the account
+	ctx, cancel := context.WithCancel(ctx)
+	response, err := u.do(request.WithContext(ctx), cred)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response.Body = cancelBody{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// cancelBody cancels the request of a response when its body is closed,
+// even where the transport would rather drain the body to reuse the
+// connection.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (u *webUpstream) Models(cred Credential) ([]UpstreamModel, error) {
+	request, err := newUpstreamRequest(http.MethodGet, cred.Endpoints().Models(), nil, cred)
+	if err != nil {
+		return nil, err
+	}
+	response, err := u.do(request, cred)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("models: upstream returned %s", response.Status)
+	}
+	var list upstreamModelList
+	if err = json.NewDecoder(response.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("models: %w", err)
+	}
+	return list.Models, nil
+}
+
+func (u *webUpstream) FileDownloadURL(fileID string, cred Credential) (string, error) {
+	request, err := newUpstreamRequest(http.MethodGet, cred.Endpoints().FileDownload(fileID), nil, cred)
+	if err != nil {
+		return "", err
+	}
+	response, err := u.do(request, cred)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var download struct {
+		Status      string `json:"status"`
+		DownloadURL string `json:"download_url"`
+		ErrorCode   string `json:"error_code"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&download); err != nil {
+		return "", fmt.Errorf("file %s: %w", fileID, err)
+	}
+	if response.StatusCode != http.StatusOK || download.DownloadURL == "" {
+		return "", fmt.Errorf("file %s: upstream returned %s %s", fileID, response.Status, download.ErrorCode)
+	}
+	return download.DownloadURL, nil
+}
+
+func (u *webUpstream) Download(url string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Signed urls need no account, use the session of the empty credential
+	response, err := u.do(request, Credential{})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download: upstream returned %s", response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxDownloadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDownloadBytes {
+		return nil, fmt.Errorf("download: file is larger than %d MB", maxDownloadBytes>>20)
+	}
+	return data, nil
+}
+
+// maxDownloadBytes bounds what Download reads into memory.
+const maxDownloadBytes = 64 << 20
+
+// UploadFile creates the file, puts its content to the blob url the backend
+// hands out and confirms the upload, the way the web client attaches files.
+func (u *webUpstream) UploadFile(name string, mimeType string, data []byte, cred Credential) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"file_name": name,
+		"file_size": len(data),
+		"use_case":  "multimodal",
+	})
+	if err != nil {
+		return "", err
+	}
+	request, err := newUpstreamRequest(http.MethodPost, cred.Endpoints().Files(), bytes.NewReader(body), cred)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := u.do(request, cred)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		Status    string `json:"status"`
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+		ErrorCode string `json:"error_code"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&created)
+	response.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("upload: %w", err)
+	}
+	if response.StatusCode != http.StatusOK || created.UploadURL == "" || created.FileID == "" {
+		return "", fmt.Errorf("upload: upstream returned %s %s", response.Status, created.ErrorCode)
+	}
+
+	request, err = http.NewRequest(http.MethodPut, created.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", mimeType)
+	request.Header.Set("x-ms-blob-type", "BlockBlob")
+	request.Header.Set("x-ms-version", "2020-04-08")
+	response, err = u.do(request, cred)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upload: blob storage returned %s", response.Status)
+	}
+
+	request, err = newUpstreamRequest(http.MethodPost, cred.Endpoints().FileUploaded(created.FileID), strings.NewReader("{}"), cred)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err = u.do(request, cred)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upload: confirming %s returned %s", created.FileID, response.Status)
+	}
+	return created.FileID, nil
+}
+
+func (u *webUpstream) Gizmo(id string, cred Credential) (json.RawMessage, error) {
+	request, err := newUpstreamRequest(http.MethodGet, cred.Endpoints().Gizmo(id), nil, cred)
+	if err != nil {
+		return nil, err
+	}
+	response, err := u.do(request, cred)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gizmo %s: upstream returned %s", id, response.Status)
+	}
+	var definition struct {
+		Gizmo json.RawMessage `json:"gizmo"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&definition); err != nil {
+		return nil, fmt.Errorf("gizmo %s: %w", id, err)
+	}
+	if len(definition.Gizmo) == 0 {
+		return nil, fmt.Errorf("gizmo %s: empty definition", id)
+	}
+	return definition.Gizmo, nil
+}
+
+// newUpstreamRequest builds a backend request authenticated as cred.
+func newUpstreamRequest(method string, url string, body io.Reader, cred Credential) (*http.Request, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	// Clear cookies
+	if cred.PUID != "" {
+		request.Header.Set("Cookie", "_puid="+cred.PUID+";")
+	}
+	request.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/112.0.0.0 Safari/537.36")
+	request.Header.Set("Accept", "*/*")
+	if cred.AccessToken != "" {
+		request.Header.Set("Authorization", "Bearer "+cred.AccessToken)
+	}
+	return request, nil
+}
+
+// FakeReply is one scripted upstream response.
+type FakeReply struct {
+	// StatusCode defaults to 200.
+	StatusCode int
+	// Body is the raw response body, usually built with SSEBody.
+	Body string
+	// Err, if set, is returned instead of a response.
+	Err error
+}
+
+// SSEBody renders each payload as a "data:" event, the way the web backend
+// frames its conversation stream. Append "[DONE]" to end the stream.
+func SSEBody(payloads ...string) string {
+	var b strings.Builder
+	for _, payload := range payloads {
+		b.WriteString("data: ")
+		b.WriteString(payload)
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+// FakeUpstream replays scripted replies in order without touching the
+// network. Once the script runs out the last reply is repeated.
+type FakeUpstream struct {
+	mu       sync.Mutex
+	replies  []FakeReply
+	next     int
+	requests []ChatGPTRequest
+}
+
+func NewFakeUpstream(replies ...FakeReply) *FakeUpstream {
+	return &FakeUpstream{replies: replies}
+}
+
+func (u *FakeUpstream) ArkoseToken(Credential) (string, error) {
+	return "", nil
+}
+
+func (u *FakeUpstream) Conversation(_ context.Context, request ChatGPTRequest, _ Credential) (*http.Response, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.requests = append(u.requests, request)
+	if len(u.replies) == 0 {
+		return nil, errors.New("fake upstream: no scripted replies")
+	}
+	reply := u.replies[u.next]
+	if u.next < len(u.replies)-1 {
+		u.next++
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	status := reply.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := http.Header{}
+	if status == http.StatusOK {
+		header.Set("Content-Type", "text/event-stream")
+	} else {
+		header.Set("Content-Type", "application/json")
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(reply.Body)),
+	}, nil
+}
+
+func (u *FakeUpstream) Models(Credential) ([]UpstreamModel, error) {
+	return nil, nil
+}
+
+func (u *FakeUpstream) FileDownloadURL(fileID string, _ Credential) (string, error) {
+	return "https://files.fake.invalid/" + fileID, nil
+}
+
+func (u *FakeUpstream) Download(url string) ([]byte, error) {
+	return []byte("fake file " + url), nil
+}
+
+func (u *FakeUpstream) UploadFile(name string, _ string, data []byte, _ Credential) (string, error) {
+	return fmt.Sprintf("file-fake-%s-%d", name, len(data)), nil
+}
+
+func (u *FakeUpstream) Gizmo(id string, _ Credential) (json.RawMessage, error) {
+	return json.Marshal(map[string]string{"id": id, "name": "Fake gizmo"})
+}
+
+// Requests returns every request the fake has received so far.
+func (u *FakeUpstream) Requests() []ChatGPTRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]ChatGPTRequest(nil), u.requests...)
+}
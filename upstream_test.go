@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tlsclient "github.com/bogdanfinn/tls-client"
+)
+
+func TestArkoseSolverUsesTheClientOfItsProxy(t *testing.T) {
+	solver := newArkoseSolver(defaultConfig().Client)
+	// Like funcaptcha, the fake solves with a package-level client
+	var current *tlsclient.HttpClient
+	solver.solve = func(client *tlsclient.HttpClient, puid string) (string, error) {
+		current = client
+		time.Sleep(time.Millisecond)
+		return (*current).GetProxy(), nil
+	}
+
+	proxies := []string{directProxy, "http://127.0.0.1:8001", "socks5://127.0.0.1:8002"}
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		proxy := proxies[i%len(proxies)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := solver.Token("puid", proxy)
+			if err != nil {
+				errs <- err
+			} else if got != proxy {
+				errs <- fmt.Errorf("token for %q fetched through %q", proxy, got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(solver.clients) != len(proxies) {
+		t.Errorf("got %d clients for %d proxies", len(solver.clients), len(proxies))
+	}
+}
+
+func TestConversationCancelledOnClose(t *testing.T) {
+	cancelled := make(chan struct{})
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; ; i++ {
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			io.WriteString(w, SSEBody(snapshot("m1", strings.Repeat("word ", i), "")))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	cfg := defaultConfig()
+	cfg.Proxy = directProxy
+	pool := newProxyPool(cfg)
+	upstream := &webUpstream{sessions: newSessionManager(cfg.Client, pool), proxies: pool}
+	response, err := upstream.Conversation(context.Background(), ChatGPTRequest{Action: "next"}, Credential{BaseURL: backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := response.Body.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the backend kept generating after the body was closed")
+	}
+}